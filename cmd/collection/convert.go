@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	cm "github.com/mahdi-cpp/api-go-settings/internal/collection_manager_v3"
+)
+
+// runConvert converts a collection on disk. Collections the server has open
+// must be converted through POST /api/v1/collections/<name>/convert instead,
+// so the server switches over with them.
+func runConvert(args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	path := fs.String("path", "", "collection file (.json) or directory")
+	to := fs.String("to", "", "file or directory")
+	depth := fs.Int("depth", 0, "shard levels when converting to a directory")
+	_ = fs.Parse(args)
+
+	if *path == "" || *to == "" {
+		return errors.New("-path and -to are required")
+	}
+
+	manager, err := cm.NewCollectionManager[cm.Document](*path, true)
+	if err != nil {
+		return err
+	}
+
+	report, err := manager.Convert(cm.StorageKind(*to), *depth)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("converted %d item(s) from %s to %s, checksum %s\n", report.Items, report.From, report.To, report.Checksum)
+	if report.Backup != "" {
+		fmt.Printf("original kept at %s\n", report.Backup)
+	}
+	return nil
+}
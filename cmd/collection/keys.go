@@ -0,0 +1,108 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cm "github.com/mahdi-cpp/api-go-settings/internal/collection_manager_v3"
+	"github.com/mahdi-cpp/api-go-settings/internal/config"
+)
+
+const dataKeyFile = ".datakey"
+
+// runRotateKeys rotates the encryption keys of every user directory under
+// -users that has data keys; the others are skipped. -master adds a master key and rewraps the data keys with it; -data
+// gives each user a new data key and re-encrypts their collections, which
+// also seals collections still stored as plain JSON.
+func runRotateKeys(args []string) error {
+	fs := flag.NewFlagSet("rotate-keys", flag.ExitOnError)
+	keyfile := fs.String("keyfile", config.GetKeyFilePath(), "master keyfile")
+	users := fs.String("users", config.GetPath("users"), "directory holding one directory per user")
+	master := fs.Bool("master", false, "add a new master key and rewrap the data keys with it")
+	data := fs.Bool("data", false, "rotate each user's data key and re-encrypt their collections")
+	_ = fs.Parse(args)
+
+	if *master {
+		version, err := cm.AddMasterKey(*keyfile)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("added master key %d\n", version)
+	}
+
+	ring, err := cm.LoadKeyring(*keyfile)
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(*users)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(*users, entry.Name())
+		keyPath := filepath.Join(dir, dataKeyFile)
+		if _, err := os.Stat(keyPath); errors.Is(err, os.ErrNotExist) {
+			// Rotating must not be what first encrypts a user's data.
+			fmt.Printf("%s: skipped, no %s\n", entry.Name(), dataKeyFile)
+			continue
+		} else if err != nil {
+			return fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		keys, err := cm.OpenDataKeys(ring, keyPath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+
+		if *master {
+			if err := keys.Rewrap(); err != nil {
+				return fmt.Errorf("%s: %w", entry.Name(), err)
+			}
+		}
+		if *data {
+			if err := keys.Rotate(); err != nil {
+				return fmt.Errorf("%s: %w", entry.Name(), err)
+			}
+			count, err := reencryptCollections(dir, keys)
+			if err != nil {
+				return fmt.Errorf("%s: %w", entry.Name(), err)
+			}
+			fmt.Printf("%s: re-encrypted %d item(s)\n", entry.Name(), count)
+		}
+	}
+	return nil
+}
+
+// reencryptCollections rewrites every collection directly inside dir, that
+// is each .json file and each directory, with the current data key.
+func reencryptCollections(dir string, keys *cm.DataKeys) (int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") || (!entry.IsDir() && filepath.Ext(name) != ".json") {
+			continue
+		}
+		manager, err := cm.NewCollectionManager[cm.Document](filepath.Join(dir, name), true, cm.WithEncryption(keys))
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", name, err)
+		}
+		count, err := manager.Reencrypt()
+		total += count
+		if err != nil {
+			return total, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return total, nil
+}
@@ -0,0 +1,53 @@
+// Command collection runs maintenance tasks against collection_manager_v3
+// collections on disk.
+//
+//	collection export -path /app/iris/com.iris.photos/albums.json -format csv > albums.csv
+//	collection import -path /app/iris/com.iris.photos/albums.json -format csv -on-conflict upsert < albums.csv
+//	collection convert -path /app/iris/com.iris.photos/albums.json -to directory -depth 1
+//	collection reshard -path /app/iris/com.iris.photos/users/<id>/assets -depth 2
+//	collection rotate-keys -master -data
+//	collection verify
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+var commands = map[string]func(args []string) error{
+	"convert":     runConvert,
+	"export":      runExport,
+	"import":      runImport,
+	"reshard":     runReshard,
+	"rotate-keys": runRotateKeys,
+	"verify":      runVerify,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err := run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "collection %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "usage: collection <command> [flags]\n\ncommands: %v\n", names)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	cm "github.com/mahdi-cpp/api-go-settings/internal/collection_manager_v3"
+)
+
+func runReshard(args []string) error {
+	fs := flag.NewFlagSet("reshard", flag.ExitOnError)
+	path := fs.String("path", "", "directory collection")
+	depth := fs.Int("depth", 2, "shard levels, 0 for the flat layout")
+	_ = fs.Parse(args)
+
+	if *path == "" {
+		return errors.New("-path is required")
+	}
+
+	moved, err := cm.Reshard(*path, *depth)
+	fmt.Printf("moved %d item file(s)\n", moved)
+	return err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"os"
+
+	cm "github.com/mahdi-cpp/api-go-settings/internal/collection_manager_v3"
+)
+
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	path := fs.String("path", "", "collection file (.json) or directory")
+	format := fs.String("format", string(cm.FormatJSONL), "jsonl or csv")
+	columns := fs.String("columns", "", "CSV columns as header:field,... (default: all fields)")
+	out := fs.String("out", "", "output file (default: stdout)")
+	_ = fs.Parse(args)
+
+	if *path == "" {
+		return errors.New("-path is required")
+	}
+
+	manager, err := cm.NewCollectionManager[cm.Document](*path, true)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return manager.Export(w, cm.ExportOptions{
+		Format:  cm.Format(*format),
+		Columns: cm.ParseColumns(*columns),
+	})
+}
+
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	path := fs.String("path", "", "collection file (.json) or directory")
+	format := fs.String("format", string(cm.FormatJSONL), "jsonl or csv")
+	columns := fs.String("columns", "", "CSV columns as header:field,... (default: header row)")
+	onConflict := fs.String("on-conflict", string(cm.ConflictFail), "upsert, skip or fail")
+	in := fs.String("in", "", "input file (default: stdin)")
+	_ = fs.Parse(args)
+
+	if *path == "" {
+		return errors.New("-path is required")
+	}
+
+	manager, err := cm.NewCollectionManager[cm.Document](*path, false)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	report, importErr := manager.Import(r, cm.ImportOptions{
+		Format:     cm.Format(*format),
+		OnConflict: cm.ConflictPolicy(*onConflict),
+		Columns:    cm.ParseColumns(*columns),
+	})
+
+	enc := json.NewEncoder(os.Stderr)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(report)
+	return importErr
+}
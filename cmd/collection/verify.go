@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	cm "github.com/mahdi-cpp/api-go-settings/internal/collection_manager_v3"
+	"github.com/mahdi-cpp/api-go-settings/internal/config"
+)
+
+// runVerify checks collections against their checksum logs: the one at
+// -path, or every collection under -root that has a log. Encrypted
+// collections are opened with the data keys of the user directory they are
+// in, using the master keys from -keyfile.
+func runVerify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	path := flags.String("path", "", "single collection to verify")
+	root := flags.String("root", config.GetPath(""), "tree to scan for collections")
+	keyfile := flags.String("keyfile", config.GetKeyFilePath(), "master keyfile for encrypted collections")
+	_ = flags.Parse(args)
+
+	paths := []string{*path}
+	if *path == "" {
+		var err error
+		if paths, err = findCollections(*root); err != nil {
+			return err
+		}
+	}
+
+	keys := &keyCache{keyfile: *keyfile, root: *root}
+	failed := 0
+	for _, p := range paths {
+		cipher, err := keys.cipherFor(p)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+		report, err := cm.Verify(p, cipher)
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL %s: %v\n", p, err)
+			for _, item := range report.Corrupted {
+				fmt.Printf("     corrupted %s: %s\n", item.ID, item.Reason)
+			}
+			for _, id := range report.Missing {
+				fmt.Printf("     missing %s\n", id)
+			}
+			continue
+		}
+		fmt.Printf("ok   %s: %d item(s), %d untracked\n", p, report.Items, report.Untracked)
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d collection(s) failed verification", failed, len(paths))
+	}
+	return nil
+}
+
+// findCollections returns every collection under root with a checksum log:
+// a ".checksums" file marks a directory collection, "<name>.sum" the
+// single-file collection "<name>".
+func findCollections(root string) ([]string, error) {
+	var paths []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		switch {
+		case d.Name() == ".checksums":
+			paths = append(paths, filepath.Dir(p))
+		case strings.HasSuffix(p, ".sum"):
+			if _, err := os.Stat(strings.TrimSuffix(p, ".sum")); err == nil {
+				paths = append(paths, strings.TrimSuffix(p, ".sum"))
+			}
+		}
+		return nil
+	})
+	return paths, err
+}
+
+// keyCache finds the data keys that apply to a collection: those in the
+// nearest directory, up to root, holding a data key file.
+type keyCache struct {
+	keyfile string
+	root    string
+	ring    *cm.Keyring
+	keys    map[string]*cm.DataKeys
+}
+
+func (k *keyCache) cipherFor(path string) (cm.Cipher, error) {
+	root := filepath.Clean(k.root)
+	for dir := filepath.Dir(filepath.Clean(path)); ; dir = filepath.Dir(dir) {
+		keyPath := filepath.Join(dir, dataKeyFile)
+		if _, err := os.Stat(keyPath); err == nil {
+			return k.open(keyPath)
+		}
+		if dir == root || dir == filepath.Dir(dir) {
+			return nil, nil
+		}
+	}
+}
+
+func (k *keyCache) open(keyPath string) (cm.Cipher, error) {
+	if keys, ok := k.keys[keyPath]; ok {
+		return keys, nil
+	}
+	if k.ring == nil {
+		ring, err := cm.LoadKeyring(k.keyfile)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("found %s but no keyfile at %s", keyPath, k.keyfile)
+		}
+		if err != nil {
+			return nil, err
+		}
+		k.ring = ring
+		k.keys = map[string]*cm.DataKeys{}
+	}
+	keys, err := cm.OpenDataKeys(k.ring, keyPath)
+	if err != nil {
+		return nil, err
+	}
+	k.keys[keyPath] = keys
+	return keys, nil
+}
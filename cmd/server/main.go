@@ -1,59 +1,195 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"log"
+	"os"
+	"time"
 
+	"github.com/cshum/vipsgen/vips"
 	"github.com/gin-gonic/gin"
 	"github.com/mahdi-cpp/api-go-settings/internal/api/handler"
 	"github.com/mahdi-cpp/api-go-settings/internal/application"
+	"github.com/mahdi-cpp/api-go-settings/internal/auth"
+	cm "github.com/mahdi-cpp/api-go-settings/internal/collection_manager_v3"
+	"github.com/mahdi-cpp/api-go-settings/internal/config"
+	"github.com/mahdi-cpp/api-go-settings/internal/imagemeta"
+	"github.com/mahdi-cpp/api-go-settings/internal/jobs"
+	"github.com/mahdi-cpp/api-go-settings/internal/snapshot"
 )
 
+// usersCollection holds a document per user, keyed by user ID.
+const usersCollection = "users.json"
+
+// collectionOptions lists the collections an admin may convert between
+// single-file and directory storage over the API, and the fields each
+// searchable collection is indexed by.
+var collectionOptions = handler.CollectionOptions{}
+
 func main() {
 
+	vips.Startup(nil)
+	defer vips.Shutdown()
+
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
 	// Load HTML templates
 	router.LoadHTMLGlob("/app/tmp/templates/*")
 
+	// Requests are made by the user their bearer token was issued to
+	signer, err := auth.LoadSigner(config.GetTokenKeyPath())
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Uploads are processed in the background, by jobs kept in the data
+	// tree so snapshots hold the work accepted with the uploads
+	jobOptions := jobs.DefaultOptions()
+	jobOptions.Gate = snapshot.DefaultGate
+	queue, err := jobs.NewQueue(config.GetPath("jobs"), jobOptions)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if n, err := queue.Import("/app/tmp/jobs"); err != nil {
+		log.Fatal(err)
+	} else if n > 0 {
+		log.Printf("moved %d jobs into the data tree", n)
+	}
+
+	// Asset records are sealed with per-user data keys, wrapped by the
+	// master keys in the keyfile
+	ring, err := loadKeyring(config.GetKeyFilePath())
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Create upload handler
-	uploadHandler := &handler.UploadHandler{
-		UploadDir: "/app/tmp/uploads",
+	uploadHandler, err := handler.NewUploadHandler("/app/tmp/uploads", 200<<20, handler.Quota{
+		MaxBytes: 20 << 30,
+		MaxFiles: 100000,
+	}, queue, ring)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tusHandler, err := handler.NewTusHandler(uploadHandler)
+	if err != nil {
+		log.Fatal(err)
 	}
 	// Setup routes
-	setupRoutes(router, uploadHandler)
+	setupRoutes(router, signer, uploadHandler, tusHandler)
 
 	newAppManager, err := application.NewAppManager()
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	downloadHandler := handler.NewDownloadHandler(newAppManager)
-	routDownloadHandler(downloadHandler)
+	// Originals are served as stored; pass imagemeta.Private to strip
+	// location, serial numbers and owner names from them as well.
+	downloadHandler := handler.NewDownloadHandler(newAppManager, imagemeta.Policy{})
+	routDownloadHandler(signer, downloadHandler)
+
+	collectionHandler := handler.NewCollectionHandler(collectionOptions)
+	routCollectionHandler(signer, collectionHandler)
+	// Deleting a user's document deletes their asset records with it
+	users, err := collectionHandler.Collection(usersCollection)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := uploadHandler.ReferenceUsers(users); err != nil {
+		log.Fatal(err)
+	}
+
+	snapshotOptions := snapshot.DefaultOptions()
+	snapshot.StartScheduler(ctx, snapshotOptions, 24*time.Hour, snapshot.DefaultPolicy)
+	routSnapshotHandler(signer, handler.NewSnapshotHandler(snapshotOptions))
+
+	routJobHandler(signer, handler.NewJobHandler(queue))
+	queue.Start(ctx)
 
 	startServer(router)
 }
 
-func setupRoutes(router *gin.Engine, uploadHandler *handler.UploadHandler) {
+// loadKeyring loads the master keys, creating the keyfile with a first key
+// on the first start.
+func loadKeyring(keyfile string) (*cm.Keyring, error) {
+	ring, err := cm.LoadKeyring(keyfile)
+	if errors.Is(err, os.ErrNotExist) {
+		if _, err := cm.AddMasterKey(keyfile); err != nil {
+			return nil, err
+		}
+		return cm.LoadKeyring(keyfile)
+	}
+	return ring, err
+}
+
+func setupRoutes(router *gin.Engine, signer *auth.Signer, uploadHandler *handler.UploadHandler, tusHandler *handler.TusHandler) {
 	// Serve upload form
 	router.GET("/", func(c *gin.Context) {
 		c.HTML(200, "index.html", nil)
 	})
 
 	// Setup upload routes
-	routUploadHandler(router, uploadHandler)
+	routUploadHandler(router, signer, uploadHandler, tusHandler)
 }
 
-func routUploadHandler(router *gin.Engine, uploadHandler *handler.UploadHandler) {
-	api := router.Group("/api/v1/upload")
+func routUploadHandler(router *gin.Engine, signer *auth.Signer, uploadHandler *handler.UploadHandler, tusHandler *handler.TusHandler) {
+	// tus clients discover the server before they authenticate
+	router.OPTIONS("/api/v1/upload/tus", tusHandler.Protocol, tusHandler.Options)
+
+	api := router.Group("/api/v1/upload", signer.Authenticate)
 
 	api.POST("/jpeg", uploadHandler.UploadJPEG)
+	api.POST("/image", uploadHandler.UploadImage)
 	api.POST("/multiple", uploadHandler.UploadMultiple)
 	api.GET("/files", uploadHandler.ListFiles)
+	api.GET("/usage", uploadHandler.Usage)
+	api.GET("/assets/:id/metadata", uploadHandler.AssetMetadata)
+
+	tus := api.Group("/tus", tusHandler.Protocol)
+	tus.POST("", tusHandler.Create)
+	tus.GET("/:id", tusHandler.Get)
+	tus.HEAD("/:id", tusHandler.Head)
+	tus.PATCH("/:id", tusHandler.Patch)
+	tus.DELETE("/:id", tusHandler.Delete)
 }
 
-func routDownloadHandler(userHandler *handler.DownloadHandler) {
+func routDownloadHandler(signer *auth.Signer, userHandler *handler.DownloadHandler) {
 
 	api := router.Group("/api/v1/download")
 
-	api.GET("original/*filename", userHandler.ImageOriginal)
+	api.GET("original/*filename", signer.Authenticate, userHandler.ImageOriginal)
 	api.GET("thumbnail/*filename", userHandler.ImageThumbnail)
 	api.GET("icon/*filename", userHandler.ImageIcons)
 }
+
+func routCollectionHandler(signer *auth.Signer, collectionHandler *handler.CollectionHandler) {
+
+	api := router.Group("/api/v1/collections", signer.Authenticate, auth.RequireAdmin)
+
+	api.GET(":name", collectionHandler.List)
+	api.GET(":name/export", collectionHandler.Export)
+	api.POST(":name/import", collectionHandler.Import)
+	api.POST(":name/convert", collectionHandler.Convert)
+	api.GET(":name/stats", collectionHandler.Stats)
+	api.GET(":name/search", collectionHandler.Search)
+	api.DELETE(":name/items/:id", collectionHandler.Delete)
+}
+
+func routSnapshotHandler(signer *auth.Signer, snapshotHandler *handler.SnapshotHandler) {
+
+	api := router.Group("/api/v1/snapshots", signer.Authenticate, auth.RequireAdmin)
+
+	api.GET("", snapshotHandler.List)
+	api.POST("", snapshotHandler.Create)
+}
+
+func routJobHandler(signer *auth.Signer, jobHandler *handler.JobHandler) {
+
+	api := router.Group("/api/v1/jobs", signer.Authenticate)
+
+	api.GET("dead", jobHandler.Dead)
+	api.GET(":id", jobHandler.Get)
+	api.POST(":id/retry", jobHandler.Retry)
+}
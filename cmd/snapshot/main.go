@@ -0,0 +1,130 @@
+// Command snapshot creates, lists, restores and prunes snapshots of the
+// /app/iris data tree.
+//
+//	snapshot create
+//	snapshot list
+//	snapshot restore -name iris-20250101T030000Z.tar.gz
+//	snapshot prune -keep-last 3 -keep-daily 7 -keep-weekly 4 -keep-monthly 6
+//
+// create only waits for writers inside its own process, so while the server
+// runs, snapshots are taken through POST /api/v1/snapshots instead; restore
+// needs the server stopped.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/mahdi-cpp/api-go-settings/internal/snapshot"
+)
+
+var commands = map[string]func(args []string) error{
+	"create":  runCreate,
+	"list":    runList,
+	"restore": runRestore,
+	"prune":   runPrune,
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	run, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+
+	if err := run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "snapshot %s: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(os.Stderr, "usage: snapshot <command> [flags]\n\ncommands: %v\n", names)
+}
+
+func optionFlags(fs *flag.FlagSet) *snapshot.Options {
+	opts := snapshot.DefaultOptions()
+	fs.StringVar(&opts.Root, "root", opts.Root, "data tree")
+	fs.StringVar(&opts.Dir, "dir", opts.Dir, "snapshot directory")
+	return &opts
+}
+
+func runCreate(args []string) error {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	opts := optionFlags(fs)
+	_ = fs.Parse(args)
+
+	info, err := snapshot.Create(*opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("created %s (%d bytes)\n", info.Path, info.Size)
+	return nil
+}
+
+func runList(args []string) error {
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	opts := optionFlags(fs)
+	_ = fs.Parse(args)
+
+	infos, err := snapshot.List(opts.Dir)
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		fmt.Printf("%s  %s  %d\n", info.Name, info.Time.Format("2006-01-02 15:04:05"), info.Size)
+	}
+	return nil
+}
+
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	opts := optionFlags(fs)
+	name := fs.String("name", "", "snapshot to restore, as printed by list")
+	_ = fs.Parse(args)
+
+	if *name == "" {
+		return errors.New("-name is required")
+	}
+
+	previous, err := snapshot.Restore(*opts, *name)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("restored %s into %s\n", *name, opts.Root)
+	if previous != "" {
+		fmt.Printf("previous data kept at %s\n", previous)
+	}
+	return nil
+}
+
+func runPrune(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	opts := optionFlags(fs)
+	policy := snapshot.DefaultPolicy
+	fs.IntVar(&policy.KeepLast, "keep-last", policy.KeepLast, "newest snapshots to keep")
+	fs.IntVar(&policy.KeepDaily, "keep-daily", policy.KeepDaily, "days to keep one snapshot of")
+	fs.IntVar(&policy.KeepWeekly, "keep-weekly", policy.KeepWeekly, "weeks to keep one snapshot of")
+	fs.IntVar(&policy.KeepMonthly, "keep-monthly", policy.KeepMonthly, "months to keep one snapshot of")
+	_ = fs.Parse(args)
+
+	removed, err := snapshot.Prune(opts.Dir, policy)
+	for _, info := range removed {
+		fmt.Printf("removed %s\n", info.Name)
+	}
+	return err
+}
@@ -0,0 +1,42 @@
+// Command token issues bearer tokens for the server's API, signed with the
+// key the server verifies them with.
+//
+//	token -user 989121234567
+//	token -user ops -admin -ttl 1h
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mahdi-cpp/api-go-settings/internal/auth"
+	"github.com/mahdi-cpp/api-go-settings/internal/config"
+)
+
+func main() {
+	keyfile := flag.String("keyfile", config.GetTokenKeyPath(), "token signing key")
+	user := flag.String("user", "", "user ID the token is for")
+	admin := flag.Bool("admin", false, "grant admin rights")
+	ttl := flag.Duration("ttl", 24*time.Hour, "how long the token is valid")
+	flag.Parse()
+
+	if err := run(*keyfile, *user, *admin, *ttl); err != nil {
+		fmt.Fprintf(os.Stderr, "token: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(keyfile string, user string, admin bool, ttl time.Duration) error {
+	signer, err := auth.LoadSigner(keyfile)
+	if err != nil {
+		return err
+	}
+	token, err := signer.Issue(user, admin, ttl)
+	if err != nil {
+		return err
+	}
+	fmt.Println(token)
+	return nil
+}
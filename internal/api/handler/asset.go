@@ -0,0 +1,398 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mahdi-cpp/api-go-pkg/metadata"
+	cm "github.com/mahdi-cpp/api-go-settings/internal/collection_manager_v3"
+	"github.com/mahdi-cpp/api-go-settings/internal/config"
+	"github.com/mahdi-cpp/api-go-settings/internal/imagemeta"
+	"github.com/mahdi-cpp/api-go-settings/internal/snapshot"
+)
+
+// Asset is the record kept for every stored original.
+type Asset struct {
+	ID               string              `json:"id"`
+	UserID           string              `json:"userID"`
+	Filename         string              `json:"filename"`         // name the original is stored under
+	OriginalFilename string              `json:"originalFilename"` // name the client gave it
+	Size             int64               `json:"size"`
+	SHA256           string              `json:"sha256"`
+	MimeType         string              `json:"mimeType"`
+	Width            int                 `json:"width"`
+	Height           int                 `json:"height"`
+	Orientation      int                 `json:"orientation"`
+	Thumbnails       []string            `json:"thumbnails,omitempty"`
+	Metadata         *imagemeta.Metadata `json:"metadata,omitempty"`
+	CreationDate     time.Time           `json:"creationDate"`
+	ModificationDate time.Time           `json:"modificationDate"`
+}
+
+func (a *Asset) SetID(id string)          { a.ID = id }
+func (a *Asset) SetCreatedAt(t time.Time) { a.CreationDate = t }
+func (a *Asset) SetUpdatedAt(t time.Time) { a.ModificationDate = t }
+func (a *Asset) GetID() string            { return a.ID }
+func (a *Asset) GetCreatedAt() time.Time  { return a.CreationDate }
+func (a *Asset) GetUpdatedAt() time.Time  { return a.ModificationDate }
+
+// ImageRecord is the sidecar <id>.json UploadImage used to write next to an
+// original before assets were kept in a collection. It is only read to
+// migrate such records.
+type ImageRecord struct {
+	ID          string    `json:"id"`
+	Filename    string    `json:"filename"`
+	Format      string    `json:"format"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Orientation int       `json:"orientation"`
+	Size        int64     `json:"size"`
+	SHA256      string    `json:"sha256"`
+	UploadedAt  time.Time `json:"uploadedAt"`
+}
+
+// assetStore keeps the asset records of each user in a directory collection
+// of their own, config.GetUserPath(user, "records"). With a keyring the
+// records are sealed with the user's data keys, kept in their .datakey file.
+type assetStore struct {
+	ring *cm.Keyring // nil stores records as plain JSON
+
+	mu     sync.Mutex
+	users  map[string]*cm.Manager[*Asset]
+	owners *cm.Manager[cm.Document] // see UploadHandler.ReferenceUsers
+}
+
+func newAssetStore(ring *cm.Keyring) *assetStore {
+	return &assetStore{ring: ring, users: map[string]*cm.Manager[*Asset]{}}
+}
+
+// of returns the asset records of user, opening them on first use.
+func (s *assetStore) of(user string) (*cm.Manager[*Asset], error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if records, ok := s.users[user]; ok {
+		return records, nil
+	}
+
+	opts := []cm.Option{cm.WithWriteGate(snapshot.DefaultGate)}
+	if s.ring != nil {
+		keys, err := cm.OpenDataKeys(s.ring, config.GetUserPath(user, ".datakey"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open data keys of %s: %w", user, err)
+		}
+		opts = append(opts, cm.WithEncryption(keys))
+	}
+	records, err := cm.NewCollectionManager[*Asset](config.GetUserPath(user, "records"), false, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load assets of %s: %w", user, err)
+	}
+	if s.owners != nil {
+		if err := referenceOwner(records, s.owners); err != nil {
+			return nil, err
+		}
+	}
+	s.users[user] = records
+	return records, nil
+}
+
+// referenceUsers ties the records of every user to users, opening the
+// records of each user in it. Records opened later are tied as they are.
+func (s *assetStore) referenceUsers(users *cm.Manager[cm.Document]) error {
+	s.mu.Lock()
+	s.owners = users
+	opened := make([]*cm.Manager[*Asset], 0, len(s.users))
+	for _, records := range s.users {
+		opened = append(opened, records)
+	}
+	s.mu.Unlock()
+
+	for _, records := range opened {
+		if err := referenceOwner(records, users); err != nil {
+			return err
+		}
+	}
+	docs, err := users.GetAll()
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if _, err := s.of(doc.GetID()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func referenceOwner(records *cm.Manager[*Asset], users *cm.Manager[cm.Document]) error {
+	if err := cm.Reference(records, "userID", users, cm.Cascade); err != nil {
+		return fmt.Errorf("failed to reference the owner of assets: %w", err)
+	}
+	return nil
+}
+
+// ReferenceUsers declares that asset records reference their owner in
+// users, a collection of user documents keyed by user ID. Deleting a user's
+// document then deletes their asset records with it, and ListFiles can
+// expand "userID" into the document.
+func (h *UploadHandler) ReferenceUsers(users *cm.Manager[cm.Document]) error {
+	return h.assets.referenceUsers(users)
+}
+
+// openLegacyAssets opens the collection all asset records were kept in
+// before they were kept per user. It is only read to migrate them.
+func openLegacyAssets(dir string) (*cm.Manager[*Asset], error) {
+	assets, err := cm.NewCollectionManager[*Asset](filepath.Join(dir, ".assets"), false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load assets: %w", err)
+	}
+	return assets, nil
+}
+
+// migrateLegacyAssets brings the originals and records of uploads made
+// before assets were kept per user into that form: originals in UploadDir
+// are recorded and moved to their owner's directory, and the records moved
+// from the shared collection to their owner's.
+func (h *UploadHandler) migrateLegacyAssets() error {
+	legacy, err := openLegacyAssets(h.UploadDir)
+	if err != nil {
+		return err
+	}
+	if n, err := h.migrateAssets(legacy); err != nil {
+		return err
+	} else if n > 0 {
+		log.Printf("migrated %d uploads to asset records", n)
+	}
+	if n, err := h.relocateOriginals(legacy); err != nil {
+		return err
+	} else if n > 0 {
+		log.Printf("moved %d originals to their owners' directories", n)
+	}
+	if n, err := h.moveRecords(legacy); err != nil {
+		return err
+	} else if n > 0 {
+		log.Printf("moved %d asset records to their owners' collections", n)
+	}
+	return nil
+}
+
+// moveRecords moves every record of legacy to its owner's collection,
+// queueing a thumbnail for those without one.
+func (h *UploadHandler) moveRecords(legacy *cm.Manager[*Asset]) (int, error) {
+	assets, err := legacy.GetAll()
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, asset := range assets {
+		records, err := h.assets.of(asset.UserID)
+		if err != nil {
+			return moved, err
+		}
+		created, err := records.CreateWithID(asset)
+		if err != nil && !errors.Is(err, cm.ErrDuplicateID) {
+			return moved, fmt.Errorf("failed to move the record of %s: %w", asset.ID, err)
+		}
+		if err == nil && len(created.Thumbnails) == 0 {
+			h.queueProcessing(created)
+		}
+		if err := legacy.Delete(asset.ID); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// migrateAssets records the originals in UploadDir that predate the asset
+// collection in legacy. ImageRecord sidecars are imported and removed;
+// originals with no record at all, as UploadJPEG used to store them, get one
+// built from their content and are accounted to anonymousUser.
+func (h *UploadHandler) migrateAssets(legacy *cm.Manager[*Asset]) (int, error) {
+	entries, err := os.ReadDir(h.UploadDir)
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, entry := range entries {
+		name := entry.Name()
+		ext := strings.ToLower(filepath.Ext(name))
+		if entry.IsDir() || strings.HasPrefix(name, ".") || !imageExtensions[ext] {
+			continue
+		}
+		id := strings.TrimSuffix(name, filepath.Ext(name))
+		if _, err := legacy.Get(id); err == nil {
+			continue
+		}
+
+		asset, err := h.legacyAsset(id, name)
+		if err != nil {
+			log.Printf("failed to migrate %s: %v", name, err)
+			continue
+		}
+		if _, err := legacy.CreateWithID(asset); err != nil {
+			return migrated, fmt.Errorf("failed to migrate %s: %w", name, err)
+		}
+		migrated++
+	}
+
+	// Sidecars are only removed once every original has its asset.
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".json" || strings.HasPrefix(name, ".") {
+			continue
+		}
+		if _, err := legacy.Get(strings.TrimSuffix(name, ".json")); err == nil {
+			os.Remove(filepath.Join(h.UploadDir, name))
+		}
+	}
+	return migrated, nil
+}
+
+// legacyAsset builds the asset of the original stored as name from its
+// sidecar, if it has one, and its content.
+func (h *UploadHandler) legacyAsset(id string, name string) (*Asset, error) {
+	path := filepath.Join(h.UploadDir, name)
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	asset := &Asset{
+		ID:               id,
+		UserID:           anonymousUser,
+		Filename:         name,
+		OriginalFilename: name,
+		Size:             fi.Size(),
+		CreationDate:     fi.ModTime(),
+		ModificationDate: fi.ModTime(),
+	}
+
+	sidecar := filepath.Join(h.UploadDir, id+".json")
+	if record, err := metadata.NewMetadataControl[ImageRecord](sidecar).Read(true); err == nil {
+		asset.SHA256 = record.SHA256
+		asset.MimeType = record.Format
+		asset.Width, asset.Height, asset.Orientation = record.Width, record.Height, record.Orientation
+		asset.CreationDate, asset.ModificationDate = record.UploadedAt, record.UploadedAt
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		if info, err := sniffFile(f); err == nil {
+			asset.MimeType = mimeType(info.Format)
+			asset.Width, asset.Height, asset.Orientation = info.Width, info.Height, info.Orientation
+			asset.Metadata = &info.Metadata
+		} else {
+			asset.MimeType = mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+		}
+	}
+
+	if asset.SHA256 == "" {
+		if asset.SHA256, err = fileSum(path); err != nil {
+			return nil, err
+		}
+	}
+	return asset, nil
+}
+
+// relocateOriginals moves the originals of legacy still in UploadDir,
+// stored before uploads were kept per user, to the assets directory of their
+// owner.
+func (h *UploadHandler) relocateOriginals(legacy *cm.Manager[*Asset]) (int, error) {
+	assets, err := legacy.GetAll()
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, asset := range assets {
+		src := filepath.Join(h.UploadDir, asset.Filename)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		dir := userAssetsDir(asset.UserID)
+		endWrite := snapshot.BeginWrite()
+		err := os.MkdirAll(dir, 0755)
+		if err == nil {
+			err = moveFile(src, filepath.Join(dir, asset.Filename))
+		}
+		endWrite()
+		if err != nil {
+			return moved, fmt.Errorf("failed to move %s: %w", asset.Filename, err)
+		}
+		moved++
+	}
+	return moved, nil
+}
+
+// thumbnailPath is where the thumbnail of asset is stored.
+func thumbnailPath(asset *Asset) string {
+	return filepath.Join(userThumbnailsDir(asset.UserID), asset.ID+".jpg")
+}
+
+func fileSum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	sum := sha256.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// AssetMetadata serves the metadata extracted from an asset's original.
+// Assets recorded before extraction existed have it extracted on first
+// request. Only the requesting user's own assets are found.
+// http://localhost:50150/api/v1/upload/assets/<id>/metadata
+func (h *UploadHandler) AssetMetadata(c *gin.Context) {
+	user, err := uploader(c)
+	if err != nil {
+		c.JSON(uploadStatus(err, http.StatusBadRequest), gin.H{"error": err.Error()})
+		return
+	}
+	records, err := h.assets.of(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load assets"})
+		return
+	}
+	asset, err := records.Get(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Asset not found"})
+		return
+	}
+
+	if asset.Metadata == nil {
+		meta, err := imagemeta.ExtractFile(filepath.Join(userAssetsDir(asset.UserID), asset.Filename))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read metadata"})
+			return
+		}
+		updated := *asset
+		updated.Metadata = &meta
+		if _, err := records.Update(&updated); err != nil {
+			log.Printf("failed to record metadata of %s: %v", asset.ID, err)
+		}
+		asset = &updated
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"id":       asset.ID,
+		"metadata": asset.Metadata,
+	})
+}
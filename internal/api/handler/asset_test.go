@@ -0,0 +1,289 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cshum/vipsgen/vips"
+	"github.com/gin-gonic/gin"
+	cm "github.com/mahdi-cpp/api-go-settings/internal/collection_manager_v3"
+	"github.com/mahdi-cpp/api-go-settings/internal/config"
+)
+
+// storeTestImage stores content as a JPEG original of user.
+func storeTestImage(t *testing.T, h *UploadHandler, user string, name string, content []byte) UploadResponse {
+	t.Helper()
+	res, err := h.storeImage(user, name, imageInfo{Format: vips.ImageTypeJpeg, Width: 4, Height: 3, Orientation: 1}, int64(len(content)), false, func(dst string) (string, error) {
+		if err := os.WriteFile(dst, content, 0644); err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(content)
+		return hex.EncodeToString(sum[:]), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestAssetRecordsSealedPerUser(t *testing.T) {
+	h := newTestUploads(t, 0, Quota{})
+	res := storeTestImage(t, h, "alice", "holiday.jpg", []byte("alice's picture"))
+
+	stored, err := os.ReadFile(filepath.Join(config.GetUserPath("alice", "records"), res.ID+".json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("holiday.jpg")) || json.Valid(stored) {
+		t.Fatalf("asset record stored in the clear: %q", stored)
+	}
+	if _, err := os.Stat(config.GetUserPath("alice", ".datakey")); err != nil {
+		t.Fatalf("no data keys for alice: %v", err)
+	}
+
+	r := gin.New()
+	r.GET("/files", testSigner.Authenticate, h.ListFiles)
+	for user, want := range map[string]int{"alice": 1, "bob": 0} {
+		req := httptest.NewRequest(http.MethodGet, "/files", nil)
+		req.Header.Set("Authorization", bearer(t, user))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", user, w.Code, w.Body)
+		}
+		var body struct {
+			Files []string `json:"files"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatal(err)
+		}
+		if len(body.Files) != want {
+			t.Errorf("%s lists %v, want %d file(s)", user, body.Files, want)
+		}
+	}
+}
+
+func TestStoreImageRollsBackWhenRecordFails(t *testing.T) {
+	h := newTestUploads(t, 0, Quota{})
+	// A records path that is no collection keeps the record from being
+	// written.
+	records := config.GetUserPath("alice", "records")
+	if err := os.MkdirAll(filepath.Dir(records), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(records, []byte("not a collection"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("alice's picture")
+	_, err := h.storeImage("alice", "a.jpg", imageInfo{Format: vips.ImageTypeJpeg}, int64(len(content)), false, func(dst string) (string, error) {
+		sum := sha256.Sum256(content)
+		return hex.EncodeToString(sum[:]), os.WriteFile(dst, content, 0644)
+	})
+	if err == nil {
+		t.Fatal("stored an image whose record could not be written")
+	}
+
+	if got := h.quotas.get("alice"); got.Bytes != 0 || got.Files != 0 {
+		t.Errorf("usage = %d bytes in %d files, want none", got.Bytes, got.Files)
+	}
+	if entries, _ := os.ReadDir(userAssetsDir("alice")); len(entries) != 0 {
+		t.Errorf("originals left behind: %v", entries)
+	}
+
+	// Once records can be written, the same content is stored anew rather
+	// than reported as a duplicate of the failed upload.
+	if err := os.Remove(records); err != nil {
+		t.Fatal(err)
+	}
+	if res := storeTestImage(t, h, "alice", "a.jpg", content); res.Duplicate {
+		t.Fatalf("content reported as already uploaded: %+v", res)
+	}
+}
+
+func TestDuplicateNeedsAssetRecord(t *testing.T) {
+	h := newTestUploads(t, 0, Quota{})
+	content := []byte("alice's picture")
+	first := storeTestImage(t, h, "alice", "a.jpg", content)
+
+	if again := storeTestImage(t, h, "alice", "b.jpg", content); !again.Duplicate || again.ID != first.ID {
+		t.Fatalf("second upload = %+v, want a duplicate of %s", again, first.ID)
+	}
+	if other := storeTestImage(t, h, "bob", "a.jpg", content); other.Duplicate {
+		t.Fatalf("content of another user reported as duplicate: %+v", other)
+	}
+
+	// The original is still on disk, but without its record it is no asset
+	// to point the client at.
+	records, err := h.assets.of("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := records.Delete(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if res := storeTestImage(t, h, "alice", "a.jpg", content); res.Duplicate || res.ID == first.ID {
+		t.Fatalf("upload after the record went = %+v, want a new asset", res)
+	}
+}
+
+func TestDuplicateNeverReachesAssetsDir(t *testing.T) {
+	h := newTestUploads(t, 0, Quota{})
+	content := []byte("alice's picture")
+	first := storeTestImage(t, h, "alice", "a.jpg", content)
+
+	var saved []string
+	res, err := h.storeImage("alice", "b.jpg", imageInfo{Format: vips.ImageTypeJpeg}, int64(len(content)), false, func(dst string) (string, error) {
+		saved = append(saved, dst)
+		if err := os.WriteFile(dst, content, 0644); err != nil {
+			return "", err
+		}
+		sum := sha256.Sum256(content)
+		return hex.EncodeToString(sum[:]), nil
+	})
+	if err != nil || !res.Duplicate || res.ID != first.ID {
+		t.Fatalf("second upload = %+v, %v; want a duplicate of %s", res, err, first.ID)
+	}
+	if len(saved) != 1 || filepath.Dir(saved[0]) != h.stagingDir() {
+		t.Fatalf("saved to %v, want the staging directory", saved)
+	}
+
+	entries, err := os.ReadDir(userAssetsDir("alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var originals []string
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".jpg" {
+			originals = append(originals, entry.Name())
+		}
+	}
+	if len(originals) != 1 || originals[0] != first.Filename {
+		t.Fatalf("originals %v, want only %s", originals, first.Filename)
+	}
+	if staged, _ := os.ReadDir(h.stagingDir()); len(staged) != 0 {
+		t.Fatalf("staging directory keeps %d files", len(staged))
+	}
+	if usage := h.quotas.get("alice"); usage.Files != 1 || usage.Bytes != int64(len(content)) {
+		t.Fatalf("usage %+v, want the first upload only", usage)
+	}
+}
+
+func TestLegacyContentIndexMigrated(t *testing.T) {
+	dir := t.TempDir()
+	legacy, err := cm.NewCollectionManager[*contentRef](filepath.Join(dir, ".contents.json"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []*contentRef{
+		{ID: contentKey("alice", "aaaa"), AssetID: "a1", Filename: "a1.jpg", Size: 3},
+		{ID: contentKey("bob", "bbbb"), AssetID: "b1", Filename: "b1.png", Size: 5},
+	} {
+		if _, err := legacy.CreateWithID(ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	index, err := newContents(dir, newAssetStore(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref, err := index.refs.Get(contentKey("bob", "bbbb")); err != nil || ref.AssetID != "b1" || ref.Size != 5 {
+		t.Fatalf("migrated entry: %+v, %v", ref, err)
+	}
+	if n := index.refs.Count(nil); n != 2 {
+		t.Fatalf("%d entries migrated, want 2", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, ".contents.json")); !os.IsNotExist(err) {
+		t.Fatalf("legacy index left behind: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, ".contents")); err != nil || !fi.IsDir() {
+		t.Fatalf("index is no directory collection: %v", err)
+	}
+
+	// Reopening finds the entries without the legacy file.
+	index, err = newContents(dir, newAssetStore(nil))
+	if err != nil || index.refs.Count(nil) != 2 {
+		t.Fatalf("reopened index: %v", err)
+	}
+}
+
+func TestAssetsReferenceTheirOwner(t *testing.T) {
+	h := newTestUploads(t, 0, Quota{})
+	collections := NewCollectionHandler(CollectionOptions{})
+	users, err := collections.Collection("users.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"alice", "bob"} {
+		if _, err := users.CreateWithID(cm.Document{"id": id, "name": id + "'s name"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// alice's records are open before the relation is declared, bob's after.
+	storeTestImage(t, h, "alice", "a.jpg", []byte("alice's picture"))
+	if err := h.ReferenceUsers(users); err != nil {
+		t.Fatal(err)
+	}
+	storeTestImage(t, h, "bob", "b.jpg", []byte("bob's picture"))
+
+	r := gin.New()
+	r.GET("/files", testSigner.Authenticate, h.ListFiles)
+	r.DELETE("/collections/:name/items/:id", collections.Delete)
+	list := func(user, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/files"+query, nil)
+		req.Header.Set("Authorization", bearer(t, user))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := list("alice", "?expand=userID")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var body struct {
+		Assets []struct {
+			UserID map[string]any `json:"userID"`
+			URL    string         `json:"url"`
+		} `json:"assets"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Assets) != 1 || body.Assets[0].UserID["name"] != "alice's name" || body.Assets[0].URL == "" {
+		t.Fatalf("expanded listing: %s", w.Body)
+	}
+	if w := list("alice", "?expand=owner"); w.Code != http.StatusBadRequest {
+		t.Fatalf("unknown relation: status %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	for _, user := range []string{"alice", "bob"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/collections/users.json/items/"+user, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("delete %s: status %d: %s", user, w.Code, w.Body)
+		}
+		records, err := h.assets.of(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := records.Count(nil); n != 0 {
+			t.Errorf("%s keeps %d asset record(s) after their user was deleted", user, n)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/collections/users.json/items/alice", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("second delete: status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
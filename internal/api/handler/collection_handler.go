@@ -0,0 +1,373 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	cm "github.com/mahdi-cpp/api-go-settings/internal/collection_manager_v3"
+	"github.com/mahdi-cpp/api-go-settings/internal/config"
+	"github.com/mahdi-cpp/api-go-settings/internal/snapshot"
+)
+
+var collectionNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+var (
+	errInvalidCollection  = errors.New("invalid collection name")
+	errCollectionNotFound = errors.New("collection not found")
+	errNotConvertible     = errors.New("collection is not registered for conversion")
+	errNotSearchable      = errors.New("collection has no search fields configured")
+)
+
+// CollectionHandler exposes the collections stored under config.GetPath by
+// name, as schema-less documents. "albums.json" is a single-file collection,
+// "albums" a directory collection. It sees the data of every user, so its
+// routes are for admin tokens only.
+type CollectionHandler struct {
+	mu          sync.Mutex
+	managers    map[string]*cm.Manager[cm.Document]
+	indexes     map[string]*cm.SearchIndex[cm.Document]
+	convertible map[string]bool
+	search      map[string][]string
+}
+
+// CollectionOptions registers the collections the handler does more with
+// than read and import.
+type CollectionOptions struct {
+	// Convertible names the collections Convert may rewrite. The data
+	// directory also holds trees, such as the users directory, that are not
+	// collections at all.
+	Convertible []string
+	// Search maps a collection name to the fields Search indexes. Each index
+	// is built on first use and kept current from then on.
+	Search map[string][]string
+}
+
+func NewCollectionHandler(opts CollectionOptions) *CollectionHandler {
+	h := &CollectionHandler{
+		managers:    make(map[string]*cm.Manager[cm.Document]),
+		indexes:     make(map[string]*cm.SearchIndex[cm.Document]),
+		convertible: make(map[string]bool, len(opts.Convertible)),
+		search:      opts.Search,
+	}
+	for _, name := range opts.Convertible {
+		h.convertible[name] = true
+	}
+	return h
+}
+
+// manager opens the named collection, creating it only when create is set.
+func (h *CollectionHandler) manager(name string, create bool) (*cm.Manager[cm.Document], error) {
+	if !collectionNamePattern.MatchString(name) || strings.Contains(name, "..") {
+		return nil, fmt.Errorf("%w: %q", errInvalidCollection, name)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if manager, ok := h.managers[name]; ok {
+		return manager, nil
+	}
+
+	path := config.GetPath(name)
+	if _, err := os.Stat(path); err != nil && !create {
+		return nil, fmt.Errorf("%w: %s", errCollectionNotFound, name)
+	}
+
+	manager, err := cm.NewCollectionManager[cm.Document](path, false, cm.WithWriteGate(snapshot.DefaultGate))
+	if err != nil {
+		return nil, err
+	}
+	h.managers[name] = manager
+	return manager, nil
+}
+
+// Collection opens the named collection, creating it on first write, for
+// code that works with it next to the handler.
+func (h *CollectionHandler) Collection(name string) (*cm.Manager[cm.Document], error) {
+	return h.manager(name, true)
+}
+
+func collectionError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, errCollectionNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, errInvalidCollection), errors.Is(err, errNotSearchable):
+		status = http.StatusBadRequest
+	}
+	c.JSON(status, gin.H{"error": err.Error()})
+}
+
+// http://localhost:50150/api/v1/collections/albums.json/export?format=csv&columns=id,title:name
+
+// Export streams a collection as JSON Lines or CSV.
+func (h *CollectionHandler) Export(c *gin.Context) {
+	manager, err := h.manager(c.Param("name"), false)
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+
+	opts := cm.ExportOptions{
+		Format:  cm.Format(c.DefaultQuery("format", string(cm.FormatJSONL))),
+		Columns: cm.ParseColumns(c.Query("columns")),
+	}
+
+	switch opts.Format {
+	case cm.FormatJSONL:
+		c.Header("Content-Type", "application/x-ndjson")
+	case cm.FormatCSV:
+		c.Header("Content-Type", "text/csv")
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be jsonl or csv"})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", c.Param("name")+"."+string(opts.Format)))
+	c.Status(http.StatusOK)
+
+	if err := manager.Export(c.Writer, opts); err != nil {
+		_ = c.Error(err)
+	}
+}
+
+// Import reads JSON Lines or CSV from the request body into a collection,
+// creating it if needed.
+func (h *CollectionHandler) Import(c *gin.Context) {
+	manager, err := h.manager(c.Param("name"), true)
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+
+	opts := cm.ImportOptions{
+		Format:     cm.Format(c.DefaultQuery("format", string(cm.FormatJSONL))),
+		OnConflict: cm.ConflictPolicy(c.DefaultQuery("onConflict", string(cm.ConflictFail))),
+		Columns:    cm.ParseColumns(c.Query("columns")),
+	}
+	switch opts.OnConflict {
+	case cm.ConflictUpsert, cm.ConflictSkip, cm.ConflictFail:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "onConflict must be upsert, skip or fail"})
+		return
+	}
+
+	report, err := manager.Import(c.Request.Body, opts)
+	if err != nil {
+		status := http.StatusBadRequest
+		if errors.Is(err, cm.ErrImportConflict) {
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error(), "report": report})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// http://localhost:50150/api/v1/collections/albums.json/convert?to=directory&depth=2
+
+// Convert switches a collection between single-file and directory storage
+// while it stays online. The name keeps addressing the collection afterwards.
+// Only collections listed in CollectionOptions.Convertible are converted.
+func (h *CollectionHandler) Convert(c *gin.Context) {
+	name := c.Param("name")
+	if !h.convertible[name] {
+		c.JSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("%v: %s", errNotConvertible, name)})
+		return
+	}
+	manager, err := h.manager(name, false)
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+
+	depth, err := strconv.Atoi(c.DefaultQuery("depth", "0"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "depth must be a number"})
+		return
+	}
+
+	report, err := manager.Convert(cm.StorageKind(c.Query("to")), depth)
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, cm.ErrUnknownStorageKind), errors.Is(err, cm.ErrInvalidShardDepth),
+			errors.Is(err, cm.ErrLazyNeedsDirectory):
+			status = http.StatusBadRequest
+		case errors.Is(err, cm.ErrConvertMismatch), errors.Is(err, cm.ErrNotConvertible):
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error(), "report": report})
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// documentFilter builds a filter from repeated where=field:value parameters.
+// All conditions must hold; values are compared in their printed form.
+func documentFilter(c *gin.Context) func(cm.Document) bool {
+	type condition struct{ field, value string }
+	var conditions []condition
+	for _, where := range c.QueryArray("where") {
+		field, value, _ := strings.Cut(where, ":")
+		conditions = append(conditions, condition{field, value})
+	}
+	if len(conditions) == 0 {
+		return nil
+	}
+	return func(doc cm.Document) bool {
+		for _, cond := range conditions {
+			if fmt.Sprint(doc.Field(cond.field)) != cond.value {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// http://localhost:50150/api/v1/collections/albums.json/stats?where=albumType:user&groupBy=isHidden&field=count&histogram=month
+
+// Stats counts the documents matching the where filters and, on request,
+// groups them by a field, summarises a numeric field and buckets them by
+// creation day or month.
+func (h *CollectionHandler) Stats(c *gin.Context) {
+	manager, err := h.manager(c.Param("name"), false)
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+
+	filter := documentFilter(c)
+	response := gin.H{
+		"count": manager.Count(filter),
+		"time":  manager.TimeStats(filter),
+	}
+
+	if field := c.Query("groupBy"); field != "" {
+		response["groups"] = manager.CountBy(filter, func(doc cm.Document) string {
+			return fmt.Sprint(doc.Field(field))
+		})
+	}
+
+	if field := c.Query("field"); field != "" {
+		response["stats"] = manager.Stats(filter, func(doc cm.Document) (float64, bool) {
+			v, ok := doc.Field(field).(float64)
+			return v, ok
+		})
+	}
+
+	if interval := c.Query("histogram"); interval != "" {
+		buckets, err := manager.CreatedHistogram(filter, cm.Interval(interval))
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "histogram must be day or month"})
+			return
+		}
+		response["histogram"] = buckets
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// http://localhost:50150/api/v1/collections/albums.json?where=isHidden:false&sortBy=albumType,-count&sortOrder=asc
+
+// List returns the documents matching the where filters, sorted by any
+// combination of fields.
+func (h *CollectionHandler) List(c *gin.Context) {
+	manager, err := h.manager(c.Param("name"), false)
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+
+	items, err := manager.GetSortedList(documentFilter(c), c.Query("sortBy"), c.DefaultQuery("sortOrder", "asc"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, cm.ErrUnknownSortField) {
+			status = http.StatusBadRequest
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": items})
+}
+
+// searchIndex returns the index over the configured fields of the named
+// collection, building it on first use.
+func (h *CollectionHandler) searchIndex(name string, manager *cm.Manager[cm.Document]) (*cm.SearchIndex[cm.Document], error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if idx, ok := h.indexes[name]; ok {
+		return idx, nil
+	}
+	fields := h.search[name]
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%w: %s", errNotSearchable, name)
+	}
+	idx := cm.NewSearchIndex(manager, fields...)
+	h.indexes[name] = idx
+	return idx, nil
+}
+
+// http://localhost:50150/api/v1/collections/uploads/search?q=holiday+img_20&limit=20
+
+// Search runs a ranked full-text query over the string fields configured for
+// the collection in CollectionOptions.Search.
+func (h *CollectionHandler) Search(c *gin.Context) {
+	name := c.Param("name")
+	if len(h.search[name]) == 0 {
+		collectionError(c, fmt.Errorf("%w: %s", errNotSearchable, name))
+		return
+	}
+	manager, err := h.manager(name, false)
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be a number"})
+		return
+	}
+
+	idx, err := h.searchIndex(name, manager)
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"hits": idx.Search(c.Query("q"), limit)})
+}
+
+// http://localhost:50150/api/v1/collections/users.json/items/<id>
+
+// Delete removes one document. The relations other collections hold on it
+// apply: it is refused while restricted, and cascades otherwise.
+func (h *CollectionHandler) Delete(c *gin.Context) {
+	manager, err := h.manager(c.Param("name"), false)
+	if err != nil {
+		collectionError(c, err)
+		return
+	}
+
+	if err := manager.Delete(c.Param("id")); err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, cm.ErrItemNotFound):
+			status = http.StatusNotFound
+		case errors.Is(err, cm.ErrInvalidID):
+			status = http.StatusBadRequest
+		case errors.Is(err, cm.ErrRestricted):
+			status = http.StatusConflict
+		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": c.Param("id")})
+}
@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestConvertOnlyRegisteredCollections(t *testing.T) {
+	h := NewCollectionHandler(CollectionOptions{Convertible: []string{"albums.json"}})
+	r := gin.New()
+	r.POST("/collections/:name/convert", h.Convert)
+
+	for _, name := range []string{"users", "albums", "..", "uploads"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/collections/"+name+"/convert?to=file", nil))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("convert %s: status %d, want %d", name, w.Code, http.StatusForbidden)
+		}
+	}
+}
+
+func TestSearchOnlyConfiguredCollections(t *testing.T) {
+	h := NewCollectionHandler(CollectionOptions{Search: map[string][]string{"uploads": {"title"}}})
+	r := gin.New()
+	r.GET("/collections/:name/search", h.Search)
+
+	for _, query := range []string{"/collections/albums/search?q=x", "/collections/albums/search?q=x&fields=title"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+	if len(h.indexes) != 0 {
+		t.Fatalf("indexes built for unconfigured collections: %v", h.indexes)
+	}
+}
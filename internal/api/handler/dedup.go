@@ -0,0 +1,197 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	cm "github.com/mahdi-cpp/api-go-settings/internal/collection_manager_v3"
+)
+
+// saveFunc writes an original to dst and returns the hex SHA-256 of its
+// content.
+type saveFunc func(dst string) (string, error)
+
+// saveUploaded streams a multipart file to dst, hashing it on the way.
+func saveUploaded(file *multipart.FileHeader) saveFunc {
+	return func(dst string) (string, error) {
+		src, err := file.Open()
+		if err != nil {
+			return "", err
+		}
+		defer src.Close()
+
+		out, err := os.Create(dst)
+		if err != nil {
+			return "", err
+		}
+		sum := sha256.New()
+		_, err = io.Copy(io.MultiWriter(out, sum), src)
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(sum.Sum(nil)), nil
+	}
+}
+
+// resumeHash restores a SHA-256 saved with saveHash, or starts a new one.
+func resumeHash(state []byte) (hash.Hash, error) {
+	sum := sha256.New()
+	if len(state) == 0 {
+		return sum, nil
+	}
+	if err := sum.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+		return nil, fmt.Errorf("failed to resume checksum: %w", err)
+	}
+	return sum, nil
+}
+
+func saveHash(sum hash.Hash) ([]byte, error) {
+	return sum.(encoding.BinaryMarshaler).MarshalBinary()
+}
+
+// contentRef records which asset a user stored some content as.
+type contentRef struct {
+	ID               string    `json:"id"` // <user>:<sha256>
+	AssetID          string    `json:"assetID"`
+	Filename         string    `json:"filename"`
+	Size             int64     `json:"size"`
+	CreationDate     time.Time `json:"creationDate"`
+	ModificationDate time.Time `json:"modificationDate"`
+}
+
+func (r *contentRef) SetID(id string)          { r.ID = id }
+func (r *contentRef) SetCreatedAt(t time.Time) { r.CreationDate = t }
+func (r *contentRef) SetUpdatedAt(t time.Time) { r.ModificationDate = t }
+func (r *contentRef) GetID() string            { return r.ID }
+func (r *contentRef) GetCreatedAt() time.Time  { return r.CreationDate }
+func (r *contentRef) GetUpdatedAt() time.Time  { return r.ModificationDate }
+
+// contents indexes stored originals by user and SHA-256 so the same content
+// uploaded twice by one user is kept once. Different users never share an
+// entry, so nobody learns what others have uploaded.
+type contents struct {
+	mu     sync.Mutex
+	refs   *cm.Manager[*contentRef]
+	assets *assetStore
+}
+
+// newContents opens the content index, a directory collection in
+// dir/.contents, moving into it the entries of the single file index
+// dir/.contents.json earlier versions kept.
+func newContents(dir string, assets *assetStore) (*contents, error) {
+	refs, err := cm.NewCollectionManager[*contentRef](filepath.Join(dir, ".contents"), false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load content index: %w", err)
+	}
+	if err := migrateContents(filepath.Join(dir, ".contents.json"), refs); err != nil {
+		return nil, err
+	}
+	return &contents{refs: refs, assets: assets}, nil
+}
+
+// migrateContents copies the entries of the legacy index into refs and
+// removes it. Entries refs holds already are kept as they are, so an
+// interrupted migration is completed on the next start.
+func migrateContents(legacy string, refs *cm.Manager[*contentRef]) error {
+	if _, err := os.Stat(legacy); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	old, err := cm.NewCollectionManager[*contentRef](legacy, true)
+	if err != nil {
+		return fmt.Errorf("failed to load legacy content index: %w", err)
+	}
+	entries, err := old.GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to load legacy content index: %w", err)
+	}
+	results, _ := refs.CreateManyWithID(entries)
+	for _, result := range results {
+		if result.Err != nil && !errors.Is(result.Err, cm.ErrDuplicateID) {
+			return fmt.Errorf("failed to migrate content index entry %s: %w", result.ID, result.Err)
+		}
+	}
+	if err := os.Remove(legacy + ".sum"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Remove(legacy); err != nil {
+		return err
+	}
+	log.Printf("moved %d content index entries to %s", len(results), filepath.Dir(legacy))
+	return nil
+}
+
+func contentKey(user string, sum string) string {
+	return user + ":" + sum
+}
+
+// claim registers ref as the asset holding content sum for user, unless the
+// user already stores that content; then the existing asset is returned
+// instead and nothing changes. Entries whose file or asset record has gone
+// are replaced.
+func (c *contents) claim(user string, sum string, ref contentRef) (*contentRef, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := contentKey(user, sum)
+	if existing, err := c.refs.Get(key); err == nil {
+		stored, err := c.stored(user, existing)
+		if err != nil {
+			return nil, err
+		}
+		if stored {
+			found := *existing
+			return &found, nil
+		}
+		if err := c.refs.Delete(key); err != nil {
+			return nil, err
+		}
+	}
+
+	ref.ID = key
+	_, err := c.refs.CreateWithID(&ref)
+	return nil, err
+}
+
+// stored reports whether the asset ref names is still there, its original
+// and its record both.
+func (c *contents) stored(user string, ref *contentRef) (bool, error) {
+	if _, err := os.Stat(filepath.Join(userAssetsDir(user), ref.Filename)); err != nil {
+		return false, nil
+	}
+	records, err := c.assets.of(user)
+	if err != nil {
+		return false, err
+	}
+	_, err = records.Get(ref.AssetID)
+	return err == nil, nil
+}
+
+// unclaim drops the entry claim made for assetID, when the asset was not
+// stored after all. An entry naming another asset is left alone.
+func (c *contents) unclaim(user string, sum string, assetID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := contentKey(user, sum)
+	ref, err := c.refs.Get(key)
+	if err != nil || ref.AssetID != assetID {
+		return
+	}
+	if err := c.refs.Delete(key); err != nil {
+		log.Printf("failed to drop content index entry of %s: %v", user, err)
+	}
+}
@@ -8,20 +8,27 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/mahdi-cpp/api-go-settings/internal/application"
+	"github.com/mahdi-cpp/api-go-settings/internal/imagemeta"
 )
 
 type DownloadHandler struct {
-	manager *application.AppManager
+	manager   *application.AppManager
+	originals imagemeta.Policy // stripped from originals; thumbnails are stripped when created
 }
 
-func NewDownloadHandler(manager *application.AppManager) *DownloadHandler {
+// NewDownloadHandler serves the images of manager. Originals are stripped
+// of the metadata originals names before they are shared; the zero Policy
+// serves them as stored.
+func NewDownloadHandler(manager *application.AppManager, originals imagemeta.Policy) *DownloadHandler {
 	return &DownloadHandler{
-		manager: manager,
+		manager:   manager,
+		originals: originals,
 	}
 }
 
-// serveImage handles common image serving logic
-func (h *DownloadHandler) serveImage(c *gin.Context, loader func(context.Context, string) ([]byte, error)) {
+// serveImage handles common image serving logic. Images are stripped of the
+// metadata policy names; one that cannot be stripped is not served at all.
+func (h *DownloadHandler) serveImage(c *gin.Context, loader func(context.Context, string) ([]byte, error), policy imagemeta.Policy) {
 
 	fullPath := c.Param("filename")
 	if fullPath == "" {
@@ -35,6 +42,13 @@ func (h *DownloadHandler) serveImage(c *gin.Context, loader func(context.Context
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load image"})
 		return
 	}
+	if !policy.IsZero() {
+		if imageBytes, err = imagemeta.StripBuffer(imageBytes, policy); err != nil {
+			log.Printf("Error stripping image %s: %v", fullPath, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "could not load image"})
+			return
+		}
+	}
 
 	// Determine content type from file extension
 	ext := filepath.Ext(fullPath)
@@ -63,9 +77,18 @@ func getContentType(ext string) string {
 // ---------------------------------------------------------------/users/018f3a8b-1b32-729a-f7e5-5467c1b2d3e4/assets/0198c111-0f9d-74f6-ab2e-6ce665ec29c6.jpg
 // http://localhost:50000/api/v1/download/original/com.iris.photos/users/018f3a8b-1b32-729a-f7e5-5467c1b2d3e4/assets/0198c111-0f9d-74f6-ab2e-6ce665ec29c6.jpg
 
-// ImageOriginal serves original images
+// ImageOriginal serves original images, only to the user who stored them.
 func (h *DownloadHandler) ImageOriginal(c *gin.Context) {
-	h.serveImage(c, h.manager.OriginalImageLoader.LoadImage)
+	user, err := uploader(c)
+	if err != nil {
+		c.JSON(uploadStatus(err, http.StatusBadRequest), gin.H{"error": err.Error()})
+		return
+	}
+	if !ownedBy(user, c.Param("filename")) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "image belongs to another user"})
+		return
+	}
+	h.serveImage(c, h.manager.OriginalImageLoader.LoadImage, h.originals)
 }
 
 // http://localhost:50000/api/v1/download/
@@ -74,9 +97,10 @@ func (h *DownloadHandler) ImageOriginal(c *gin.Context) {
 // ----------------------------------------------------------------/users/018f3a8b-1b32-729a-f7e5-5467c1b2d3e4/assets/thumbnails/0198c111-0f9d-74f6-ab2e-6ce665ec29c6_270.jpg
 // http://localhost:50000/api/v1/download/thumbnail/com.iris.photos/users/018f3a8b-1b32-729a-f7e5-5467c1b2d3e4/assets/thumbnails/0198c111-0f9d-74f6-ab2e-6ce665ec29c6_270.jpg
 
-// ImageThumbnail serves thumbnail images
+// ImageThumbnail serves thumbnail images. They are stripped with
+// imagemeta.Private when they are created, so they are served as stored.
 func (h *DownloadHandler) ImageThumbnail(c *gin.Context) {
-	h.serveImage(c, h.manager.ThumbnailImageLoader.LoadImage)
+	h.serveImage(c, h.manager.ThumbnailImageLoader.LoadImage, imagemeta.Policy{})
 }
 
 // http://localhost:50000/api/v1/download/icon
@@ -86,5 +110,5 @@ func (h *DownloadHandler) ImageThumbnail(c *gin.Context) {
 
 // ImageIcons serves icon images
 func (h *DownloadHandler) ImageIcons(c *gin.Context) {
-	h.serveImage(c, h.manager.IconImageLoader.LoadImage)
+	h.serveImage(c, h.manager.IconImageLoader.LoadImage, imagemeta.Policy{})
 }
@@ -0,0 +1,77 @@
+package handler
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mahdi-cpp/api-go-settings/internal/application"
+	"github.com/mahdi-cpp/api-go-settings/internal/imagemeta"
+)
+
+func TestOriginalsServedToTheirOwnerOnly(t *testing.T) {
+	h := newTestUploads(t, 0, Quota{})
+	var content bytes.Buffer
+	if err := png.Encode(&content, image.NewGray(image.Rect(0, 0, 4, 3))); err != nil {
+		t.Fatal(err)
+	}
+	alices := storeTestImage(t, h, "alice", "a.png", content.Bytes())
+	bobs := storeTestImage(t, h, "bob", "b.png", append(content.Bytes(), 0))
+
+	manager, err := application.NewAppManager()
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloads := NewDownloadHandler(manager, imagemeta.Policy{})
+	r := gin.New()
+	r.GET(originalRoute+"*filename", testSigner.Authenticate, downloads.ImageOriginal)
+
+	escape := strings.Replace(bobs.URL, "/users/bob/", "/users/alice/assets/../../bob/", 1)
+	tests := []struct {
+		name   string
+		url    string
+		user   string
+		status int
+	}{
+		{"owner", alices.URL, "alice", http.StatusOK},
+		{"other user", alices.URL, "bob", http.StatusForbidden},
+		{"no token", alices.URL, "", http.StatusUnauthorized},
+		{"out of the assets directory", escape, "alice", http.StatusForbidden},
+		{"data root", originalRoute + "keys/master.key", "alice", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		if tt.user != "" {
+			req.Header.Set("Authorization", bearer(t, tt.user))
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		if tt.status == http.StatusOK && !bytes.Equal(w.Body.Bytes(), content.Bytes()) {
+			t.Errorf("%s: served %d bytes, not the original", tt.name, w.Body.Len())
+		}
+	}
+}
+
+func TestThumbnailsKeptWithTheirOwner(t *testing.T) {
+	newTestUploads(t, 0, Quota{})
+	asset := &Asset{ID: "0198c111", UserID: "alice"}
+
+	path := thumbnailPath(asset)
+	if filepath.Dir(path) != filepath.Join(userAssetsDir("alice"), "thumbnails") {
+		t.Fatalf("thumbnail stored at %s", path)
+	}
+	url := thumbnailURL(path)
+	rel, ok := strings.CutPrefix(url, thumbnailRoute)
+	if !ok || !ownedBy("alice", rel) || ownedBy("bob", rel) {
+		t.Fatalf("thumbnail served from %s", url)
+	}
+}
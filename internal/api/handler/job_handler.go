@@ -0,0 +1,82 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mahdi-cpp/api-go-settings/internal/jobs"
+)
+
+// JobHandler reports on the background jobs of the requesting user and lets
+// them retry the ones that died. Jobs of other users are reported as not
+// found.
+type JobHandler struct {
+	queue *jobs.Queue
+}
+
+func NewJobHandler(queue *jobs.Queue) *JobHandler {
+	return &JobHandler{queue: queue}
+}
+
+// http://localhost:50150/api/v1/jobs/0198c111-9b1c-7d6e-a000-5c1d3e7f9a21
+
+// Get returns the state of a job.
+func (h *JobHandler) Get(c *gin.Context) {
+	job, ok := h.owned(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// http://localhost:50150/api/v1/jobs/dead
+
+// Dead lists the user's jobs that failed every attempt, newest first.
+func (h *JobHandler) Dead(c *gin.Context) {
+	user, err := uploader(c)
+	if err != nil {
+		c.JSON(uploadStatus(err, http.StatusBadRequest), gin.H{"error": err.Error()})
+		return
+	}
+	dead, err := h.queue.Dead(func(job *jobs.Job) bool { return job.UserID == user })
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"jobs": dead})
+}
+
+// http://localhost:50150/api/v1/jobs/0198c111-9b1c-7d6e-a000-5c1d3e7f9a21/retry
+
+// Retry puts a dead job back in the queue.
+func (h *JobHandler) Retry(c *gin.Context) {
+	if _, ok := h.owned(c); !ok {
+		return
+	}
+	job, err := h.queue.Retry(c.Param("id"))
+	switch {
+	case errors.Is(err, jobs.ErrNotDead):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusAccepted, job)
+	}
+}
+
+// owned returns the job the request names if it belongs to the requesting
+// user, having answered the request otherwise.
+func (h *JobHandler) owned(c *gin.Context) (*jobs.Job, bool) {
+	user, err := uploader(c)
+	if err != nil {
+		c.JSON(uploadStatus(err, http.StatusBadRequest), gin.H{"error": err.Error()})
+		return nil, false
+	}
+	job, err := h.queue.Get(c.Param("id"))
+	if err != nil || job.UserID != user {
+		c.JSON(http.StatusNotFound, gin.H{"error": "job not found"})
+		return nil, false
+	}
+	return job, true
+}
@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/mahdi-cpp/api-go-settings/internal/jobs"
+	"github.com/mahdi-cpp/api-go-settings/internal/snapshot"
+	"github.com/mahdi-cpp/api-go-settings/internal/thumbnail"
+)
+
+// thumbnailJob is the kind of job that creates the thumbnail of a stored
+// original.
+const thumbnailJob = "thumbnail"
+
+// thumbnailTask is the payload of a thumbnailJob.
+type thumbnailTask struct {
+	AssetID string `json:"assetID"`
+}
+
+// processThumbnail creates the thumbnail of the asset a thumbnailJob names in
+// its owner's thumbnails directory and records the URL it is served from on
+// the asset. An asset that has gone is not retried.
+func (h *UploadHandler) processThumbnail(ctx context.Context, job *jobs.Job) error {
+	var task thumbnailTask
+	if err := job.Decode(&task); err != nil {
+		return err
+	}
+	records, err := h.assets.of(job.UserID)
+	if err != nil {
+		return err
+	}
+	asset, err := records.Get(task.AssetID)
+	if err != nil {
+		return fmt.Errorf("%w: asset %s: %v", jobs.ErrPermanent, task.AssetID, err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	src := filepath.Join(userAssetsDir(asset.UserID), asset.Filename)
+	dst := thumbnailPath(asset)
+	endWrite := snapshot.BeginWrite()
+	err = thumbnail.CreateSingleThumbnail(src, dst)
+	endWrite()
+	if err != nil {
+		return err
+	}
+
+	updated := *asset
+	updated.Thumbnails = []string{thumbnailURL(dst)}
+	if _, err := records.Update(&updated); err != nil {
+		return fmt.Errorf("failed to record thumbnail of %s: %w", asset.ID, err)
+	}
+	return nil
+}
+
+// queueProcessing queues the work done on a new original once its upload
+// has been answered and returns the job's ID. The upload has succeeded
+// either way, so a failure to queue is only logged and gives "".
+func (h *UploadHandler) queueProcessing(asset *Asset) string {
+	job, err := h.queue.Enqueue(thumbnailJob, asset.UserID, thumbnailTask{AssetID: asset.ID})
+	if err != nil {
+		log.Printf("failed to queue processing of %s: %v", asset.ID, err)
+		return ""
+	}
+	return job.ID
+}
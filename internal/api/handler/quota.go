@@ -0,0 +1,259 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mahdi-cpp/api-go-settings/internal/auth"
+	cm "github.com/mahdi-cpp/api-go-settings/internal/collection_manager_v3"
+	"github.com/mahdi-cpp/api-go-settings/internal/snapshot"
+	"github.com/mahdi-cpp/api-go-settings/internal/utils"
+)
+
+const (
+	// anonymousUser owns the originals stored before uploads needed a user;
+	// no request can act as it.
+	anonymousUser = "anonymous"
+
+	// formOverhead is what a multipart body may carry beside the file
+	// itself: boundaries, part headers and small form fields.
+	formOverhead = 64 << 10
+)
+
+var (
+	errInvalidUser     = errors.New("invalid user ID")
+	errUnauthenticated = errors.New("request is not authenticated")
+)
+
+// uploader returns the user the request is made by and accounted to, as
+// auth.Authenticate verified it from the request's token.
+func uploader(c *gin.Context) (string, error) {
+	user, ok := auth.User(c)
+	if !ok {
+		return "", errUnauthenticated
+	}
+	if user == anonymousUser {
+		return "", fmt.Errorf("%w: %q", errInvalidUser, user)
+	}
+	return user, nil
+}
+
+// Quota bounds what one user may store. Zero fields are unlimited.
+type Quota struct {
+	MaxBytes int64 `json:"maxBytes"`
+	MaxFiles int   `json:"maxFiles"`
+}
+
+// Usage is what one user stores, keyed by user ID.
+type Usage struct {
+	ID               string    `json:"id"`
+	Bytes            int64     `json:"bytes"`
+	Files            int       `json:"files"`
+	CreationDate     time.Time `json:"creationDate"`
+	ModificationDate time.Time `json:"modificationDate"`
+}
+
+func (u *Usage) SetID(id string)          { u.ID = id }
+func (u *Usage) SetCreatedAt(t time.Time) { u.CreationDate = t }
+func (u *Usage) SetUpdatedAt(t time.Time) { u.ModificationDate = t }
+func (u *Usage) GetID() string            { return u.ID }
+func (u *Usage) GetCreatedAt() time.Time  { return u.CreationDate }
+func (u *Usage) GetUpdatedAt() time.Time  { return u.ModificationDate }
+
+// quotas keeps the Usage of every user and enforces Quota against it.
+// Space is reserved before a file is stored and released again if storing
+// fails, so concurrent uploads cannot overshoot the quota together.
+type quotas struct {
+	quota Quota
+
+	mu    sync.Mutex
+	usage *cm.Manager[*Usage]
+}
+
+// usageFile is the collection, under config.GetPath, storage usage is kept
+// in, so snapshots of the data root carry it along with the originals it
+// accounts for.
+const usageFile = "usage.json"
+
+func newQuotas(path string, quota Quota) (*quotas, error) {
+	usage, err := cm.NewCollectionManager[*Usage](path, false, cm.WithWriteGate(snapshot.DefaultGate))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load storage usage: %w", err)
+	}
+	return &quotas{quota: quota, usage: usage}, nil
+}
+
+// get returns the usage of user, zero if nothing was stored yet.
+func (q *quotas) get(user string) Usage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if usage, err := q.usage.Get(user); err == nil {
+		return *usage
+	}
+	return Usage{ID: user}
+}
+
+// allows fails with ErrQuotaExceeded unless user has room for files more
+// files of bytes in total. Nothing is reserved.
+func (q *quotas) allows(user string, bytes int64, files int) error {
+	usage := q.get(user)
+	return q.quota.check(usage, bytes, files)
+}
+
+func (quota Quota) check(usage Usage, bytes int64, files int) error {
+	if quota.MaxBytes > 0 && usage.Bytes+bytes > quota.MaxBytes {
+		return fmt.Errorf("%w: %d of %d bytes used, %d more requested",
+			utils.ErrQuotaExceeded, usage.Bytes, quota.MaxBytes, bytes)
+	}
+	if quota.MaxFiles > 0 && usage.Files+files > quota.MaxFiles {
+		return fmt.Errorf("%w: %d of %d files used, %d more requested",
+			utils.ErrQuotaExceeded, usage.Files, quota.MaxFiles, files)
+	}
+	return nil
+}
+
+// reserve adds bytes and files to the usage of user if the quota allows it.
+func (q *quotas) reserve(user string, bytes int64, files int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage, err := q.usage.Get(user)
+	if err != nil {
+		if err := q.quota.check(Usage{}, bytes, files); err != nil {
+			return err
+		}
+		_, err := q.usage.CreateWithID(&Usage{ID: user, Bytes: bytes, Files: files})
+		return err
+	}
+	if err := q.quota.check(*usage, bytes, files); err != nil {
+		return err
+	}
+	updated := *usage
+	updated.Bytes += bytes
+	updated.Files += files
+	_, err = q.usage.Update(&updated)
+	return err
+}
+
+// release gives back a reservation whose file was not stored after all.
+func (q *quotas) release(user string, bytes int64, files int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	usage, err := q.usage.Get(user)
+	if err != nil {
+		return
+	}
+	updated := *usage
+	updated.Bytes = max(updated.Bytes-bytes, 0)
+	updated.Files = max(updated.Files-files, 0)
+	if _, err := q.usage.Update(&updated); err != nil {
+		log.Printf("failed to release quota of %s: %v", user, err)
+	}
+}
+
+// admit checks a request against limit and the quota of user before any of
+// its body is read, going by its declared length, and caps the body at limit
+// bytes so a request that lies about or omits its length fails while it is
+// read.
+func (h *UploadHandler) admit(c *gin.Context, user string, limit int64) error {
+	if length := c.Request.ContentLength; length > 0 {
+		if limit > 0 && length > limit {
+			return fmt.Errorf("%w: request of %d bytes exceeds %d", utils.ErrFileTooLarge, length, limit)
+		}
+		if err := h.quotas.allows(user, max(length-formOverhead, 0), 1); err != nil {
+			return err
+		}
+	}
+	if limit > 0 {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+	}
+	return nil
+}
+
+// checkSize fails with ErrFileTooLarge for a file above MaxFileSize.
+func (h *UploadHandler) checkSize(size int64) error {
+	if h.MaxFileSize > 0 && size > h.MaxFileSize {
+		return fmt.Errorf("%w: %d bytes exceeds %d", utils.ErrFileTooLarge, size, h.MaxFileSize)
+	}
+	return nil
+}
+
+// bodyLimit is the most a request carrying files files may send.
+func (h *UploadHandler) bodyLimit(files int) int64 {
+	if h.MaxFileSize <= 0 {
+		return 0
+	}
+	return int64(files)*h.MaxFileSize + formOverhead
+}
+
+// uploadStatus maps an upload error to its HTTP status, fallback for errors
+// it does not know.
+func uploadStatus(err error, fallback int) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.Is(err, utils.ErrFileTooLarge), errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, utils.ErrQuotaExceeded):
+		return http.StatusForbidden
+	case errors.Is(err, utils.ErrUnsupportedFormat):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, errInvalidUser):
+		return http.StatusBadRequest
+	case errors.Is(err, errUnauthenticated):
+		return http.StatusUnauthorized
+	}
+	return fallback
+}
+
+// Usage reports what the requesting user stores against their quota.
+//
+// http://localhost:50150/api/v1/upload/usage
+func (h *UploadHandler) Usage(c *gin.Context) {
+	user, err := uploader(c)
+	if err != nil {
+		c.JSON(uploadStatus(err, http.StatusBadRequest), gin.H{"error": err.Error()})
+		return
+	}
+	usage := h.quotas.get(user)
+	c.JSON(http.StatusOK, gin.H{
+		"userID":      user,
+		"bytes":       usage.Bytes,
+		"files":       usage.Files,
+		"quota":       h.quotas.quota,
+		"maxFileSize": h.MaxFileSize,
+	})
+}
+
+// moveLegacyUsage moves the usage collection kept in the upload directory
+// by earlier versions, with its checksums, to path. Nothing is moved once
+// path exists.
+func moveLegacyUsage(legacy string, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if _, err := os.Stat(legacy); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	defer snapshot.BeginWrite()()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	// The checksums go first: usage found without them is still read.
+	if err := moveFile(legacy+".sum", path+".sum"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to move storage usage: %w", err)
+	}
+	if err := moveFile(legacy, path); err != nil {
+		return fmt.Errorf("failed to move storage usage: %w", err)
+	}
+	log.Printf("moved storage usage to %s", path)
+	return nil
+}
@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mahdi-cpp/api-go-settings/internal/auth"
+	cm "github.com/mahdi-cpp/api-go-settings/internal/collection_manager_v3"
+	"github.com/mahdi-cpp/api-go-settings/internal/config"
+	"github.com/mahdi-cpp/api-go-settings/internal/jobs"
+)
+
+var testSigner = auth.NewSigner([]byte("0123456789abcdef0123456789abcdef"))
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+// newTestUploads returns an UploadHandler keeping its state, and the data
+// root, in a temporary directory, with a queue that is never started. Asset
+// records are sealed under a fresh keyring.
+func newTestUploads(t *testing.T, maxFileSize int64, quota Quota) *UploadHandler {
+	t.Helper()
+	dir := t.TempDir()
+	config.SetRootDir(filepath.Join(dir, "root"))
+	queue, err := jobs.NewQueue(filepath.Join(dir, "jobs"), jobs.Options{Workers: 1, MaxAttempts: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyfile := filepath.Join(dir, "master.key")
+	if _, err := cm.AddMasterKey(keyfile); err != nil {
+		t.Fatal(err)
+	}
+	ring, err := cm.LoadKeyring(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewUploadHandler(filepath.Join(dir, "uploads"), maxFileSize, quota, queue, ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// bearer returns the Authorization header value for user.
+func bearer(t *testing.T, user string) string {
+	t.Helper()
+	token, err := testSigner.Issue(user, false, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return "Bearer " + token
+}
+
+func TestUploaderComesFromToken(t *testing.T) {
+	h := newTestUploads(t, 0, Quota{MaxFiles: 3})
+	r := gin.New()
+	r.GET("/usage", testSigner.Authenticate, h.Usage)
+
+	tests := []struct {
+		name   string
+		header map[string]string
+		status int
+		user   string
+	}{
+		{"no credentials", nil, http.StatusUnauthorized, ""},
+		{"header only", map[string]string{"X-User-ID": "alice"}, http.StatusUnauthorized, ""},
+		{"token", map[string]string{"Authorization": bearer(t, "alice")}, http.StatusOK, "alice"},
+		{"token beats header", map[string]string{"Authorization": bearer(t, "alice"), "X-User-ID": "bob"}, http.StatusOK, "alice"},
+		{"anonymous", map[string]string{"Authorization": bearer(t, anonymousUser)}, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/usage", nil)
+		for k, v := range tt.header {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body.String())
+			continue
+		}
+		if tt.user == "" {
+			continue
+		}
+		var body struct {
+			UserID string `json:"userID"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.UserID != tt.user {
+			t.Errorf("%s: userID %q, want %q (%v)", tt.name, body.UserID, tt.user, err)
+		}
+	}
+}
+
+func TestUploaderWithoutMiddleware(t *testing.T) {
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+	c.Request.Header.Set("X-User-ID", "alice")
+	if _, err := uploader(c); uploadStatus(err, 0) != http.StatusUnauthorized {
+		t.Fatalf("uploader without Authenticate: err = %v", err)
+	}
+}
+
+func TestUsageKeptUnderDataRoot(t *testing.T) {
+	h := newTestUploads(t, 0, Quota{})
+	storeTestImage(t, h, "alice", "a.jpg", []byte("alice's picture"))
+	if _, err := os.Stat(config.GetPath(usageFile)); err != nil {
+		t.Fatalf("usage not kept under the data root: %v", err)
+	}
+	if got := h.quotas.get("alice"); got.Files != 1 {
+		t.Fatalf("alice uses %+v", got)
+	}
+}
+
+func TestMoveLegacyUsage(t *testing.T) {
+	dir := t.TempDir()
+	legacy := filepath.Join(dir, "uploads", ".usage.json")
+	old, err := newQuotas(legacy, Quota{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := old.reserve("alice", 10, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "root", usageFile)
+	if err := moveLegacyUsage(legacy, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(legacy); !os.IsNotExist(err) {
+		t.Fatalf("legacy usage left behind: %v", err)
+	}
+	moved, err := newQuotas(path, Quota{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := moved.get("alice"); got.Bytes != 10 || got.Files != 1 {
+		t.Fatalf("moved usage of alice: %+v", got)
+	}
+
+	// Once moved, a stale legacy file is left alone.
+	if err := os.WriteFile(legacy, []byte("[]"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := moveLegacyUsage(legacy, path); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := newQuotas(path, Quota{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reopened.get("alice"); got.Bytes != 10 {
+		t.Fatalf("usage replaced by the stale legacy file: %+v", got)
+	}
+}
@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/mahdi-cpp/api-go-settings/internal/snapshot"
+)
+
+// SnapshotHandler takes and lists snapshots of the data tree from inside the
+// server, where writers can be held off while the tree is staged. Snapshots
+// hold the data of every user, so its routes are for admin tokens only.
+type SnapshotHandler struct {
+	Options snapshot.Options
+}
+
+func NewSnapshotHandler(opts snapshot.Options) *SnapshotHandler {
+	return &SnapshotHandler{Options: opts}
+}
+
+// http://localhost:50150/api/v1/snapshots
+
+// Create archives the data tree now.
+func (h *SnapshotHandler) Create(c *gin.Context) {
+	info, err := snapshot.Create(h.Options)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, info)
+}
+
+// List returns the snapshots, newest first.
+func (h *SnapshotHandler) List(c *gin.Context) {
+	infos, err := snapshot.List(h.Options.Dir)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"snapshots": infos})
+}
@@ -0,0 +1,151 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"slices"
+
+	"github.com/cshum/vipsgen/vips"
+	"github.com/mahdi-cpp/api-go-settings/internal/imagemeta"
+	"github.com/mahdi-cpp/api-go-settings/internal/utils"
+)
+
+// sniffMagic identifies an image format from the leading bytes of a file.
+// AVIF and HEIC share the ISO base media container and differ in its brand.
+func sniffMagic(head []byte) vips.ImageType {
+	switch {
+	case bytes.HasPrefix(head, []byte{0xFF, 0xD8, 0xFF}):
+		return vips.ImageTypeJpeg
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		return vips.ImageTypePng
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return vips.ImageTypeGif
+	case bytes.HasPrefix(head, []byte("II*\x00")), bytes.HasPrefix(head, []byte("MM\x00*")):
+		return vips.ImageTypeTiff
+	case len(head) >= 12 && string(head[:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		return vips.ImageTypeWebp
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		return ftypFormat(head)
+	}
+	return vips.ImageTypeUnknown
+}
+
+// ftypFormat tells AVIF from HEIC by the brands of the ftyp box head starts
+// with. The major brands mif1 and msf1 only say the file is a HEIF image or
+// sequence, which AVIF files are as well, so for them the compatible brands
+// decide, and AVIF wins when listed.
+func ftypFormat(head []byte) vips.ImageType {
+	end := len(head)
+	if size := int(binary.BigEndian.Uint32(head)); size >= 8 && size < end {
+		end = size
+	}
+	var compatible []string
+	for i := 16; i+4 <= end; i += 4 {
+		compatible = append(compatible, string(head[i:i+4]))
+	}
+
+	switch string(head[8:12]) {
+	case "avif", "avis":
+		return vips.ImageTypeAvif
+	case "heic", "heix", "hevc", "hevx", "heim", "heis":
+		return vips.ImageTypeHeif
+	case "mif1", "msf1":
+		if slices.Contains(compatible, "avif") || slices.Contains(compatible, "avis") {
+			return vips.ImageTypeAvif
+		}
+		return vips.ImageTypeHeif
+	}
+	return vips.ImageTypeUnknown
+}
+
+// sameFormat reports whether the format vips decoded agrees with the magic
+// bytes. vips loads AVIF with its HEIF loader and reports it as HEIF.
+func sameFormat(magic vips.ImageType, decoded vips.ImageType) bool {
+	if magic == vips.ImageTypeAvif {
+		return decoded == vips.ImageTypeAvif || decoded == vips.ImageTypeHeif
+	}
+	return magic == decoded
+}
+
+// imageInfo is what sniffing an upload found out about it.
+type imageInfo struct {
+	Format      vips.ImageType
+	Width       int
+	Height      int
+	Orientation int // EXIF orientation, 1 when upright
+	Metadata    imagemeta.Metadata
+}
+
+// sniffUpload identifies an uploaded image by its magic bytes and confirms it
+// by decoding its header with vips, ignoring the client's Content-Type and
+// file name. Unknown content, content vips cannot decode and content whose
+// header disagrees with its magic bytes fail with ErrUnsupportedFormat.
+func sniffUpload(file *multipart.FileHeader) (imageInfo, error) {
+	f, err := file.Open()
+	if err != nil {
+		return imageInfo{Format: vips.ImageTypeUnknown}, err
+	}
+	return sniffFile(f)
+}
+
+// sniffFile is sniffUpload for content already opened; it closes f.
+func sniffFile(f io.ReadSeekCloser) (imageInfo, error) {
+	info := imageInfo{Format: vips.ImageTypeUnknown}
+	head := make([]byte, 64) // room for the compatible brands of an ftyp box
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		f.Close()
+		return info, fmt.Errorf("%w: %v", utils.ErrUnsupportedFormat, err)
+	}
+	info.Format = sniffMagic(head[:n])
+	if info.Format == vips.ImageTypeUnknown {
+		f.Close()
+		return info, fmt.Errorf("%w: content is not a known image type", utils.ErrUnsupportedFormat)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		return info, err
+	}
+
+	source := vips.NewSource(f)
+	defer source.Close()
+	img, err := vips.NewImageFromSource(source, nil)
+	if err != nil {
+		return info, fmt.Errorf("%w: %s content does not decode: %v", utils.ErrUnsupportedFormat, info.Format, err)
+	}
+	defer img.Close()
+
+	if decoded := img.Format(); !sameFormat(info.Format, decoded) {
+		return info, fmt.Errorf("%w: content starts as %s but decodes as %s", utils.ErrUnsupportedFormat, info.Format, decoded)
+	}
+	info.Width, info.Height = img.Width(), img.Height()
+	info.Orientation = max(img.Orientation(), 1)
+	info.Metadata = imagemeta.Extract(img)
+	return info, nil
+}
+
+// extensions is the file extension an original is stored under, by format.
+var extensions = map[vips.ImageType]string{
+	vips.ImageTypeJpeg: ".jpg",
+	vips.ImageTypePng:  ".png",
+	vips.ImageTypeGif:  ".gif",
+	vips.ImageTypeWebp: ".webp",
+	vips.ImageTypeHeif: ".heic",
+	vips.ImageTypeAvif: ".avif",
+	vips.ImageTypeTiff: ".tif",
+}
+
+// mimeType is the MIME type reported for a sniffed format, empty when
+// nothing was recognised.
+func mimeType(format vips.ImageType) string {
+	if format == vips.ImageTypeUnknown {
+		return ""
+	}
+	if mime, ok := format.MimeType(); ok {
+		return mime
+	}
+	return "image/" + string(format)
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/cshum/vipsgen/vips"
+)
+
+// ftyp builds an ftyp box with the given major and compatible brands.
+func ftyp(major string, compatible ...string) []byte {
+	box := make([]byte, 16, 16+4*len(compatible))
+	binary.BigEndian.PutUint32(box, uint32(16+4*len(compatible)))
+	copy(box[4:], "ftyp")
+	copy(box[8:], major)
+	for _, brand := range compatible {
+		box = append(box, brand...)
+	}
+	return box
+}
+
+func TestSniffMagic(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want vips.ImageType
+	}{
+		{"jpeg", []byte{0xFF, 0xD8, 0xFF, 0xE0, 0, 0x10}, vips.ImageTypeJpeg},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00"), vips.ImageTypePng},
+		{"gif87a", []byte("GIF87a..."), vips.ImageTypeGif},
+		{"gif89a", []byte("GIF89a..."), vips.ImageTypeGif},
+		{"tiff little endian", []byte("II*\x00\x08\x00"), vips.ImageTypeTiff},
+		{"tiff big endian", []byte("MM\x00*\x00\x08"), vips.ImageTypeTiff},
+		{"webp", []byte("RIFF\x24\x00\x00\x00WEBPVP8 "), vips.ImageTypeWebp},
+		{"riff but not webp", []byte("RIFF\x24\x00\x00\x00WAVEfmt "), vips.ImageTypeUnknown},
+		{"avif", ftyp("avif", "mif1", "miaf"), vips.ImageTypeAvif},
+		{"avif sequence", ftyp("avis", "msf1"), vips.ImageTypeAvif},
+		{"heic", ftyp("heic", "mif1", "heic"), vips.ImageTypeHeif},
+		{"mif1 listing avif", ftyp("mif1", "mif1", "avif", "miaf", "MA1B"), vips.ImageTypeAvif},
+		{"msf1 listing avis", ftyp("msf1", "msf1", "avis"), vips.ImageTypeAvif},
+		{"mif1 listing heic", ftyp("mif1", "mif1", "heic"), vips.ImageTypeHeif},
+		{"mif1 alone", ftyp("mif1"), vips.ImageTypeHeif},
+		// Bytes past the end of the box are the next box, not brands.
+		{"avif after the box", append(ftyp("mif1", "heic"), "avif"...), vips.ImageTypeHeif},
+		{"mp4", ftyp("isom", "iso2", "avc1"), vips.ImageTypeUnknown},
+		{"text", []byte("hello, world"), vips.ImageTypeUnknown},
+		{"empty", nil, vips.ImageTypeUnknown},
+		{"short ftyp", []byte("\x00\x00\x00\x0cftyp"), vips.ImageTypeUnknown},
+	}
+	for _, tt := range tests {
+		if got := sniffMagic(tt.head); got != tt.want {
+			t.Errorf("%s: sniffMagic = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSameFormat(t *testing.T) {
+	tests := []struct {
+		magic, decoded vips.ImageType
+		want           bool
+	}{
+		{vips.ImageTypeJpeg, vips.ImageTypeJpeg, true},
+		{vips.ImageTypeJpeg, vips.ImageTypePng, false},
+		{vips.ImageTypeAvif, vips.ImageTypeAvif, true},
+		{vips.ImageTypeAvif, vips.ImageTypeHeif, true},
+		{vips.ImageTypeHeif, vips.ImageTypeHeif, true},
+		{vips.ImageTypeHeif, vips.ImageTypeAvif, false},
+		{vips.ImageTypeAvif, vips.ImageTypeJpeg, false},
+	}
+	for _, tt := range tests {
+		if got := sameFormat(tt.magic, tt.decoded); got != tt.want {
+			t.Errorf("sameFormat(%q, %q) = %v, want %v", tt.magic, tt.decoded, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,482 @@
+package handler
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	cm "github.com/mahdi-cpp/api-go-settings/internal/collection_manager_v3"
+)
+
+// https://tus.io/protocols/resumable-upload
+
+const (
+	tusVersion     = "1.0.0"
+	tusExtensions  = "creation,termination,expiration"
+	tusContentType = "application/offset+octet-stream"
+
+	// tusExpiry is how long an upload survives without a PATCH, and how long
+	// a finished one can still be queried.
+	tusExpiry = 24 * time.Hour
+)
+
+var (
+	errInvalidMetadata = errors.New("invalid Upload-Metadata")
+	errUploadNotFound  = errors.New("upload not found")
+)
+
+// tusUpload is the state of one resumable upload. The bytes received so far
+// are kept in <id>.part until the upload completes.
+type tusUpload struct {
+	ID               string            `json:"id"`
+	User             string            `json:"user"`
+	Length           int64             `json:"length"`
+	Offset           int64             `json:"offset"`
+	Metadata         map[string]string `json:"metadata,omitempty"`
+	Reserved         bool              `json:"reserved,omitempty"` // Length is charged to User's quota
+	ExpiresAt        time.Time         `json:"expiresAt"`
+	HashState        []byte            `json:"hashState,omitempty"` // SHA-256 of the bytes so far
+	Result           *UploadResponse   `json:"result,omitempty"`
+	CreationDate     time.Time         `json:"creationDate"`
+	ModificationDate time.Time         `json:"modificationDate"`
+}
+
+func (u *tusUpload) SetID(id string)          { u.ID = id }
+func (u *tusUpload) SetCreatedAt(t time.Time) { u.CreationDate = t }
+func (u *tusUpload) SetUpdatedAt(t time.Time) { u.ModificationDate = t }
+func (u *tusUpload) GetID() string            { return u.ID }
+func (u *tusUpload) GetCreatedAt() time.Time  { return u.CreationDate }
+func (u *tusUpload) GetUpdatedAt() time.Time  { return u.ModificationDate }
+func (u *tusUpload) GetExpiresAt() time.Time  { return u.ExpiresAt }
+
+// filename is the file name the client announced in Upload-Metadata.
+func (u *tusUpload) filename() string {
+	if name := u.Metadata["filename"]; name != "" {
+		return name
+	}
+	return u.Metadata["name"]
+}
+
+func (u *tusUpload) complete() bool        { return u.Offset == u.Length }
+func (u *tusUpload) remaining() int64      { return u.Length - u.Offset }
+func (u *tusUpload) offsetHeader() string  { return strconv.FormatInt(u.Offset, 10) }
+func (u *tusUpload) expiresHeader() string { return u.ExpiresAt.UTC().Format(http.TimeFormat) }
+
+// TusHandler serves the tus 1.0 resumable upload protocol with the creation,
+// termination and expiration extensions, under the size limit and quotas of
+// the UploadHandler it finalises into. Sessions live in a collection under
+// UploadDir/.tus and expire tusExpiry after their last PATCH, taking their
+// partial data with them. Each session holds the quota for its full length
+// from its creation until it is finalised, deleted or expires. A completed
+// upload goes through the same pipeline as UploadImage; its outcome can be
+// fetched with GET until it expires.
+type TusHandler struct {
+	uploads  *UploadHandler
+	dir      string
+	sessions *cm.Manager[*tusUpload]
+	busy     sync.Map // upload IDs with a PATCH or DELETE in progress
+}
+
+func NewTusHandler(uploads *UploadHandler) (*TusHandler, error) {
+	dir := filepath.Join(uploads.UploadDir, ".tus")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	sessions, err := cm.NewCollectionManager[*tusUpload](filepath.Join(dir, "sessions"), false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load upload sessions: %w", err)
+	}
+
+	h := &TusHandler{uploads: uploads, dir: dir, sessions: sessions}
+	sessions.OnChange(func(event cm.ChangeEvent[*tusUpload]) {
+		if event.Op == cm.ChangeDelete || event.Op == cm.ChangeExpire {
+			if event.Item.Reserved {
+				uploads.quotas.release(event.Item.User, event.Item.Length, 1)
+			}
+			if err := os.Remove(h.partPath(event.ID)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				log.Printf("failed to remove partial upload %s: %v", event.ID, err)
+			}
+		}
+	})
+	sessions.StartSweeper(context.Background(), time.Minute)
+	return h, nil
+}
+
+// Protocol is the middleware for every tus route: it announces the protocol
+// version and answers 412 to requests speaking another one. OPTIONS and the
+// non-tus GET are exempt.
+func (h *TusHandler) Protocol(c *gin.Context) {
+	c.Header("Tus-Resumable", tusVersion)
+	method := c.Request.Method
+	if method != http.MethodOptions && method != http.MethodGet && c.GetHeader("Tus-Resumable") != tusVersion {
+		c.Header("Tus-Version", tusVersion)
+		c.AbortWithStatus(http.StatusPreconditionFailed)
+		return
+	}
+	c.Next()
+}
+
+// http://localhost:50150/api/v1/upload/tus
+func (h *TusHandler) Options(c *gin.Context) {
+	c.Header("Tus-Version", tusVersion)
+	c.Header("Tus-Extension", tusExtensions)
+	if h.uploads.MaxFileSize > 0 {
+		c.Header("Tus-Max-Size", strconv.FormatInt(h.uploads.MaxFileSize, 10))
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// Create starts an upload of Upload-Length bytes and answers with its URL in
+// Location. The full length is charged to the quota here, so uploads in
+// progress cannot together outgrow it.
+func (h *TusHandler) Create(c *gin.Context) {
+	user, err := uploader(c)
+	if err != nil {
+		c.JSON(uploadStatus(err, http.StatusBadRequest), gin.H{"error": err.Error()})
+		return
+	}
+	length, err := strconv.ParseInt(c.GetHeader("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Length must be a non-negative integer"})
+		return
+	}
+	if err := h.uploads.checkSize(length); err != nil {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	}
+	meta, err := parseUploadMetadata(c.GetHeader("Upload-Metadata"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.uploads.quotas.reserve(user, length, 1); err != nil {
+		c.JSON(uploadStatus(err, http.StatusInternalServerError), gin.H{"error": err.Error()})
+		return
+	}
+
+	upload, err := h.sessions.Create(&tusUpload{User: user, Length: length, Metadata: meta, Reserved: true, ExpiresAt: time.Now().Add(tusExpiry)})
+	if err != nil {
+		h.uploads.quotas.release(user, length, 1)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := os.WriteFile(h.partPath(upload.ID), nil, 0644); err != nil {
+		h.sessions.Delete(upload.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("Location", strings.TrimSuffix(c.Request.URL.Path, "/")+"/"+upload.ID)
+	c.Header("Upload-Expires", upload.expiresHeader())
+	c.Status(http.StatusCreated)
+}
+
+// Head reports how many bytes of the upload the server has.
+func (h *TusHandler) Head(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	upload, status, err := h.session(c)
+	if err != nil {
+		c.Status(status)
+		return
+	}
+
+	c.Header("Upload-Offset", upload.offsetHeader())
+	c.Header("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	if len(upload.Metadata) > 0 {
+		c.Header("Upload-Metadata", encodeUploadMetadata(upload.Metadata))
+	}
+	c.Header("Upload-Expires", upload.expiresHeader())
+	c.Status(http.StatusOK)
+}
+
+// Get returns the upload state as JSON, including the stored file once the
+// upload has completed.
+//
+// http://localhost:50150/api/v1/upload/tus/0198c111-9b1c-7d6e-a000-5c1d3e7f9a21
+func (h *TusHandler) Get(c *gin.Context) {
+	upload, status, err := h.session(c)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, upload)
+}
+
+// Patch appends the request body at Upload-Offset, which must be where the
+// upload currently ends. Whatever arrives before the body breaks off is kept,
+// so the client can resume from the offset Head reports. The chunk that
+// completes the upload also finalises it.
+func (h *TusHandler) Patch(c *gin.Context) {
+	if c.ContentType() != tusContentType {
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be " + tusContentType})
+		return
+	}
+	offset, err := strconv.ParseInt(c.GetHeader("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Upload-Offset must be a non-negative integer"})
+		return
+	}
+
+	id := c.Param("id")
+	if !h.acquire(id) {
+		c.JSON(http.StatusLocked, gin.H{"error": "upload is being written by another request"})
+		return
+	}
+	defer h.release(id)
+
+	upload, status, err := h.session(c)
+	if err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if offset != upload.Offset {
+		c.Header("Upload-Offset", upload.offsetHeader())
+		c.JSON(http.StatusConflict, gin.H{"error": fmt.Sprintf("Upload-Offset is %d, expected %d", offset, upload.Offset)})
+		return
+	}
+	if upload.complete() && upload.Result != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": "upload is already complete"})
+		return
+	}
+	if c.Request.ContentLength > upload.remaining() {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("chunk exceeds the %d bytes left", upload.remaining())})
+		return
+	}
+
+	// The session is advanced on a copy, so a failed save leaves the one
+	// the collection holds, and the offset clients resume from, as it was.
+	next := *upload
+	interrupted, err := h.appendPart(&next, c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	next.ExpiresAt = time.Now().Add(tusExpiry)
+	if _, err := h.sessions.Update(&next); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	upload = &next
+
+	c.Header("Upload-Offset", upload.offsetHeader())
+	c.Header("Upload-Expires", upload.expiresHeader())
+	if interrupted != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "upload interrupted: " + interrupted.Error()})
+		return
+	}
+
+	if upload.complete() {
+		status, response := h.finalize(upload)
+		if status != http.StatusOK {
+			c.JSON(status, response)
+			return
+		}
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// appendPart writes body to the end of the upload's partial data, feeding
+// it to the upload's checksum on the way, and advances the offset by what
+// was written. If the body breaks off, what arrived is kept and the read
+// error returned as interrupted; any other error leaves the upload as it
+// was. Bytes beyond the recorded offset, left by a request that failed
+// before its session was saved, are dropped first.
+func (h *TusHandler) appendPart(upload *tusUpload, body io.Reader) (interrupted error, err error) {
+	sum, err := resumeHash(upload.HashState)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(h.partPath(upload.ID), os.O_WRONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Truncate(upload.Offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(upload.Offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	body = io.LimitReader(body, upload.remaining())
+	buf := make([]byte, 32<<10)
+	var written int64
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if _, err := f.Write(buf[:n]); err != nil {
+				f.Close()
+				return nil, err
+			}
+			sum.Write(buf[:n])
+			written += int64(n)
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			interrupted = readErr
+			break
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	state, err := saveHash(sum)
+	if err != nil {
+		return nil, err
+	}
+	upload.Offset += written
+	upload.HashState = state
+	return interrupted, nil
+}
+
+// finalize hands the completed upload to the UploadImage pipeline and
+// records the outcome. Content that is not a supported image, or that fails
+// to be stored, ends the session along with its data.
+func (h *TusHandler) finalize(upload *tusUpload) (int, UploadResponse) {
+	part := h.partPath(upload.ID)
+	f, err := os.Open(part)
+	if err != nil {
+		return http.StatusInternalServerError, UploadResponse{Message: "Failed to open upload", Errors: []string{err.Error()}}
+	}
+	info, err := sniffFile(f)
+	if err != nil {
+		h.sessions.Delete(upload.ID)
+		return http.StatusUnsupportedMediaType, UploadResponse{Message: "Unsupported image", DetectedType: mimeType(info.Format), Errors: []string{err.Error()}}
+	}
+
+	sum, err := resumeHash(upload.HashState)
+	if err != nil {
+		return http.StatusInternalServerError, UploadResponse{Message: "Failed to checksum upload", Errors: []string{err.Error()}}
+	}
+
+	// The charge the session holds passes to storeImage, which keeps it only
+	// if the file is stored.
+	handed := *upload
+	handed.Reserved = false
+	if _, err := h.sessions.Update(&handed); err != nil {
+		return http.StatusInternalServerError, UploadResponse{Message: "Failed to record upload", Errors: []string{err.Error()}}
+	}
+	response, err := h.uploads.storeImage(upload.User, upload.filename(), info, upload.Length, upload.Reserved, func(dst string) (string, error) {
+		return hex.EncodeToString(sum.Sum(nil)), moveFile(part, dst)
+	})
+	if err != nil {
+		// The data may have gone with the failed attempt; the client has to
+		// start over.
+		h.sessions.Delete(upload.ID)
+		return uploadStatus(err, http.StatusInternalServerError), UploadResponse{Message: response.Message, Errors: []string{err.Error()}}
+	}
+
+	done := handed
+	done.Result = &response
+	if _, err := h.sessions.Update(&done); err != nil {
+		return http.StatusInternalServerError, UploadResponse{Message: "Failed to record upload", Errors: []string{err.Error()}}
+	}
+	return http.StatusOK, response
+}
+
+// Delete terminates the upload and discards its partial data. Files stored
+// by a completed upload are kept.
+func (h *TusHandler) Delete(c *gin.Context) {
+	id := c.Param("id")
+	if !h.acquire(id) {
+		c.JSON(http.StatusLocked, gin.H{"error": "upload is being written by another request"})
+		return
+	}
+	defer h.release(id)
+
+	if _, status, err := h.session(c); err != nil {
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.sessions.Delete(id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// session returns the upload the request names if the requesting user
+// created it. Uploads of other users are reported as not found.
+func (h *TusHandler) session(c *gin.Context) (*tusUpload, int, error) {
+	user, err := uploader(c)
+	if err != nil {
+		return nil, uploadStatus(err, http.StatusBadRequest), err
+	}
+	upload, err := h.sessions.Get(c.Param("id"))
+	if err != nil || upload.User != user {
+		return nil, http.StatusNotFound, errUploadNotFound
+	}
+	return upload, http.StatusOK, nil
+}
+
+func (h *TusHandler) partPath(id string) string {
+	return filepath.Join(h.dir, id+".part")
+}
+
+func (h *TusHandler) acquire(id string) bool {
+	_, busy := h.busy.LoadOrStore(id, struct{}{})
+	return !busy
+}
+
+func (h *TusHandler) release(id string) {
+	h.busy.Delete(id)
+}
+
+// parseUploadMetadata decodes an Upload-Metadata header: comma-separated
+// pairs of a key and an optional base64 value, separated by a space.
+func parseUploadMetadata(header string) (map[string]string, error) {
+	if strings.TrimSpace(header) == "" {
+		return nil, nil
+	}
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("%w: empty key", errInvalidMetadata)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", errInvalidMetadata, key, err)
+		}
+		meta[key] = string(decoded)
+	}
+	return meta, nil
+}
+
+func encodeUploadMetadata(meta map[string]string) string {
+	keys := make([]string, 0, len(meta))
+	for key := range meta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = key
+		if meta[key] != "" {
+			pairs[i] += " " + base64.StdEncoding.EncodeToString([]byte(meta[key]))
+		}
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/cshum/vipsgen/vips"
+	"github.com/gin-gonic/gin"
+)
+
+// newTestTus returns a router serving the tus routes of a test TusHandler.
+func newTestTus(t *testing.T, quota Quota) (*gin.Engine, *TusHandler) {
+	t.Helper()
+	h, err := NewTusHandler(newTestUploads(t, 1<<20, quota))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := gin.New()
+	tus := r.Group("/tus", testSigner.Authenticate, h.Protocol)
+	tus.POST("", h.Create)
+	tus.HEAD("/:id", h.Head)
+	tus.PATCH("/:id", h.Patch)
+	tus.DELETE("/:id", h.Delete)
+	return r, h
+}
+
+func tusRequest(t *testing.T, r *gin.Engine, method, path, user string, headers map[string]string, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", bearer(t, user))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	if method == http.MethodPatch {
+		req.Header.Set("Content-Type", tusContentType)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// createUpload starts an upload of length bytes and returns its path.
+func createUpload(t *testing.T, r *gin.Engine, user string, length int) string {
+	t.Helper()
+	w := tusRequest(t, r, http.MethodPost, "/tus", user, map[string]string{"Upload-Length": strconv.Itoa(length)}, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	return w.Header().Get("Location")
+}
+
+func TestTusResumeAtReportedOffset(t *testing.T) {
+	r, _ := newTestTus(t, Quota{})
+	path := createUpload(t, r, "alice", 10)
+
+	if w := tusRequest(t, r, http.MethodPatch, path, "alice", map[string]string{"Upload-Offset": "0"}, "abcd"); w.Code != http.StatusNoContent {
+		t.Fatalf("first chunk: status %d: %s", w.Code, w.Body)
+	}
+	w := tusRequest(t, r, http.MethodHead, path, "alice", nil, "")
+	if got := w.Header().Get("Upload-Offset"); got != "4" {
+		t.Fatalf("offset after first chunk = %q, want 4", got)
+	}
+
+	// A client that lost track resends from the start and is told where to
+	// resume.
+	w = tusRequest(t, r, http.MethodPatch, path, "alice", map[string]string{"Upload-Offset": "0"}, "abcd")
+	if w.Code != http.StatusConflict || w.Header().Get("Upload-Offset") != "4" {
+		t.Fatalf("stale offset: status %d, offset %q", w.Code, w.Header().Get("Upload-Offset"))
+	}
+
+	if w := tusRequest(t, r, http.MethodPatch, path, "alice", map[string]string{"Upload-Offset": "4"}, "efg"); w.Code != http.StatusNoContent {
+		t.Fatalf("second chunk: status %d: %s", w.Code, w.Body)
+	}
+	w = tusRequest(t, r, http.MethodHead, path, "alice", nil, "")
+	if got := w.Header().Get("Upload-Offset"); got != "7" {
+		t.Fatalf("offset after second chunk = %q, want 7", got)
+	}
+
+	// Other users do not see the upload at all.
+	if w := tusRequest(t, r, http.MethodHead, path, "bob", nil, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("head by another user: status %d", w.Code)
+	}
+}
+
+func TestTusRefusesChunkBeyondLength(t *testing.T) {
+	r, _ := newTestTus(t, Quota{})
+	path := createUpload(t, r, "alice", 4)
+
+	w := tusRequest(t, r, http.MethodPatch, path, "alice", map[string]string{"Upload-Offset": "0"}, "abcdef")
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want 413: %s", w.Code, w.Body)
+	}
+	w = tusRequest(t, r, http.MethodHead, path, "alice", nil, "")
+	if got := w.Header().Get("Upload-Offset"); got != "0" {
+		t.Fatalf("offset = %q, want 0", got)
+	}
+}
+
+func TestTusReservesQuotaUntilSessionEnds(t *testing.T) {
+	r, h := newTestTus(t, Quota{MaxBytes: 100})
+	usage := func() int64 { return h.uploads.quotas.get("alice").Bytes }
+
+	deleted := createUpload(t, r, "alice", 60)
+	if got := usage(); got != 60 {
+		t.Fatalf("usage after create = %d, want 60", got)
+	}
+	// The first upload's reservation leaves no room for a second.
+	w := tusRequest(t, r, http.MethodPost, "/tus", "alice", map[string]string{"Upload-Length": "60"}, "")
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("create beyond quota: status %d", w.Code)
+	}
+	if got := usage(); got != 60 {
+		t.Fatalf("usage after refused create = %d, want 60", got)
+	}
+
+	if w := tusRequest(t, r, http.MethodDelete, deleted, "alice", nil, ""); w.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d", w.Code)
+	}
+	if got := usage(); got != 0 {
+		t.Fatalf("usage after delete = %d, want 0", got)
+	}
+
+	expired := createUpload(t, r, "alice", 30)
+	upload, err := h.sessions.Get(expired[strings.LastIndex(expired, "/")+1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := *upload
+	stale.ExpiresAt = stale.ExpiresAt.Add(-2 * tusExpiry)
+	if _, err := h.sessions.Update(&stale); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := h.sessions.SweepExpired(); err != nil || n != 1 {
+		t.Fatalf("swept %d, %v", n, err)
+	}
+	if got := usage(); got != 0 {
+		t.Fatalf("usage after expiry = %d, want 0", got)
+	}
+
+	// Content that is not an image is refused when the upload completes.
+	refused := createUpload(t, r, "alice", 4)
+	if w := tusRequest(t, r, http.MethodPatch, refused, "alice", map[string]string{"Upload-Offset": "0"}, "abcd"); w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("finalize: status %d: %s", w.Code, w.Body)
+	}
+	if got := usage(); got != 0 {
+		t.Fatalf("usage after refused upload = %d, want 0", got)
+	}
+}
+
+func TestStoreImageKeepsReservedCharge(t *testing.T) {
+	h := newTestUploads(t, 0, Quota{})
+	if err := h.quotas.reserve("alice", 5, 1); err != nil {
+		t.Fatal(err)
+	}
+	_, err := h.storeImage("alice", "a.jpg", imageInfo{Format: vips.ImageTypeJpeg}, 5, true, func(dst string) (string, error) {
+		return "0123", os.WriteFile(dst, []byte("hello"), 0644)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := h.quotas.get("alice"); got.Bytes != 5 || got.Files != 1 {
+		t.Fatalf("usage = %d bytes in %d files, want 5 in 1", got.Bytes, got.Files)
+	}
+}
@@ -1,83 +1,303 @@
 package handler
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
 
 	"github.com/cshum/vipsgen/vips"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
-	"github.com/mahdi-cpp/api-go-settings/internal/thumbnail"
+	cm "github.com/mahdi-cpp/api-go-settings/internal/collection_manager_v3"
+	"github.com/mahdi-cpp/api-go-settings/internal/config"
+	"github.com/mahdi-cpp/api-go-settings/internal/jobs"
+	"github.com/mahdi-cpp/api-go-settings/internal/snapshot"
+	"github.com/mahdi-cpp/api-go-settings/internal/utils"
 )
 
 //https://chat.deepseek.com/a/chat/s/913cf162-1ad1-4857-8048-2990d3c959a4
 
+const (
+	// maxFilesPerRequest bounds how many files UploadMultiple takes at once.
+	maxFilesPerRequest = 32
+
+	// originalRoute and thumbnailRoute are where DownloadHandler serves
+	// originals and thumbnails, relative to the data root.
+	originalRoute  = "/api/v1/download/original/"
+	thumbnailRoute = "/api/v1/download/thumbnail/"
+)
+
 type UploadHandler struct {
+	// UploadDir holds the handler's indexes and resumable uploads. Originals
+	// are stored in the assets directory of the user who uploaded them.
 	UploadDir string
+
+	// MaxFileSize is the largest file accepted, in bytes; 0 means no limit.
+	MaxFileSize int64
+
+	quotas   *quotas
+	contents *contents
+	assets   *assetStore
+	queue    *jobs.Queue
+}
+
+// NewUploadHandler stores uploads in the assets directory of each user,
+// refusing files above maxFileSize and uploads beyond quota. Storage usage is
+// kept per user in the usage.json collection under config.GetPath and the
+// content index in the uploadDir/.contents collection; uploads are staged in
+// uploadDir/.staging until they are known to be new. Asset records are kept
+// in each user's directory, sealed with their data keys under ring unless
+// ring is nil; originals and records stored the way earlier versions did are
+// migrated there. Thumbnails are created by jobs on queue, for which the
+// handler registers itself.
+func NewUploadHandler(uploadDir string, maxFileSize int64, quota Quota, queue *jobs.Queue, ring *cm.Keyring) (*UploadHandler, error) {
+	if err := os.MkdirAll(filepath.Join(uploadDir, ".staging"), 0755); err != nil {
+		return nil, err
+	}
+	if err := moveLegacyUsage(filepath.Join(uploadDir, ".usage.json"), config.GetPath(usageFile)); err != nil {
+		return nil, err
+	}
+	q, err := newQuotas(config.GetPath(usageFile), quota)
+	if err != nil {
+		return nil, err
+	}
+	assets := newAssetStore(ring)
+	contents, err := newContents(uploadDir, assets)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &UploadHandler{UploadDir: uploadDir, MaxFileSize: maxFileSize, quotas: q, contents: contents, assets: assets, queue: queue}
+	queue.Handle(thumbnailJob, h.processThumbnail)
+	if err := h.migrateLegacyAssets(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// formFile admits the request for user and reads its single "file" field,
+// refusing files above MaxFileSize.
+func (h *UploadHandler) formFile(c *gin.Context, user string) (*multipart.FileHeader, error) {
+	if err := h.admit(c, user, h.bodyLimit(1)); err != nil {
+		return nil, err
+	}
+	file, err := c.FormFile("file")
+	if err != nil {
+		return nil, err
+	}
+	return file, h.checkSize(file.Size)
 }
 
 type UploadResponse struct {
-	Message  string   `json:"message"`
-	Filename string   `json:"filename"`
-	Size     int64    `json:"size"`
-	URL      string   `json:"url"`
-	Errors   []string `json:"errors,omitempty"`
+	Message      string   `json:"message"`
+	ID           string   `json:"id,omitempty"`
+	Duplicate    bool     `json:"duplicate,omitempty"`
+	Filename     string   `json:"filename"`
+	Size         int64    `json:"size"`
+	URL          string   `json:"url"`
+	DetectedType string   `json:"detectedType,omitempty"`
+	Width        int      `json:"width,omitempty"`
+	Height       int      `json:"height,omitempty"`
+	Orientation  int      `json:"orientation,omitempty"`
+	JobID        string   `json:"jobID,omitempty"` // the job processing the original further
+	Errors       []string `json:"errors,omitempty"`
 }
 
 func (h *UploadHandler) UploadJPEG(c *gin.Context) {
-
-	vips.Startup(nil)
-	defer vips.Shutdown()
+	user, err := uploader(c)
+	if err != nil {
+		c.JSON(uploadStatus(err, http.StatusBadRequest), UploadResponse{Message: "Invalid user", Errors: []string{err.Error()}})
+		return
+	}
 
 	// Single file upload
-	file, err := c.FormFile("file")
+	file, err := h.formFile(c, user)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, UploadResponse{
-			Message: "No file uploaded",
+		c.JSON(uploadStatus(err, http.StatusBadRequest), UploadResponse{
+			Message: "Upload refused",
 			Errors:  []string{err.Error()},
 		})
 		return
 	}
 
-	// Check if it's a JPEG
-	if !isJPEG(file) {
-		c.JSON(http.StatusBadRequest, UploadResponse{Message: "Only JPEG files are allowed", Errors: []string{"Invalid file type"}})
+	// Check if it's a JPEG by its content
+	info, err := sniffUpload(file)
+	if err == nil && info.Format != vips.ImageTypeJpeg {
+		err = fmt.Errorf("%w: %s", utils.ErrUnsupportedFormat, info.Format)
+	}
+	if err != nil {
+		c.JSON(http.StatusUnsupportedMediaType, UploadResponse{Message: "Only JPEG files are allowed", DetectedType: mimeType(info.Format), Errors: []string{err.Error()}})
 		return
 	}
 
-	// Generate unique filename
-	uuidName, err := generateUniqueFilename()
-	fileDirectory := filepath.Join(h.UploadDir, uuidName+".jpg")
+	response, err := h.storeImage(user, file.Filename, info, file.Size, false, saveUploaded(file))
+	if err != nil {
+		c.JSON(uploadStatus(err, http.StatusInternalServerError), UploadResponse{Message: response.Message, Errors: []string{err.Error()}})
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
 
-	// Save the file
-	if err := c.SaveUploadedFile(file, fileDirectory); err != nil {
-		c.JSON(http.StatusInternalServerError, UploadResponse{Message: "Failed to save file", Errors: []string{err.Error()}})
+// UploadImage accepts any image format sniffUpload recognises and vips can
+// decode, stores the original byte for byte and records its format,
+// dimensions and orientation.
+func (h *UploadHandler) UploadImage(c *gin.Context) {
+	user, err := uploader(c)
+	if err != nil {
+		c.JSON(uploadStatus(err, http.StatusBadRequest), UploadResponse{Message: "Invalid user", Errors: []string{err.Error()}})
 		return
 	}
 
-	if err := thumbnail.CreateSingleThumbnail(fileDirectory, uuidName+".jpg"); err != nil {
-		c.JSON(http.StatusInternalServerError, UploadResponse{Message: "Failed to create thumbnail file", Errors: []string{err.Error()}})
-		log.Fatalf("An error occurred during thumbnail creation: %v", err)
+	file, err := h.formFile(c, user)
+	if err != nil {
+		c.JSON(uploadStatus(err, http.StatusBadRequest), UploadResponse{
+			Message: "Upload refused",
+			Errors:  []string{err.Error()},
+		})
+		return
 	}
 
-	c.JSON(http.StatusOK, UploadResponse{
-		Message:  "File uploaded successfully",
-		Filename: uuidName,
-		Size:     file.Size,
-		URL:      "/uploads/" + uuidName,
-	})
+	info, err := sniffUpload(file)
+	if err != nil {
+		c.JSON(http.StatusUnsupportedMediaType, UploadResponse{Message: "Unsupported image", DetectedType: mimeType(info.Format), Errors: []string{err.Error()}})
+		return
+	}
+
+	response, err := h.storeImage(user, file.Filename, info, file.Size, false, saveUploaded(file))
+	if err != nil {
+		c.JSON(uploadStatus(err, http.StatusInternalServerError), UploadResponse{Message: response.Message, Errors: []string{err.Error()}})
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// storeImage is the pipeline every upload ends in once its content has been
+// sniffed: the file is charged to the quota of user, save writes it to a
+// staging file outside the data root, hashing it on the way, and unless the
+// user has stored that content before it is moved into the user's assets
+// directory under a new name, an Asset is recorded and a job queued to
+// create its thumbnail, name being the file name the client gave. For
+// content stored before the response names the existing asset, and nothing
+// reaches the data root. With reserved set the caller has charged the file
+// already; either way the charge is only kept if the file is stored. On
+// failure the response only carries a message naming the failed step.
+func (h *UploadHandler) storeImage(user string, name string, info imageInfo, size int64, reserved bool, save saveFunc) (UploadResponse, error) {
+	if !reserved {
+		if err := h.quotas.reserve(user, size, 1); err != nil {
+			return UploadResponse{Message: "Storage quota exceeded"}, err
+		}
+	}
+	uuidName, err := generateUniqueFilename()
+	if err != nil {
+		h.quotas.release(user, size, 1)
+		return UploadResponse{Message: "Failed to name file"}, err
+	}
+	filename := uuidName + extensions[info.Format]
+	dir := userAssetsDir(user)
+	fileDirectory := filepath.Join(dir, filename)
+
+	staged := filepath.Join(h.stagingDir(), filename)
+	defer os.Remove(staged)
+	sum, err := save(staged)
+	if err != nil {
+		h.quotas.release(user, size, 1)
+		return UploadResponse{Message: "Failed to save file"}, err
+	}
+
+	existing, err := h.contents.claim(user, sum, contentRef{AssetID: uuidName, Filename: filename, Size: size})
+	if err != nil || existing != nil {
+		h.quotas.release(user, size, 1)
+	}
+	if err != nil {
+		return UploadResponse{Message: "Failed to index file"}, err
+	}
+	if existing != nil {
+		return UploadResponse{
+			Message:      "File already uploaded",
+			ID:           existing.AssetID,
+			Duplicate:    true,
+			Filename:     existing.Filename,
+			Size:         existing.Size,
+			URL:          originalURL(filepath.Join(dir, existing.Filename)),
+			DetectedType: mimeType(info.Format),
+			Width:        info.Width,
+			Height:       info.Height,
+			Orientation:  info.Orientation,
+		}, nil
+	}
+
+	endWrite := snapshot.BeginWrite()
+	err = os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = moveFile(staged, fileDirectory)
+	}
+	endWrite()
+	if err != nil {
+		h.contents.unclaim(user, sum, uuidName)
+		h.quotas.release(user, size, 1)
+		return UploadResponse{Message: "Failed to save file"}, err
+	}
+
+	records, err := h.assets.of(user)
+	var asset *Asset
+	if err == nil {
+		asset, err = records.CreateWithID(&Asset{
+			ID:               uuidName,
+			UserID:           user,
+			Filename:         filename,
+			OriginalFilename: name,
+			Size:             size,
+			SHA256:           sum,
+			MimeType:         mimeType(info.Format),
+			Width:            info.Width,
+			Height:           info.Height,
+			Orientation:      info.Orientation,
+			Metadata:         &info.Metadata,
+		})
+	}
+	if err != nil {
+		// Without its record nothing would ever refer to the original.
+		h.contents.unclaim(user, sum, uuidName)
+		removeOriginal(fileDirectory)
+		h.quotas.release(user, size, 1)
+		return UploadResponse{Message: "Failed to record file"}, err
+	}
+
+	return UploadResponse{
+		Message:      "File uploaded successfully",
+		ID:           asset.ID,
+		Filename:     asset.Filename,
+		Size:         asset.Size,
+		URL:          originalURL(fileDirectory),
+		DetectedType: asset.MimeType,
+		Width:        asset.Width,
+		Height:       asset.Height,
+		Orientation:  asset.Orientation,
+		JobID:        h.queueProcessing(asset),
+	}, nil
 }
 
 func (h *UploadHandler) UploadMultiple(c *gin.Context) {
+	user, err := uploader(c)
+	if err == nil {
+		err = h.admit(c, user, h.bodyLimit(maxFilesPerRequest))
+	}
+	if err != nil {
+		c.JSON(uploadStatus(err, http.StatusBadRequest), UploadResponse{Message: "Upload refused", Errors: []string{err.Error()}})
+		return
+	}
+
 	// Multipart form
 	form, err := c.MultipartForm()
 	if err != nil {
-		c.JSON(http.StatusBadRequest, UploadResponse{
+		c.JSON(uploadStatus(err, http.StatusBadRequest), UploadResponse{
 			Message: "Failed to parse form",
 			Errors:  []string{err.Error()},
 		})
@@ -85,35 +305,36 @@ func (h *UploadHandler) UploadMultiple(c *gin.Context) {
 	}
 
 	files := form.File["files"]
+	if len(files) > maxFilesPerRequest {
+		c.JSON(http.StatusBadRequest, UploadResponse{Message: fmt.Sprintf("At most %d files per request", maxFilesPerRequest)})
+		return
+	}
 	var responses []UploadResponse
 	var errors []string
 
 	for _, file := range files {
-		// Check if it's a JPEG
-		if !isJPEG(file) {
-			errors = append(errors, fmt.Sprintf("%s: Not a JPEG file", file.Filename))
+		if err := h.checkSize(file.Size); err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %v", file.Filename, err))
 			continue
 		}
 
-		// Generate unique filename
-		uniqueName, err := generateUniqueFilename()
+		// Check if it's a JPEG by its content
+		info, err := sniffUpload(file)
 		if err != nil {
-			return
+			errors = append(errors, fmt.Sprintf("%s: %v", file.Filename, err))
+			continue
 		}
-		dst := filepath.Join(h.UploadDir, uniqueName)
-
-		// Save the file
-		if err := c.SaveUploadedFile(file, dst); err != nil {
-			errors = append(errors, fmt.Sprintf("%s: %s", file.Filename, err.Error()))
+		if info.Format != vips.ImageTypeJpeg {
+			errors = append(errors, fmt.Sprintf("%s: %v: %s", file.Filename, utils.ErrUnsupportedFormat, info.Format))
 			continue
 		}
 
-		responses = append(responses, UploadResponse{
-			Message:  "File uploaded successfully",
-			Filename: uniqueName,
-			Size:     file.Size,
-			URL:      "/uploads/" + uniqueName,
-		})
+		response, err := h.storeImage(user, file.Filename, info, file.Size, false, saveUploaded(file))
+		if err != nil {
+			errors = append(errors, fmt.Sprintf("%s: %s: %v", file.Filename, response.Message, err))
+			continue
+		}
+		responses = append(responses, response)
 	}
 
 	if len(errors) > 0 {
@@ -131,8 +352,32 @@ func (h *UploadHandler) UploadMultiple(c *gin.Context) {
 	})
 }
 
+// listedAsset is an asset as ListFiles reports it, with the URL its
+// original is downloaded from.
+type listedAsset struct {
+	*Asset
+	URL string `json:"url"`
+}
+
+// ListFiles lists the originals the requesting user stores, newest first,
+// from their asset records. expand names relation fields, comma separated,
+// to replace by the items they reference, e.g. expand=userID for the owner.
+//
+// http://localhost:50150/api/v1/upload/files?expand=userID
 func (h *UploadHandler) ListFiles(c *gin.Context) {
-	files, err := getJPEGFiles(h.UploadDir)
+	user, err := uploader(c)
+	if err != nil {
+		c.JSON(uploadStatus(err, http.StatusBadRequest), gin.H{"error": err.Error()})
+		return
+	}
+	records, err := h.assets.of(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": "Failed to list files",
+		})
+		return
+	}
+	assets, err := records.GetSortedList(nil, "creationDate", "desc")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{
 			"error": "Failed to list files",
@@ -140,24 +385,42 @@ func (h *UploadHandler) ListFiles(c *gin.Context) {
 		return
 	}
 
+	var expand []string
+	for _, field := range strings.Split(c.Query("expand"), ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			expand = append(expand, field)
+		}
+	}
+
+	dir := userAssetsDir(user)
+	files := make([]string, len(assets))
+	listed := make([]any, len(assets))
+	for i, asset := range assets {
+		files[i] = asset.Filename
+		url := originalURL(filepath.Join(dir, asset.Filename))
+		if len(expand) == 0 {
+			listed[i] = listedAsset{Asset: asset, URL: url}
+			continue
+		}
+		row, err := records.Expand(asset, expand...)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, cm.ErrUnknownRelation) {
+				status = http.StatusBadRequest
+			}
+			c.JSON(status, gin.H{"error": err.Error()})
+			return
+		}
+		row["url"] = url
+		listed[i] = row
+	}
 	c.JSON(http.StatusOK, gin.H{
-		"files": files,
+		"files":  files,
+		"assets": listed,
 	})
 }
 
 // Helper functions
-func isJPEG(file *multipart.FileHeader) bool {
-	// Check content type
-	contentType := file.Header.Get("Content-Type")
-	if contentType != "image/jpeg" {
-		return false
-	}
-
-	// Also check file extension for extra safety
-	ext := strings.ToLower(filepath.Ext(file.Filename))
-	return ext == ".jpg" || ext == ".jpeg"
-}
-
 func generateUniqueFilename() (string, error) {
 
 	u7, err2 := uuid.NewV7()
@@ -168,27 +431,93 @@ func generateUniqueFilename() (string, error) {
 	return u7.String(), nil
 }
 
-func getJPEGFiles(dir string) ([]string, error) {
-	var files []string
+// stagingDir is where uploads are written and hashed before they are known
+// to be new content, outside the data root so snapshots never see them.
+func (h *UploadHandler) stagingDir() string {
+	return filepath.Join(h.UploadDir, ".staging")
+}
 
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
+// userAssetsDir is where the originals of user are stored.
+func userAssetsDir(user string) string {
+	return config.GetUserPath(user, "assets")
+}
 
-		if !info.IsDir() {
-			ext := strings.ToLower(filepath.Ext(path))
-			if ext == ".jpg" || ext == ".jpeg" {
-				// Return relative path
-				rel, err := filepath.Rel(dir, path)
-				if err == nil {
-					files = append(files, rel)
-				}
-			}
-		}
+// userThumbnailsDir is where the thumbnails of user's originals are stored.
+func userThumbnailsDir(user string) string {
+	return filepath.Join(userAssetsDir(user), "thumbnails")
+}
 
-		return nil
-	})
+// originalURL is where the original stored at path is downloaded from,
+// under the root the download handler serves originals from.
+func originalURL(path string) string {
+	return downloadURL(originalRoute, path)
+}
+
+// thumbnailURL is where the thumbnail stored at path is downloaded from.
+func thumbnailURL(path string) string {
+	return downloadURL(thumbnailRoute, path)
+}
+
+func downloadURL(route string, path string) string {
+	rel, err := filepath.Rel(config.GetRootDir(), path)
+	if err != nil {
+		return ""
+	}
+	return route + filepath.ToSlash(rel)
+}
+
+// ownedBy reports whether the file at path, relative to the data root as
+// download routes take it, lies in the assets directory of user.
+func ownedBy(user string, path string) bool {
+	dir, err := filepath.Rel(config.GetRootDir(), userAssetsDir(user))
+	if err != nil {
+		return false
+	}
+	path = strings.TrimPrefix(filepath.Clean("/"+path), "/")
+	return strings.HasPrefix(path, dir+"/")
+}
+
+// removeOriginal deletes an original that is not to be kept.
+func removeOriginal(path string) {
+	defer snapshot.BeginWrite()()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to remove %s: %v", path, err)
+	}
+}
+
+// moveFile renames src to dst, copying it where they are on different
+// file systems.
+func moveFile(src string, dst string) error {
+	err := os.Rename(src, dst)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
 
-	return files, err
+// imageExtensions are the extensions originals are stored under.
+var imageExtensions = map[string]bool{
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true,
+	".webp": true, ".heic": true, ".avif": true, ".tif": true,
 }
@@ -0,0 +1,168 @@
+// Package auth verifies the signed bearer tokens requests are made with and
+// tells handlers which user a request is made by. Tokens are issued by
+// whatever logs users in, sharing the signing key, or by cmd/token.
+package auth
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	keySize = 32
+
+	userKey  = "auth.user" // gin context keys set by Authenticate
+	adminKey = "auth.admin"
+)
+
+// userIDPattern is what user IDs look like; they name directories.
+var userIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+var (
+	ErrNoToken      = errors.New("no bearer token given")
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+	ErrNotAdmin     = errors.New("admin token required")
+)
+
+// Claims is what a token asserts about its bearer.
+type Claims struct {
+	User      string `json:"sub"`
+	Admin     bool   `json:"admin,omitempty"`
+	ExpiresAt int64  `json:"exp"` // Unix seconds
+}
+
+// Signer issues and verifies tokens. A token is the base64url JSON of its
+// Claims and the HMAC-SHA256 of that, joined by a dot.
+type Signer struct {
+	key []byte
+	now func() time.Time
+}
+
+// NewSigner returns a Signer using key, which should be 32 random bytes.
+func NewSigner(key []byte) *Signer {
+	return &Signer{key: key, now: time.Now}
+}
+
+// LoadSigner reads the hex signing key at path, creating a random one when
+// the file does not exist yet.
+func LoadSigner(path string) (*Signer, error) {
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, keySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(key)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		return NewSigner(key), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || len(key) != keySize {
+		return nil, fmt.Errorf("%s does not hold a %d byte hex key", path, keySize)
+	}
+	return NewSigner(key), nil
+}
+
+// Issue returns a token for user, valid for ttl.
+func (s *Signer) Issue(user string, admin bool, ttl time.Duration) (string, error) {
+	if !userIDPattern.MatchString(user) {
+		return "", fmt.Errorf("invalid user ID %q", user)
+	}
+	payload, err := json.Marshal(Claims{User: user, Admin: admin, ExpiresAt: s.now().Add(ttl).Unix()})
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.sign(encoded)), nil
+}
+
+// Verify checks the signature and expiry of token and returns its claims.
+func (s *Signer) Verify(token string) (Claims, error) {
+	var claims Claims
+	encoded, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return claims, ErrInvalidToken
+	}
+	got, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(got, s.sign(encoded)) {
+		return claims, ErrInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return claims, ErrInvalidToken
+	}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&claims); err != nil || !userIDPattern.MatchString(claims.User) {
+		return Claims{}, ErrInvalidToken
+	}
+	if !s.now().Before(time.Unix(claims.ExpiresAt, 0)) {
+		return Claims{}, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+func (s *Signer) sign(encoded string) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(encoded))
+	return mac.Sum(nil)
+}
+
+// Authenticate is middleware that admits requests carrying a valid
+// "Authorization: Bearer <token>" header and answers 401 to the others.
+func (s *Signer) Authenticate(c *gin.Context) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": ErrNoToken.Error()})
+		return
+	}
+	claims, err := s.Verify(token)
+	if err != nil {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	c.Set(userKey, claims.User)
+	c.Set(adminKey, claims.Admin)
+	c.Next()
+}
+
+// RequireAdmin is middleware, placed after Authenticate, that answers 403
+// to requests whose token does not grant admin rights.
+func RequireAdmin(c *gin.Context) {
+	if !c.GetBool(adminKey) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": ErrNotAdmin.Error()})
+		return
+	}
+	c.Next()
+}
+
+// User returns the user Authenticate found the request to be made by.
+func User(c *gin.Context) (string, bool) {
+	user := c.GetString(userKey)
+	return user, user != ""
+}
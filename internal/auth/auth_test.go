@@ -0,0 +1,139 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func testSigner(now time.Time) *Signer {
+	s := NewSigner([]byte("0123456789abcdef0123456789abcdef"))
+	s.now = func() time.Time { return now }
+	return s
+}
+
+func TestIssueVerify(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	s := testSigner(now)
+
+	token, err := s.Issue("alice", true, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := s.Verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.User != "alice" || !claims.Admin {
+		t.Fatalf("claims = %+v", claims)
+	}
+
+	s.now = func() time.Time { return now.Add(time.Hour) }
+	if _, err := s.Verify(token); !errors.Is(err, ErrTokenExpired) {
+		t.Fatalf("expired token: err = %v", err)
+	}
+}
+
+func TestVerifyRejectsForgeries(t *testing.T) {
+	s := testSigner(time.Now())
+	token, err := s.Issue("alice", false, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, sig, _ := strings.Cut(token, ".")
+	other := NewSigner([]byte("fedcba9876543210fedcba9876543210"))
+	forged, _ := other.Issue("alice", true, time.Hour)
+
+	for name, bad := range map[string]string{
+		"empty":          "",
+		"no signature":   payload,
+		"bad signature":  payload + "." + sig[:len(sig)-2] + "AA",
+		"other key":      forged,
+		"swapped claims": strings.SplitN(forged, ".", 2)[0] + "." + sig,
+	} {
+		if _, err := s.Verify(bad); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("%s: err = %v, want ErrInvalidToken", name, err)
+		}
+	}
+}
+
+func TestIssueRejectsBadUser(t *testing.T) {
+	s := testSigner(time.Now())
+	for _, user := range []string{"", "../alice", "a/b", strings.Repeat("x", 65)} {
+		if _, err := s.Issue(user, false, time.Hour); err == nil {
+			t.Errorf("Issue(%q) succeeded", user)
+		}
+	}
+}
+
+func TestLoadSignerCreatesKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys", "token.key")
+	first, err := LoadSigner(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("key file mode = %v", fi.Mode().Perm())
+	}
+
+	token, _ := first.Issue("alice", false, time.Hour)
+	second, err := LoadSigner(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := second.Verify(token); err != nil {
+		t.Fatalf("reloaded key does not verify: %v", err)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := testSigner(time.Now())
+	r := gin.New()
+	r.GET("/me", s.Authenticate, func(c *gin.Context) {
+		user, _ := User(c)
+		c.String(http.StatusOK, user)
+	})
+	r.GET("/admin", s.Authenticate, RequireAdmin, func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	userToken, _ := s.Issue("alice", false, time.Hour)
+	adminToken, _ := s.Issue("ops", true, time.Hour)
+	tests := []struct {
+		path   string
+		header string
+		status int
+		body   string
+	}{
+		{"/me", "", http.StatusUnauthorized, ""},
+		{"/me", "Bearer nonsense", http.StatusUnauthorized, ""},
+		{"/me", "Basic " + userToken, http.StatusUnauthorized, ""},
+		{"/me", "Bearer " + userToken, http.StatusOK, "alice"},
+		{"/admin", "Bearer " + userToken, http.StatusForbidden, ""},
+		{"/admin", "Bearer " + adminToken, http.StatusNoContent, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Header.Set("X-User-ID", "mallory")
+		if tt.header != "" {
+			req.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status || (tt.body != "" && w.Body.String() != tt.body) {
+			t.Errorf("%s with %q: %d %q, want %d %q", tt.path, tt.header, w.Code, w.Body.String(), tt.status, tt.body)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package collection_manager_v3
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"time"
+)
+
+// Interval is the bucket width of a CreatedAt histogram.
+type Interval string
+
+const (
+	IntervalDay   Interval = "day"
+	IntervalMonth Interval = "month"
+)
+
+var ErrUnknownInterval = errors.New("unknown histogram interval")
+
+// NumericStats summarises the values a Stats value function reported.
+type NumericStats struct {
+	Count int     `json:"count"`
+	Sum   float64 `json:"sum"`
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Mean  float64 `json:"mean"`
+}
+
+// TimeStats holds the earliest and latest CreatedAt and UpdatedAt seen.
+type TimeStats struct {
+	Count          int       `json:"count"`
+	FirstCreatedAt time.Time `json:"firstCreatedAt"`
+	LastCreatedAt  time.Time `json:"lastCreatedAt"`
+	FirstUpdatedAt time.Time `json:"firstUpdatedAt"`
+	LastUpdatedAt  time.Time `json:"lastUpdatedAt"`
+}
+
+// Bucket is one histogram bar, starting at Start in UTC.
+type Bucket struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+// Count returns how many items match filterFunc; nil matches everything.
+func (manager *Manager[T]) Count(filterFunc func(T) bool) int {
+	if filterFunc == nil {
+		return len(manager.values())
+	}
+	count := 0
+	for _, item := range manager.values() {
+		if filterFunc(item) {
+			count++
+		}
+	}
+	return count
+}
+
+// GroupBy partitions the items matching filterFunc by keyFunc.
+func (manager *Manager[T]) GroupBy(filterFunc func(T) bool, keyFunc func(T) string) map[string][]T {
+	groups := map[string][]T{}
+	for _, item := range manager.values() {
+		if filterFunc == nil || filterFunc(item) {
+			key := keyFunc(item)
+			groups[key] = append(groups[key], item)
+		}
+	}
+	return groups
+}
+
+// CountBy is GroupBy without keeping the items.
+func (manager *Manager[T]) CountBy(filterFunc func(T) bool, keyFunc func(T) string) map[string]int {
+	counts := map[string]int{}
+	for _, item := range manager.values() {
+		if filterFunc == nil || filterFunc(item) {
+			counts[keyFunc(item)]++
+		}
+	}
+	return counts
+}
+
+// Stats aggregates valueFunc over the items matching filterFunc. Items for
+// which valueFunc reports false are left out.
+func (manager *Manager[T]) Stats(filterFunc func(T) bool, valueFunc func(T) (float64, bool)) NumericStats {
+	stats := NumericStats{Min: math.Inf(1), Max: math.Inf(-1)}
+	for _, item := range manager.values() {
+		if filterFunc != nil && !filterFunc(item) {
+			continue
+		}
+		v, ok := valueFunc(item)
+		if !ok {
+			continue
+		}
+		stats.Count++
+		stats.Sum += v
+		stats.Min = math.Min(stats.Min, v)
+		stats.Max = math.Max(stats.Max, v)
+	}
+	if stats.Count == 0 {
+		return NumericStats{}
+	}
+	stats.Mean = stats.Sum / float64(stats.Count)
+	return stats
+}
+
+// TimeStats reports the CreatedAt and UpdatedAt range of the items matching
+// filterFunc.
+func (manager *Manager[T]) TimeStats(filterFunc func(T) bool) TimeStats {
+	var stats TimeStats
+	for _, item := range manager.values() {
+		if filterFunc != nil && !filterFunc(item) {
+			continue
+		}
+		created, updated := item.GetCreatedAt(), item.GetUpdatedAt()
+		if stats.Count == 0 {
+			stats.FirstCreatedAt, stats.LastCreatedAt = created, created
+			stats.FirstUpdatedAt, stats.LastUpdatedAt = updated, updated
+		}
+		stats.Count++
+		if created.Before(stats.FirstCreatedAt) {
+			stats.FirstCreatedAt = created
+		}
+		if created.After(stats.LastCreatedAt) {
+			stats.LastCreatedAt = created
+		}
+		if updated.Before(stats.FirstUpdatedAt) {
+			stats.FirstUpdatedAt = updated
+		}
+		if updated.After(stats.LastUpdatedAt) {
+			stats.LastUpdatedAt = updated
+		}
+	}
+	return stats
+}
+
+// CreatedHistogram counts the items matching filterFunc per day or month of
+// CreatedAt, in UTC. Empty buckets are omitted; the result is in time order.
+func (manager *Manager[T]) CreatedHistogram(filterFunc func(T) bool, interval Interval) ([]Bucket, error) {
+	var truncate func(time.Time) time.Time
+	switch interval {
+	case IntervalDay:
+		truncate = func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		}
+	case IntervalMonth:
+		truncate = func(t time.Time) time.Time {
+			return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+		}
+	default:
+		return nil, ErrUnknownInterval
+	}
+
+	counts := map[time.Time]int{}
+	for _, item := range manager.values() {
+		if filterFunc == nil || filterFunc(item) {
+			counts[truncate(item.GetCreatedAt().UTC())]++
+		}
+	}
+
+	buckets := make([]Bucket, 0, len(counts))
+	for start, count := range counts {
+		buckets = append(buckets, Bucket{Start: start, Count: count})
+	}
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Start.Before(buckets[j].Start)
+	})
+	return buckets, nil
+}
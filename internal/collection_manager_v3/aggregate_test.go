@@ -0,0 +1,168 @@
+package collection_manager_v3
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newAggregateManager creates notes of the given sizes, one per hour from
+// testEpoch, each owned by owners[i] when that is not empty.
+func newAggregateManager(t *testing.T, sizes []int, owners []string) *Manager[*note] {
+	t.Helper()
+	manager, _, clock := newTestManager(t)
+	for i, size := range sizes {
+		n := &note{Title: "n", Size: size}
+		if owners[i] != "" {
+			n.Owner = &owners[i]
+		}
+		if _, err := manager.Create(n); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Hour)
+	}
+	return manager
+}
+
+func ownerOf(n *note) string {
+	if n.Owner == nil {
+		return ""
+	}
+	return *n.Owner
+}
+
+func TestCountAndGroupBy(t *testing.T) {
+	manager := newAggregateManager(t, []int{1, 2, 3, 4}, []string{"ann", "bob", "ann", ""})
+	large := func(n *note) bool { return n.Size > 1 }
+
+	tests := []struct {
+		name   string
+		filter func(*note) bool
+		count  int
+		groups map[string]int
+	}{
+		{"all", nil, 4, map[string]int{"ann": 2, "bob": 1, "": 1}},
+		{"filtered", large, 3, map[string]int{"ann": 1, "bob": 1, "": 1}},
+		{"none", func(*note) bool { return false }, 0, map[string]int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := manager.Count(tt.filter); got != tt.count {
+				t.Errorf("Count = %d, want %d", got, tt.count)
+			}
+			if got := manager.CountBy(tt.filter, ownerOf); !reflect.DeepEqual(got, tt.groups) {
+				t.Errorf("CountBy = %v, want %v", got, tt.groups)
+			}
+			groups := manager.GroupBy(tt.filter, ownerOf)
+			if len(groups) != len(tt.groups) {
+				t.Fatalf("GroupBy has %d groups, want %d", len(groups), len(tt.groups))
+			}
+			for key, items := range groups {
+				if len(items) != tt.groups[key] {
+					t.Errorf("group %q has %d items, want %d", key, len(items), tt.groups[key])
+				}
+				for _, item := range items {
+					if ownerOf(item) != key {
+						t.Errorf("group %q holds an item of %q", key, ownerOf(item))
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	manager := newAggregateManager(t, []int{4, -2, 10, 0}, []string{"ann", "ann", "bob", ""})
+	size := func(n *note) (float64, bool) { return float64(n.Size), true }
+	owned := func(n *note) (float64, bool) { return float64(n.Size), n.Owner != nil }
+
+	tests := []struct {
+		name   string
+		filter func(*note) bool
+		value  func(*note) (float64, bool)
+		want   NumericStats
+	}{
+		{"all", nil, size, NumericStats{Count: 4, Sum: 12, Min: -2, Max: 10, Mean: 3}},
+		{"skipped values", nil, owned, NumericStats{Count: 3, Sum: 12, Min: -2, Max: 10, Mean: 4}},
+		{"filtered", func(n *note) bool { return ownerOf(n) == "ann" }, size, NumericStats{Count: 2, Sum: 2, Min: -2, Max: 4, Mean: 1}},
+		{"empty", func(*note) bool { return false }, size, NumericStats{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := manager.Stats(tt.filter, tt.value); got != tt.want {
+				t.Errorf("Stats = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTimeStats(t *testing.T) {
+	manager := newAggregateManager(t, []int{1, 2, 3}, []string{"", "", ""})
+	first := testEpoch
+	last := testEpoch.Add(2 * time.Hour)
+
+	got := manager.TimeStats(nil)
+	want := TimeStats{Count: 3, FirstCreatedAt: first, LastCreatedAt: last, FirstUpdatedAt: first, LastUpdatedAt: last}
+	if !got.FirstCreatedAt.Equal(want.FirstCreatedAt) || !got.LastCreatedAt.Equal(want.LastCreatedAt) ||
+		!got.FirstUpdatedAt.Equal(want.FirstUpdatedAt) || !got.LastUpdatedAt.Equal(want.LastUpdatedAt) || got.Count != want.Count {
+		t.Fatalf("TimeStats = %+v, want %+v", got, want)
+	}
+	if empty := manager.TimeStats(func(*note) bool { return false }); empty.Count != 0 || !empty.FirstCreatedAt.IsZero() {
+		t.Fatalf("TimeStats of nothing = %+v", empty)
+	}
+}
+
+func TestCreatedHistogram(t *testing.T) {
+	manager, _, clock := newTestManager(t)
+	newYork := time.FixedZone("EST", -5*60*60)
+	created := []time.Time{
+		time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2025, 1, 1, 23, 59, 0, 0, time.UTC),
+		time.Date(2025, 1, 3, 12, 0, 0, 0, time.UTC),
+		// 2025-02-01 03:30 in UTC, so it counts towards February.
+		time.Date(2025, 1, 31, 22, 30, 0, 0, newYork),
+		time.Date(2025, 3, 15, 0, 0, 0, 0, time.UTC),
+	}
+	// Created out of order, as the result must be sorted regardless.
+	for _, i := range []int{4, 0, 3, 2, 1} {
+		clock.Set(created[i])
+		if _, err := manager.Create(&note{Title: "n", Size: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	day := func(m time.Month, d int) time.Time { return time.Date(2025, m, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		name     string
+		filter   func(*note) bool
+		interval Interval
+		want     []Bucket
+	}{
+		{"days", nil, IntervalDay, []Bucket{
+			{day(1, 1), 2}, {day(1, 3), 1}, {day(2, 1), 1}, {day(3, 15), 1},
+		}},
+		{"months", nil, IntervalMonth, []Bucket{
+			{day(1, 1), 3}, {day(2, 1), 1}, {day(3, 1), 1},
+		}},
+		{"filtered", func(n *note) bool { return n.Size >= 3 }, IntervalMonth, []Bucket{
+			{day(2, 1), 1}, {day(3, 1), 1},
+		}},
+		{"empty", func(*note) bool { return false }, IntervalDay, []Bucket{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := manager.CreatedHistogram(tt.filter, tt.interval)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CreatedHistogram = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := manager.CreatedHistogram(nil, "week"); !errors.Is(err, ErrUnknownInterval) {
+		t.Fatalf("err = %v, want ErrUnknownInterval", err)
+	}
+}
@@ -0,0 +1,361 @@
+package collection_manager_v3
+
+import (
+	"errors"
+	"fmt"
+)
+
+// BatchResult is the outcome for one entry of a bulk operation, reported in
+// the same position as the entry it belongs to.
+type BatchResult[T CollectionItem] struct {
+	ID   string
+	Item T
+	Err  error
+}
+
+// batchError joins the per-item errors of a bulk operation, or returns nil
+// when every item succeeded.
+func batchError[T CollectionItem](results []BatchResult[T]) error {
+	var errs []error
+	for _, r := range results {
+		if r.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.ID, r.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// fillErrs returns a slice of n copies of err.
+func fillErrs(n int, err error) []error {
+	errs := make([]error, n)
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+func (s *singleFileStorage[T]) CreateItems(newItems []T) []error {
+	items, err := s.ReadAll(false)
+	if err != nil {
+		return fillErrs(len(newItems), err)
+	}
+	items = append(items, newItems...)
+	return fillErrs(len(newItems), s.write(items))
+}
+
+func (s *singleFileStorage[T]) UpdateItems(updatedItems []T) []error {
+	errs := make([]error, len(updatedItems))
+	items, err := s.ReadAll(false)
+	if err != nil {
+		return fillErrs(len(updatedItems), err)
+	}
+
+	index := make(map[string]int, len(items))
+	for i, item := range items {
+		index[item.GetID()] = i
+	}
+
+	changed := false
+	for i, updatedItem := range updatedItems {
+		pos, ok := index[updatedItem.GetID()]
+		if !ok {
+			errs[i] = fmt.Errorf("%w: %s", ErrItemNotFound, updatedItem.GetID())
+			continue
+		}
+		items[pos] = updatedItem
+		changed = true
+	}
+	if !changed {
+		return errs
+	}
+
+	if err := s.write(items); err != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+	return errs
+}
+
+func (s *singleFileStorage[T]) DeleteItems(ids []string) []error {
+	items, err := s.ReadAll(false)
+	if err != nil {
+		return fillErrs(len(ids), err)
+	}
+
+	remove := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		remove[id] = true
+	}
+
+	found := make(map[string]bool, len(ids))
+	var newItems []T
+	for _, item := range items {
+		if remove[item.GetID()] {
+			found[item.GetID()] = true
+			continue
+		}
+		newItems = append(newItems, item)
+	}
+
+	var writeErr error
+	if len(found) > 0 {
+		writeErr = s.write(newItems)
+	}
+	errs := make([]error, len(ids))
+	for i, id := range ids {
+		if !found[id] {
+			errs[i] = fmt.Errorf("%w: %s", ErrItemNotFound, id)
+		} else {
+			errs[i] = writeErr
+		}
+	}
+	return errs
+}
+
+func (d *directoryStorage[T]) CreateItems(items []T) []error {
+	errs := make([]error, len(items))
+	for i, item := range items {
+		errs[i] = d.CreateItem(item)
+	}
+	return errs
+}
+
+func (d *directoryStorage[T]) UpdateItems(items []T) []error {
+	errs := make([]error, len(items))
+	for i, item := range items {
+		errs[i] = d.UpdateItem(item)
+	}
+	return errs
+}
+
+func (d *directoryStorage[T]) DeleteItems(ids []string) []error {
+	errs := make([]error, len(ids))
+	for i, id := range ids {
+		errs[i] = d.DeleteItem(id)
+	}
+	return errs
+}
+
+func (m *MemoryStorage[T]) CreateItems(items []T) []error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.beginWrite(); err != nil {
+		return fillErrs(len(items), err)
+	}
+	errs := make([]error, len(items))
+	for i, item := range items {
+		errs[i] = m.put(item)
+	}
+	return errs
+}
+
+func (m *MemoryStorage[T]) UpdateItems(items []T) []error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.beginWrite(); err != nil {
+		return fillErrs(len(items), err)
+	}
+	errs := make([]error, len(items))
+	for i, item := range items {
+		if _, ok := m.data[item.GetID()]; !ok {
+			errs[i] = fmt.Errorf("%w: %s", ErrItemNotFound, item.GetID())
+			continue
+		}
+		errs[i] = m.put(item)
+	}
+	return errs
+}
+
+func (m *MemoryStorage[T]) DeleteItems(ids []string) []error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.beginWrite(); err != nil {
+		return fillErrs(len(ids), err)
+	}
+	errs := make([]error, len(ids))
+	for i, id := range ids {
+		errs[i] = m.remove(id)
+	}
+	return errs
+}
+
+// CreateMany assigns IDs and timestamps to newItems and persists them with a
+// single storage write where the backend allows it. Items that fail ID
+// generation or collide with an existing ID are skipped and reported; the
+// returned error joins every per-item failure.
+func (manager *Manager[T]) CreateMany(newItems []T) ([]BatchResult[T], error) {
+	return manager.createMany(newItems, false)
+}
+
+// CreateManyWithID is the bulk form of CreateWithID.
+func (manager *Manager[T]) CreateManyWithID(newItems []T) ([]BatchResult[T], error) {
+	return manager.createMany(newItems, true)
+}
+
+func (manager *Manager[T]) createMany(newItems []T, keepIDs bool) ([]BatchResult[T], error) {
+	results := make([]BatchResult[T], len(newItems))
+	seen := make(map[string]bool, len(newItems))
+	var pending []T
+	var pendingPos []int
+
+	now := manager.clock.Now()
+	for i, newItem := range newItems {
+		results[i].Item = newItem
+
+		id := newItem.GetID()
+		if !keepIDs {
+			var err error
+			if id, err = manager.newID(newItem); err != nil {
+				results[i].Err = fmt.Errorf("error generating ID: %w", err)
+				continue
+			}
+		}
+		results[i].ID = id
+		if err := checkID(id); err != nil {
+			results[i].Err = err
+			continue
+		}
+		if seen[id] || manager.exists(id) {
+			results[i].Err = ErrDuplicateID
+			continue
+		}
+		seen[id] = true
+
+		newItem.SetID(id)
+		if !keepIDs || newItem.GetCreatedAt().IsZero() {
+			newItem.SetCreatedAt(now)
+		}
+		if !keepIDs || newItem.GetUpdatedAt().IsZero() {
+			newItem.SetUpdatedAt(newItem.GetCreatedAt())
+		}
+		pending = append(pending, newItem)
+		pendingPos = append(pendingPos, i)
+	}
+
+	if len(pending) > 0 {
+		endWrite := manager.beginWrite()
+		errs := manager.storage.CreateItems(pending)
+		endWrite()
+		for k, pos := range pendingPos {
+			if errs[k] != nil {
+				results[pos].Err = errs[k]
+				continue
+			}
+			manager.items.Register(pending[k].GetID(), pending[k])
+			manager.emit(ChangeCreate, pending[k].GetID(), pending[k])
+		}
+	}
+
+	return results, batchError(results)
+}
+
+// UpdateMany stamps UpdatedAt on every item and persists them with a single
+// storage write where the backend allows it. An ID that appears more than
+// once is updated from its first entry; the later ones fail with
+// ErrDuplicateID.
+func (manager *Manager[T]) UpdateMany(updatedItems []T) ([]BatchResult[T], error) {
+	results := make([]BatchResult[T], len(updatedItems))
+	if len(updatedItems) == 0 {
+		return results, nil
+	}
+
+	seen := make(map[string]bool, len(updatedItems))
+	var pending []T
+	var pendingPos []int
+
+	now := manager.clock.Now()
+	for i, updatedItem := range updatedItems {
+		id := updatedItem.GetID()
+		results[i] = BatchResult[T]{ID: id, Item: updatedItem}
+		if seen[id] {
+			results[i].Err = ErrDuplicateID
+			continue
+		}
+		seen[id] = true
+		updatedItem.SetUpdatedAt(now)
+		pending = append(pending, updatedItem)
+		pendingPos = append(pendingPos, i)
+	}
+
+	endWrite := manager.beginWrite()
+	errs := manager.storage.UpdateItems(pending)
+	endWrite()
+	for k, pos := range pendingPos {
+		if errs[k] != nil {
+			results[pos].Err = errs[k]
+			continue
+		}
+		manager.items.Update(pending[k].GetID(), pending[k])
+		manager.emit(ChangeUpdate, pending[k].GetID(), pending[k])
+	}
+
+	return results, batchError(results)
+}
+
+// DeleteMany removes the items with the given IDs with a single storage
+// write where the backend allows it. Each result carries the deleted item
+// when it was known to the manager. Repeats of an ID fail with
+// ErrDuplicateID.
+func (manager *Manager[T]) DeleteMany(ids []string) ([]BatchResult[T], error) {
+	return manager.deleteMany(ids, ChangeDelete)
+}
+
+func (manager *Manager[T]) deleteMany(ids []string, op ChangeOp) ([]BatchResult[T], error) {
+	results := make([]BatchResult[T], len(ids))
+	if len(ids) == 0 {
+		return results, nil
+	}
+
+	pos := make(map[string]int, len(ids))
+	var unique []string
+	for i, id := range ids {
+		results[i].ID = id
+		if _, seen := pos[id]; seen {
+			results[i].Err = ErrDuplicateID
+			continue
+		}
+		results[i].Item, _ = manager.items.Get(id)
+		pos[id] = i
+		unique = append(unique, id)
+	}
+
+	allowed, refused := manager.beforeDelete(unique)
+	for id, err := range refused {
+		results[pos[id]].Err = err
+	}
+
+	var deleted []string
+	if len(allowed) > 0 {
+		endWrite := manager.beginWrite()
+		errs := manager.storage.DeleteItems(allowed)
+		endWrite()
+		for k, id := range allowed {
+			i := pos[id]
+			if errs[k] != nil {
+				results[i].Err = errs[k]
+				continue
+			}
+			manager.items.Delete(id)
+			manager.emit(op, id, results[i].Item)
+			deleted = append(deleted, id)
+		}
+	}
+
+	return results, errors.Join(batchError(results), manager.afterDelete(deleted))
+}
+
+// GetMany looks up each ID, reporting the ones that do not exist.
+func (manager *Manager[T]) GetMany(ids []string) ([]BatchResult[T], error) {
+	results := make([]BatchResult[T], len(ids))
+	for i, id := range ids {
+		item, err := manager.lookup(id)
+		results[i] = BatchResult[T]{ID: id, Item: item, Err: err}
+	}
+	return results, batchError(results)
+}
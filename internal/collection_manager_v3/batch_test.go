@@ -0,0 +1,195 @@
+package collection_manager_v3
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+var errDiskFull = errors.New("disk full")
+
+func seedNotes(t *testing.T, manager *Manager[*note], titles ...string) []*note {
+	t.Helper()
+	var items []*note
+	for _, title := range titles {
+		items = append(items, &note{Title: title})
+	}
+	results, err := manager.CreateMany(items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := make([]*note, len(results))
+	for i, r := range results {
+		created[i] = r.Item
+	}
+	return created
+}
+
+func TestCreateMany(t *testing.T) {
+	manager, store, _ := newTestManager(t)
+	existing := seedNotes(t, manager, "existing")[0]
+
+	results, err := manager.CreateManyWithID([]*note{
+		{ID: "a", Title: "first"},
+		{ID: "a", Title: "repeat"},
+		{ID: existing.ID, Title: "taken"},
+		{ID: "b", Title: "second"},
+	})
+	if err == nil {
+		t.Fatal("CreateManyWithID reported no error")
+	}
+	want := []error{nil, ErrDuplicateID, ErrDuplicateID, nil}
+	for i, r := range results {
+		if !errors.Is(r.Err, want[i]) {
+			t.Errorf("result %d (%s): err = %v, want %v", i, r.ID, r.Err, want[i])
+		}
+	}
+	if got, _ := manager.Get("a"); got == nil || got.Title != "first" {
+		t.Fatalf("a = %+v, want the first entry", got)
+	}
+	if got, _ := manager.Get(existing.ID); got.Title != "existing" {
+		t.Fatalf("existing item overwritten: %+v", got)
+	}
+	if store.Len() != 3 {
+		t.Fatalf("stored %d items, want 3", store.Len())
+	}
+}
+
+func TestCreateManyRollsBackOnWriteFailure(t *testing.T) {
+	manager, store, _ := newTestManager(t)
+	var events []ChangeEvent[*note]
+	manager.OnChange(func(e ChangeEvent[*note]) { events = append(events, e) })
+
+	store.FailNextWrite(errDiskFull)
+	results, err := manager.CreateMany([]*note{{Title: "a"}, {Title: "b"}})
+	if !errors.Is(err, errDiskFull) {
+		t.Fatalf("err = %v, want the write error", err)
+	}
+	for _, r := range results {
+		if !errors.Is(r.Err, errDiskFull) {
+			t.Errorf("%s: err = %v", r.ID, r.Err)
+		}
+		if _, err := manager.Get(r.ID); err == nil {
+			t.Errorf("%s registered after a failed write", r.ID)
+		}
+	}
+	if all, _ := manager.GetAll(); len(all) != 0 {
+		t.Fatalf("registry holds %d items", len(all))
+	}
+	if len(events) != 0 {
+		t.Fatalf("emitted %d events for a failed write", len(events))
+	}
+}
+
+func TestUpdateMany(t *testing.T) {
+	manager, _, clock := newTestManager(t)
+	seeded := seedNotes(t, manager, "a", "b")
+	clock.Advance(time.Minute)
+
+	first, second := *seeded[0], *seeded[1]
+	first.Title, second.Title = "a2", "b2"
+	repeat := first
+	repeat.Title = "a3"
+	results, err := manager.UpdateMany([]*note{&first, {ID: "missing"}, &repeat, &second})
+	if err == nil {
+		t.Fatal("UpdateMany reported no error")
+	}
+	want := []error{nil, ErrItemNotFound, ErrDuplicateID, nil}
+	for i, r := range results {
+		if !errors.Is(r.Err, want[i]) {
+			t.Errorf("result %d (%s): err = %v, want %v", i, r.ID, r.Err, want[i])
+		}
+	}
+
+	for id, title := range map[string]string{first.ID: "a2", second.ID: "b2"} {
+		got, err := manager.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Title != title || !got.UpdatedAt.Equal(clock.Now()) {
+			t.Errorf("%s = %q updated %v, want %q at %v", id, got.Title, got.UpdatedAt, title, clock.Now())
+		}
+	}
+}
+
+func TestUpdateManyRollsBackOnWriteFailure(t *testing.T) {
+	manager, store, _ := newTestManager(t)
+	seeded := seedNotes(t, manager, "a")
+
+	changed := *seeded[0]
+	changed.Title = "changed"
+	store.FailNextWrite(errDiskFull)
+	if _, err := manager.UpdateMany([]*note{&changed}); !errors.Is(err, errDiskFull) {
+		t.Fatalf("err = %v, want the write error", err)
+	}
+	got, err := manager.Get(changed.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "a" {
+		t.Fatalf("registry holds %q after a failed write", got.Title)
+	}
+}
+
+func TestDeleteMany(t *testing.T) {
+	manager, store, _ := newTestManager(t)
+	seeded := seedNotes(t, manager, "a", "b", "c")
+	a, b := seeded[0].ID, seeded[1].ID
+
+	results, err := manager.DeleteMany([]string{a, "missing", a, b})
+	if err == nil {
+		t.Fatal("DeleteMany reported no error")
+	}
+	want := []error{nil, ErrItemNotFound, ErrDuplicateID, nil}
+	for i, r := range results {
+		if !errors.Is(r.Err, want[i]) {
+			t.Errorf("result %d (%s): err = %v, want %v", i, r.ID, r.Err, want[i])
+		}
+	}
+	if results[0].Item == nil || results[0].Item.Title != "a" {
+		t.Fatalf("result 0 carries %+v, want the deleted item", results[0].Item)
+	}
+	for _, id := range []string{a, b} {
+		if _, err := manager.Get(id); err == nil {
+			t.Errorf("%s still present", id)
+		}
+	}
+	if store.Len() != 1 {
+		t.Fatalf("stored %d items, want 1", store.Len())
+	}
+}
+
+func TestDeleteManyRollsBackOnWriteFailure(t *testing.T) {
+	manager, store, _ := newTestManager(t)
+	seeded := seedNotes(t, manager, "a", "b")
+
+	store.FailNextWrite(errDiskFull)
+	if _, err := manager.DeleteMany([]string{seeded[0].ID, seeded[1].ID}); !errors.Is(err, errDiskFull) {
+		t.Fatalf("err = %v, want the write error", err)
+	}
+	for _, item := range seeded {
+		if _, err := manager.Get(item.ID); err != nil {
+			t.Errorf("%s dropped from the registry after a failed write: %v", item.ID, err)
+		}
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	manager, _, _ := newTestManager(t)
+	seeded := seedNotes(t, manager, "a")
+	id := seeded[0].ID
+
+	results, err := manager.GetMany([]string{id, "missing", id})
+	if err == nil {
+		t.Fatal("GetMany reported no error")
+	}
+	if results[0].Err != nil || results[2].Err != nil {
+		t.Fatalf("repeated ID failed: %v, %v", results[0].Err, results[2].Err)
+	}
+	if results[0].Item.Title != "a" || results[2].Item.Title != "a" {
+		t.Fatalf("items = %+v, %+v", results[0].Item, results[2].Item)
+	}
+	if results[1].Err == nil {
+		t.Fatal("missing ID found")
+	}
+}
@@ -0,0 +1,404 @@
+package collection_manager_v3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/mahdi-cpp/api-go-settings/internal/utils"
+)
+
+const (
+	checksumFile   = ".checksums" // inside a directory collection
+	checksumSuffix = ".sum"       // next to a single-file collection
+	deletedSum     = "-"
+
+	// sealedFileEntry is the ID the checksum of a sealed single-file
+	// collection is logged under. No item ID can contain a slash.
+	sealedFileEntry = "/file"
+)
+
+// contentSum is the SHA-256 of the compact form of raw JSON, so it does not
+// depend on the indentation the item was written with.
+func contentSum(raw []byte) (string, error) {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, raw); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(compact.Bytes())
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func itemSum(item any) (string, error) {
+	raw, err := json.Marshal(item)
+	if err != nil {
+		return "", err
+	}
+	return contentSum(raw)
+}
+
+// storedSum is the checksum of a file as read from disk. Sealed files are
+// summed as they are stored, so the log says nothing about their contents;
+// plain ones by their JSON content.
+func storedSum(stored []byte) (string, error) {
+	if isSealed(stored) {
+		sum := sha256.Sum256(stored)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	return contentSum(stored)
+}
+
+func corrupted(path string, id string, reason string) error {
+	return fmt.Errorf("%w: %s: item %s: %s", utils.ErrMetadataCorrupted, path, id, reason)
+}
+
+// checksumLog is the sidecar manifest holding the checksum of every item of
+// a collection. It is an append-only file of "<id> <sha256>" lines, the last
+// line for an ID winning and "-" marking a delete, compacted once stale
+// lines outnumber live ones. Items written before the log existed are
+// untracked and pass unchecked until they are written again.
+//
+// The checksum is logged before the item is written, and an item matching
+// the checksum logged before its latest one passes too: a crash between the
+// two writes leaves the old item, which is still intact.
+type checksumLog struct {
+	path string
+
+	mu    sync.Mutex
+	sums  map[string]string // nil until loaded
+	prev  map[string]string // the checksum each ID had before its latest
+	lines int
+}
+
+func newChecksumLog(path string) *checksumLog {
+	return &checksumLog{path: path}
+}
+
+func (l *checksumLog) loadLocked() error {
+	if l.sums != nil {
+		return nil
+	}
+	sums, prev, lines, err := readChecksums(l.path)
+	if err != nil {
+		return err
+	}
+	l.sums, l.prev, l.lines = sums, prev, lines
+	return nil
+}
+
+func readChecksums(path string) (sums, prev map[string]string, lines int, err error) {
+	sums, prev = map[string]string{}, map[string]string{}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return sums, prev, 0, nil
+	}
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		id, sum, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			// A torn last line from an interrupted append.
+			continue
+		}
+		lines++
+		setSum(sums, prev, id, sum)
+	}
+	return sums, prev, lines, scanner.Err()
+}
+
+// setSum makes sum the checksum of id, keeping the one it replaces in prev.
+func setSum(sums, prev map[string]string, id, sum string) {
+	if sum == deletedSum {
+		delete(sums, id)
+		delete(prev, id)
+		return
+	}
+	if old, ok := sums[id]; ok && old != sum {
+		prev[id] = old
+	}
+	sums[id] = sum
+}
+
+// matches reports whether got is the checksum logged for id, or the one
+// logged before it.
+func matches(sums, prev map[string]string, id, got string) bool {
+	return got == sums[id] || (prev[id] != "" && got == prev[id])
+}
+
+// expected returns the recorded checksum of id, if it is tracked.
+func (l *checksumLog) expected(id string) (string, bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.loadLocked(); err != nil {
+		return "", false, err
+	}
+	sum, ok := l.sums[id]
+	return sum, ok, nil
+}
+
+// tracking reports whether the log holds any checksum, that is whether the
+// collection has been written since checksums were introduced.
+func (l *checksumLog) tracking() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.loadLocked() == nil && len(l.sums) > 0
+}
+
+// check compares stored, the bytes of item id as read from disk, with its
+// recorded checksum.
+func (l *checksumLog) check(id string, stored []byte, source string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.loadLocked(); err != nil {
+		return err
+	}
+	want, tracked := l.sums[id]
+	if !tracked {
+		return nil
+	}
+	got, err := storedSum(stored)
+	if err != nil {
+		return corrupted(source, id, err.Error())
+	}
+	if !matches(l.sums, l.prev, id, got) {
+		return corrupted(source, id, fmt.Sprintf("checksum %s, expected %s", got, want))
+	}
+	return nil
+}
+
+func (l *checksumLog) record(id string, sum string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.loadLocked(); err != nil {
+		return err
+	}
+	setSum(l.sums, l.prev, id, sum)
+
+	if l.lines+1 > 2*len(l.sums)+64 {
+		return l.rewriteLocked()
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(f, "%s %s\n", id, sum); err != nil {
+		f.Close()
+		return err
+	}
+	l.lines++
+	return f.Close()
+}
+
+func (l *checksumLog) forget(id string) error {
+	return l.record(id, deletedSum)
+}
+
+// undo restores the checksum id had before the latest record, for a write
+// that failed after its checksum was logged.
+func (l *checksumLog) undo(id string) error {
+	l.mu.Lock()
+	old, ok := l.prev[id]
+	l.mu.Unlock()
+	if !ok {
+		return l.forget(id)
+	}
+	return l.record(id, old)
+}
+
+// replace records exactly the checksums given, for storages that rewrite
+// the whole collection on every write, and returns the ones it replaced.
+func (l *checksumLog) replace(sums map[string]string) (map[string]string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.loadLocked(); err != nil {
+		return nil, err
+	}
+	old := l.sums
+	prev := map[string]string{}
+	for id, sum := range sums {
+		if was, ok := old[id]; ok && was != sum {
+			prev[id] = was
+		} else if was, ok := l.prev[id]; ok {
+			prev[id] = was
+		}
+	}
+	l.sums, l.prev = sums, prev
+	return old, l.rewriteLocked()
+}
+
+// rewriteLocked compacts the log to one line per ID, preceded by the
+// previous checksum of IDs that have one.
+func (l *checksumLog) rewriteLocked() error {
+	ids := make([]string, 0, len(l.sums))
+	for id := range l.sums {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	var buf bytes.Buffer
+	lines := 0
+	for _, id := range ids {
+		if prev, ok := l.prev[id]; ok {
+			fmt.Fprintf(&buf, "%s %s\n", id, prev)
+			lines++
+		}
+		fmt.Fprintf(&buf, "%s %s\n", id, l.sums[id])
+		lines++
+	}
+	tmp := l.path + ".tmp"
+	if err := os.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	l.lines = lines
+	return os.Rename(tmp, l.path)
+}
+
+// CorruptItem is an item that failed verification.
+type CorruptItem struct {
+	ID     string `json:"id"`
+	Reason string `json:"reason"`
+}
+
+// VerifyReport is the outcome of Verify for one collection.
+type VerifyReport struct {
+	Path      string        `json:"path"`
+	Items     int           `json:"items"`
+	Verified  int           `json:"verified"`
+	Untracked int           `json:"untracked"`
+	Missing   []string      `json:"missing,omitempty"`
+	Corrupted []CorruptItem `json:"corrupted,omitempty"`
+}
+
+// Err returns ErrMetadataCorrupted with the problems found, or nil.
+func (r VerifyReport) Err() error {
+	if len(r.Missing) == 0 && len(r.Corrupted) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s: %d corrupted and %d missing item(s)",
+		utils.ErrMetadataCorrupted, r.Path, len(r.Corrupted), len(r.Missing))
+}
+
+// Verify checks every item of the collection at path against its checksum
+// log without loading it into a Manager, so it works for any item type that
+// keeps its ID under "id". Tracked items that are gone are reported as
+// missing. Sealed files are checked as stored; c is only needed to count
+// the items of a sealed single-file collection and may be nil. The error is
+// the report's Err, or what kept the collection from being read.
+func Verify(path string, c Cipher) (VerifyReport, error) {
+	report := VerifyReport{Path: path}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return report, err
+	}
+
+	var sums, prev map[string]string
+	seen := map[string]bool{}
+	checkItem := func(id string, stored []byte) {
+		report.Items++
+		seen[id] = true
+		want, tracked := sums[id]
+		if !tracked {
+			report.Untracked++
+			return
+		}
+		got, err := storedSum(stored)
+		switch {
+		case err != nil:
+			report.Corrupted = append(report.Corrupted, CorruptItem{ID: id, Reason: err.Error()})
+		case !matches(sums, prev, id, got):
+			report.Corrupted = append(report.Corrupted, CorruptItem{ID: id, Reason: fmt.Sprintf("checksum %s, expected %s", got, want)})
+		default:
+			report.Verified++
+		}
+	}
+
+	if fi.IsDir() {
+		if sums, prev, _, err = readChecksums(filepath.Join(path, checksumFile)); err != nil {
+			return report, err
+		}
+		files, err := itemFiles(path)
+		if err != nil {
+			return report, err
+		}
+		for id, file := range files {
+			stored, err := os.ReadFile(file)
+			if err != nil {
+				report.Items++
+				seen[id] = true
+				report.Corrupted = append(report.Corrupted, CorruptItem{ID: id, Reason: err.Error()})
+				continue
+			}
+			checkItem(id, stored)
+		}
+	} else {
+		if sums, prev, _, err = readChecksums(path + checksumSuffix); err != nil {
+			return report, err
+		}
+		stored, err := os.ReadFile(path)
+		if err != nil {
+			return report, err
+		}
+		raw := stored
+		if isSealed(stored) {
+			seen[sealedFileEntry] = true
+			if want, tracked := sums[sealedFileEntry]; tracked {
+				if got, _ := storedSum(stored); !matches(sums, prev, sealedFileEntry, got) {
+					report.Corrupted = append(report.Corrupted, CorruptItem{Reason: fmt.Sprintf("checksum %s, expected %s", got, want)})
+					return report, report.Err()
+				}
+			}
+			if c == nil {
+				return report, report.Err()
+			}
+			if raw, err = openRaw(c, path, stored); err != nil {
+				return report, err
+			}
+		}
+		var elems []json.RawMessage
+		if err := json.Unmarshal(raw, &elems); err != nil && len(bytes.TrimSpace(raw)) > 0 {
+			report.Corrupted = append(report.Corrupted, CorruptItem{Reason: "file is not a JSON array: " + err.Error()})
+			return report, report.Err()
+		}
+		for _, elem := range elems {
+			var key struct {
+				ID string `json:"id"`
+			}
+			if err := json.Unmarshal(elem, &key); err != nil {
+				report.Corrupted = append(report.Corrupted, CorruptItem{Reason: err.Error()})
+				continue
+			}
+			if isSealed(stored) {
+				// Checked as a whole above.
+				report.Items++
+				report.Verified++
+				seen[key.ID] = true
+				continue
+			}
+			checkItem(key.ID, elem)
+		}
+	}
+
+	for id := range sums {
+		if !seen[id] {
+			report.Missing = append(report.Missing, id)
+		}
+	}
+	sort.Strings(report.Missing)
+	sort.Slice(report.Corrupted, func(i, j int) bool {
+		return report.Corrupted[i].ID < report.Corrupted[j].ID
+	})
+	return report, report.Err()
+}
@@ -0,0 +1,171 @@
+package collection_manager_v3
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mahdi-cpp/api-go-settings/internal/utils"
+)
+
+// testDataKeys returns data keys under a fresh master key in dir.
+func testDataKeys(t *testing.T, dir string) *DataKeys {
+	t.Helper()
+	keyfile := filepath.Join(dir, "keys", "master.key")
+	if _, err := AddMasterKey(keyfile); err != nil {
+		t.Fatal(err)
+	}
+	ring, err := LoadKeyring(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := OpenDataKeys(ring, filepath.Join(dir, ".datakey"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestCrashBeforeItemWriteStillLoads(t *testing.T) {
+	for _, name := range []string{"notes", "notes.json"} {
+		path := filepath.Join(t.TempDir(), name)
+		manager, err := NewCollectionManager[*note](path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := manager.CreateWithID(&note{ID: "a", Title: "before"}); err != nil {
+			t.Fatal(err)
+		}
+
+		// Log the checksum of an update, then "crash" before the item is
+		// written.
+		updated := &note{ID: "a", Title: "after"}
+		sum, _ := itemSum(updated)
+		switch s := manager.storage.(type) {
+		case *directoryStorage[*note]:
+			err = s.sums.record("a", sum)
+		case *singleFileStorage[*note]:
+			_, err = s.sums.replace(map[string]string{"a": sum})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reopened, err := NewCollectionManager[*note](path, true)
+		if err != nil {
+			t.Fatalf("%s: collection does not load after the crash: %v", name, err)
+		}
+		if got, _ := reopened.Get("a"); got == nil || got.Title != "before" {
+			t.Fatalf("%s: item = %+v", name, got)
+		}
+		if report, err := Verify(path, nil); err != nil {
+			t.Fatalf("%s: verify after the crash: %v %+v", name, err, report)
+		}
+	}
+}
+
+func TestChecksumsCatchCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notes")
+	manager, err := NewCollectionManager[*note](path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.CreateWithID(&note{ID: "a", Title: "one"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Update(&note{ID: "a", Title: "two"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Update(&note{ID: "a", Title: "three"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Neither a rollback past the previous version nor a flipped byte
+	// passes.
+	file := filepath.Join(path, "a.json")
+	for _, content := range []string{`{"id":"a","title":"one"}`, `{"id":"a","title":"thrEe"}`} {
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := newDirectoryStorage[*note](path).readItem("a"); !errors.Is(err, utils.ErrMetadataCorrupted) {
+			t.Errorf("%s: err = %v, want ErrMetadataCorrupted", content, err)
+		}
+	}
+}
+
+func TestChecksumSidecarsArePrivate(t *testing.T) {
+	dir := t.TempDir()
+	for _, path := range []string{filepath.Join(dir, "notes"), filepath.Join(dir, "notes.json")} {
+		manager, err := NewCollectionManager[*note](path, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Enough writes to go through both appending and compacting.
+		for i := 0; i < 80; i++ {
+			if _, err := manager.Create(&note{Title: "x"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sidecar := path + checksumSuffix
+		if filepath.Ext(path) == "" {
+			sidecar = filepath.Join(path, checksumFile)
+		}
+		fi, err := os.Stat(sidecar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0600 {
+			t.Errorf("%s: mode %v", sidecar, fi.Mode().Perm())
+		}
+	}
+}
+
+func TestEncryptedChecksumsDoNotDescribeContent(t *testing.T) {
+	dir := t.TempDir()
+	keys := testDataKeys(t, dir)
+	plainSum, _ := itemSum(&note{ID: "a", Title: "secret"})
+
+	for _, name := range []string{"notes", "notes.json"} {
+		path := filepath.Join(dir, name)
+		manager, err := NewCollectionManager[*note](path, false, WithEncryption(keys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := manager.CreateWithID(&note{ID: "a", Title: "secret"}); err != nil {
+			t.Fatal(err)
+		}
+
+		sidecar := path + checksumSuffix
+		itemFile := path
+		if name == "notes" {
+			sidecar = filepath.Join(path, checksumFile)
+			itemFile = filepath.Join(path, "a.json")
+		}
+		log, err := os.ReadFile(sidecar)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(log, []byte(plainSum)) {
+			t.Fatalf("%s: checksum log holds the plaintext checksum", name)
+		}
+
+		// Verify needs no key to check sealed items.
+		if _, err := Verify(path, nil); err != nil {
+			t.Fatalf("%s: verify without key: %v", name, err)
+		}
+
+		stored, err := os.ReadFile(itemFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stored[len(stored)-1] ^= 1
+		if err := os.WriteFile(itemFile, stored, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := NewCollectionManager[*note](path, true, WithEncryption(keys)); !errors.Is(err, utils.ErrMetadataCorrupted) {
+			t.Fatalf("%s: tampered collection opened: %v", name, err)
+		}
+	}
+}
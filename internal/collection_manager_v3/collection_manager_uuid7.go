@@ -1,17 +1,19 @@
 package collection_manager_v3
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
-	"sort"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/mahdi-cpp/api-go-pkg/metadata"
 	"github.com/mahdi-cpp/api-go-pkg/registery"
+	"github.com/mahdi-cpp/api-go-settings/internal/utils"
 )
 
 type CollectionItem interface {
@@ -28,21 +30,119 @@ type storage[T CollectionItem] interface {
 	CreateItem(item T) error
 	UpdateItem(item T) error
 	DeleteItem(id string) error
+	CreateItems(items []T) []error
+	UpdateItems(items []T) []error
+	DeleteItems(ids []string) []error
 }
 
 type singleFileStorage[T CollectionItem] struct {
-	ctrl *metadata.Control[[]T]
+	path   string
+	ctrl   *metadata.Control[[]T]
+	cipher Cipher // nil stores plain JSON
+	sums   *checksumLog
+
+	mu sync.Mutex // serialises writes, so the file and its checksums change in step
+}
+
+func newSingleFileStorage[T CollectionItem](path string) *singleFileStorage[T] {
+	return &singleFileStorage[T]{
+		path: path,
+		ctrl: metadata.NewMetadataControl[[]T](path),
+		sums: newChecksumLog(path + checksumSuffix),
+	}
 }
 
+// ReadAll decodes the file item by item, checking each against its
+// checksum, and fails with ErrMetadataCorrupted on the first mismatch. A
+// sealed file is checked as a whole before it is opened.
 func (s *singleFileStorage[T]) ReadAll(requireExist bool) ([]T, error) {
-	dataPtr, err := s.ctrl.Read(requireExist)
+	stored, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) && !requireExist {
+			return []T{}, nil
+		}
+		return nil, err
+	}
+	sealed := isSealed(stored)
+	if sealed {
+		if err := s.sums.check(sealedFileEntry, stored, s.path); err != nil {
+			return nil, err
+		}
+	}
+	raw, err := openRaw(s.cipher, s.path, stored)
 	if err != nil {
 		return nil, err
 	}
-	if dataPtr == nil {
+	if len(bytes.TrimSpace(raw)) == 0 {
 		return []T{}, nil
 	}
-	return *dataPtr, nil
+
+	var elems []json.RawMessage
+	if err := json.Unmarshal(raw, &elems); err != nil {
+		if s.sums.tracking() {
+			return nil, fmt.Errorf("%w: %s: %v", utils.ErrMetadataCorrupted, s.path, err)
+		}
+		return nil, err
+	}
+
+	items := make([]T, 0, len(elems))
+	for _, elem := range elems {
+		var item T
+		if err := json.Unmarshal(elem, &item); err != nil {
+			return nil, err
+		}
+		if !sealed {
+			if err := s.sums.check(item.GetID(), elem, s.path); err != nil {
+				return nil, err
+			}
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// write replaces the file with items. The checksums are logged first; see
+// checksumLog.
+func (s *singleFileStorage[T]) write(items []T) error {
+	sums := make(map[string]string, len(items))
+	var sealed []byte
+	if s.cipher != nil {
+		var err error
+		if sealed, err = sealJSON(s.cipher, items); err != nil {
+			return err
+		}
+		if sums[sealedFileEntry], err = storedSum(sealed); err != nil {
+			return err
+		}
+	} else {
+		for _, item := range items {
+			sum, err := itemSum(item)
+			if err != nil {
+				return err
+			}
+			sums[item.GetID()] = sum
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return err
+	}
+	old, err := s.sums.replace(sums)
+	if err != nil {
+		return err
+	}
+	if sealed != nil {
+		err = writeFile(s.path, sealed)
+	} else {
+		err = s.ctrl.Write(&items)
+	}
+	if err != nil {
+		_, undoErr := s.sums.replace(old)
+		return errors.Join(err, undoErr)
+	}
+	return nil
 }
 
 func (s *singleFileStorage[T]) CreateItem(item T) error {
@@ -51,7 +151,7 @@ func (s *singleFileStorage[T]) CreateItem(item T) error {
 		return err
 	}
 	items = append(items, item)
-	return s.ctrl.Write(&items)
+	return s.write(items)
 }
 
 func (s *singleFileStorage[T]) UpdateItem(updatedItem T) error {
@@ -68,135 +168,269 @@ func (s *singleFileStorage[T]) UpdateItem(updatedItem T) error {
 		}
 	}
 	if !found {
-		return errors.New("item not found")
+		return fmt.Errorf("%w: %s", ErrItemNotFound, updatedItem.GetID())
 	}
-	return s.ctrl.Write(&items)
+	return s.write(items)
 }
 
 func (s *singleFileStorage[T]) DeleteItem(id string) error {
-	items, err := s.ReadAll(false)
-	if err != nil {
-		return err
-	}
-	var newItems []T
-	for _, item := range items {
-		if item.GetID() != id {
-			newItems = append(newItems, item)
-		}
-	}
-	return s.ctrl.Write(&newItems)
+	return s.DeleteItems([]string{id})[0]
 }
 
 type directoryStorage[T CollectionItem] struct {
 	baseDir string
+	depth   int    // shard levels, 0 for the flat layout
+	cipher  Cipher // nil stores plain JSON
+	sums    *checksumLog
+
+	layoutPending bool // depth still has to be recorded in the .layout file
+}
+
+func newDirectoryStorage[T CollectionItem](baseDir string) *directoryStorage[T] {
+	return &directoryStorage[T]{baseDir: baseDir, sums: newChecksumLog(filepath.Join(baseDir, checksumFile))}
 }
 
 func (d *directoryStorage[T]) itemPath(id string) string {
-	return filepath.Join(d.baseDir, id+".json")
+	return shardedPath(d.baseDir, id, d.depth)
 }
 
 func (d *directoryStorage[T]) ReadAll(requireExist bool) ([]T, error) {
+	ids, err := d.ListIDs(requireExist)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []T{}
+	var corrupt []error
+	for _, id := range ids {
+		item, err := d.readItem(id)
+		if errors.Is(err, utils.ErrMetadataCorrupted) || errors.Is(err, ErrDecrypt) {
+			// Items the keys cannot open are not left out silently.
+			corrupt = append(corrupt, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		items = append(items, item)
+	}
+	return items, errors.Join(corrupt...)
+}
+
+// ListIDs returns the IDs of the stored items without reading them. It
+// finds items in both the flat and the sharded layout, so a collection that
+// is half way through a reshard still lists completely.
+func (d *directoryStorage[T]) ListIDs(requireExist bool) ([]string, error) {
 	if _, err := os.Stat(d.baseDir); err != nil {
 		if os.IsNotExist(err) {
 			if requireExist {
 				return nil, err
 			}
-			return []T{}, nil
+			return []string{}, nil
 		}
 		return nil, err
 	}
 
-	entries, err := os.ReadDir(d.baseDir)
+	paths, err := itemFiles(d.baseDir)
 	if err != nil {
 		return nil, err
 	}
+	ids := make([]string, 0, len(paths))
+	for id := range paths {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
 
-	var items []T
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-
-		filename := entry.Name()
-		if filepath.Ext(filename) != ".json" {
+// locate returns where the item with id is stored, looking in the other
+// layouts when it is not where the current layout puts it.
+func (d *directoryStorage[T]) locate(id string) string {
+	path := d.itemPath(id)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	for depth := 0; depth <= maxShardDepth; depth++ {
+		if depth == d.depth {
 			continue
 		}
-
-		id := strings.TrimSuffix(filename, filepath.Ext(filename))
-		item, err := d.readItem(id)
-		if err != nil {
-			continue
+		alt := shardedPath(d.baseDir, id, depth)
+		if _, err := os.Stat(alt); err == nil {
+			return alt
 		}
-		items = append(items, item)
 	}
-	return items, nil
+	return path
 }
 
+// readItem reads and checks the item with id. An item that does not parse
+// although it has a checksum is reported as corrupted, as that is what a
+// partial write leaves behind.
 func (d *directoryStorage[T]) readItem(id string) (T, error) {
-	var zero T
-	path := d.itemPath(id)
-	ctrl := metadata.NewMetadataControl[T](path)
-
-	dataPtr, err := ctrl.Read(true)
+	var item T
+	if err := checkID(id); err != nil {
+		return item, err
+	}
+	path := d.locate(id)
+	stored, err := os.ReadFile(path)
 	if err != nil {
-		return zero, err
+		return item, err
 	}
-	if dataPtr == nil {
-		return zero, errors.New("metadata not found")
+	if err := d.sums.check(id, stored, path); err != nil {
+		return item, err
 	}
-	return *dataPtr, nil
+	raw, err := openRaw(d.cipher, path, stored)
+	if err != nil {
+		return item, err
+	}
+	if err := json.Unmarshal(raw, &item); err != nil {
+		if _, tracked, _ := d.sums.expected(id); tracked {
+			return item, corrupted(path, id, err.Error())
+		}
+		return item, err
+	}
+	return item, nil
 }
 
 func (d *directoryStorage[T]) CreateItem(item T) error {
-	if err := os.MkdirAll(d.baseDir, 0755); err != nil {
+	path := d.itemPath(item.GetID())
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
 		return err
 	}
-	path := d.itemPath(item.GetID())
-	ctrl := metadata.NewMetadataControl[T](path)
-	return ctrl.Write(&item)
+	if d.layoutPending {
+		if err := writeLayout(d.baseDir, layout{ShardDepth: d.depth}); err != nil {
+			return err
+		}
+		d.layoutPending = false
+	}
+	return d.writeItem(path, item)
 }
 
 func (d *directoryStorage[T]) UpdateItem(item T) error {
-	path := d.itemPath(item.GetID())
-	ctrl := metadata.NewMetadataControl[T](path)
-	return ctrl.Write(&item)
+	if err := checkID(item.GetID()); err != nil {
+		return err
+	}
+	path := d.locate(item.GetID())
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrItemNotFound, item.GetID())
+	}
+	return d.writeItem(path, item)
 }
 
-func (d *directoryStorage[T]) DeleteItem(id string) error {
-	path := d.itemPath(id)
-	return os.Remove(path)
+// writeItem writes item to path. The checksum is logged first; see
+// checksumLog.
+func (d *directoryStorage[T]) writeItem(path string, item T) error {
+	var sealed []byte
+	sum, err := itemSum(item)
+	if err == nil && d.cipher != nil {
+		if sealed, err = sealJSON(d.cipher, item); err == nil {
+			sum, err = storedSum(sealed)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	id := item.GetID()
+	if err := d.sums.record(id, sum); err != nil {
+		return err
+	}
+	if sealed != nil {
+		err = writeFile(path, sealed)
+	} else {
+		err = metadata.NewMetadataControl[T](path).Write(&item)
+	}
+	if err != nil {
+		return errors.Join(err, d.sums.undo(id))
+	}
+	return nil
 }
 
-type Manager[T CollectionItem] struct {
-	storage storage[T]
-	items   *registery.Registry[T]
+func (d *directoryStorage[T]) DeleteItem(id string) error {
+	if err := checkID(id); err != nil {
+		return err
+	}
+	path := d.locate(id)
+	if err := os.Remove(path); errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("%w: %s", ErrItemNotFound, id)
+	} else if err != nil {
+		return err
+	}
+	return d.sums.forget(id)
 }
 
-type SortOptions struct {
-	SortBy    string
-	SortOrder string
+type Manager[T CollectionItem] struct {
+	// storageMu is held shared around every storage write, through
+	// beginWrite, and exclusively while Convert swaps the storage.
+	storageMu sync.RWMutex
+	storage   storage[T]
+	items     itemSet[T]
+	clock     Clock
+	ids       IDGenerator
+	ttl       time.Duration
+	gate      WriteGate
+	listeners listeners[T]
+	relations relations
 }
 
-func NewCollectionManager[T CollectionItem](path string, requireExist bool) (*Manager[T], error) {
+func NewCollectionManager[T CollectionItem](path string, requireExist bool, opts ...Option) (*Manager[T], error) {
 	var store storage[T]
 
 	if fi, err := os.Stat(path); err == nil {
 		if fi.IsDir() {
-			store = &directoryStorage[T]{baseDir: path}
+			store = newDirectoryStorage[T](path)
 		} else {
-			store = &singleFileStorage[T]{ctrl: metadata.NewMetadataControl[[]T](path)}
+			store = newSingleFileStorage[T](path)
 		}
 	} else {
 		if strings.HasSuffix(path, ".json") {
-			store = &singleFileStorage[T]{ctrl: metadata.NewMetadataControl[[]T](path)}
+			store = newSingleFileStorage[T](path)
 		} else {
-			store = &directoryStorage[T]{baseDir: path}
+			store = newDirectoryStorage[T](path)
 		}
 	}
 
+	return newManager[T](store, requireExist, opts)
+}
+
+func newManager[T CollectionItem](store storage[T], requireExist bool, opts []Option) (*Manager[T], error) {
+	o := newOptions(opts)
+
 	manager := &Manager[T]{
 		storage: store,
 		items:   registery.NewRegistry[T](),
+		clock:   o.clock,
+		ids:     o.ids,
+		ttl:     o.ttl,
+		gate:    o.gate,
+	}
+
+	if o.cipher != nil {
+		switch s := store.(type) {
+		case *singleFileStorage[T]:
+			s.cipher = o.cipher
+		case *directoryStorage[T]:
+			s.cipher = o.cipher
+		default:
+			return nil, ErrEncryptionNeedsFiles
+		}
+	}
+
+	if dir, ok := store.(*directoryStorage[T]); ok {
+		if err := dir.openLayout(o.shardDepth); err != nil {
+			return nil, fmt.Errorf("failed to open layout: %w", err)
+		}
+	}
+
+	if o.lazyBudget > 0 {
+		dir, ok := store.(*directoryStorage[T])
+		if !ok {
+			return nil, ErrLazyNeedsDirectory
+		}
+		lazy, err := newLazyItems[T](dir, o.lazyBudget, requireExist)
+		if err != nil {
+			return nil, fmt.Errorf("failed to index items: %w", err)
+		}
+		manager.items = lazy
+		return manager, nil
 	}
 
 	items, err := manager.storage.ReadAll(requireExist)
@@ -211,48 +445,130 @@ func NewCollectionManager[T CollectionItem](path string, requireExist bool) (*Ma
 	return manager, nil
 }
 
+// beginWrite holds off the write gate, such as snapshots, and storage swaps
+// until the returned function is called.
+func (manager *Manager[T]) beginWrite() func() {
+	endGateWrite := manager.gate.BeginWrite()
+	manager.storageMu.RLock()
+	return func() {
+		manager.storageMu.RUnlock()
+		endGateWrite()
+	}
+}
+
 func (manager *Manager[T]) Create(newItem T) (T, error) {
-	u7, err := uuid.NewV7()
+	id, err := manager.newID(newItem)
 	if err != nil {
 		var zero T
-		return zero, fmt.Errorf("error generating UUIDv7: %w", err)
+		return zero, fmt.Errorf("error generating ID: %w", err)
+	}
+	if manager.exists(id) {
+		var zero T
+		return zero, fmt.Errorf("%w: %s", ErrDuplicateID, id)
 	}
 
-	newItem.SetID(u7.String())
-	newItem.SetCreatedAt(time.Now())
-	newItem.SetUpdatedAt(time.Now())
+	now := manager.clock.Now()
+	newItem.SetID(id)
+	newItem.SetCreatedAt(now)
+	newItem.SetUpdatedAt(now)
 
-	if err := manager.storage.CreateItem(newItem); err != nil {
+	endWrite := manager.beginWrite()
+	err = manager.storage.CreateItem(newItem)
+	endWrite()
+	if err != nil {
 		return newItem, err
 	}
 
 	manager.items.Register(newItem.GetID(), newItem)
+	manager.emit(ChangeCreate, newItem.GetID(), newItem)
+	return newItem, nil
+}
+
+// CreateWithID stores an item that already carries its ID, for imports from
+// another collection or system. Timestamps already set on the item are kept;
+// zero ones are stamped with the current time. IDs that could not name a
+// file inside the collection are refused with ErrInvalidID.
+func (manager *Manager[T]) CreateWithID(newItem T) (T, error) {
+	id := newItem.GetID()
+	if err := checkID(id); err != nil {
+		return newItem, err
+	}
+	if manager.exists(id) {
+		return newItem, fmt.Errorf("%w: %s", ErrDuplicateID, id)
+	}
+
+	now := manager.clock.Now()
+	if newItem.GetCreatedAt().IsZero() {
+		newItem.SetCreatedAt(now)
+	}
+	if newItem.GetUpdatedAt().IsZero() {
+		newItem.SetUpdatedAt(newItem.GetCreatedAt())
+	}
+
+	endWrite := manager.beginWrite()
+	err := manager.storage.CreateItem(newItem)
+	endWrite()
+	if err != nil {
+		return newItem, err
+	}
+
+	manager.items.Register(id, newItem)
+	manager.emit(ChangeCreate, id, newItem)
 	return newItem, nil
 }
 
+func (manager *Manager[T]) newID(item T) (string, error) {
+	if gen, ok := manager.ids.(ItemIDGenerator); ok {
+		return gen.NewIDFor(item)
+	}
+	return manager.ids.NewID()
+}
+
+func (manager *Manager[T]) exists(id string) bool {
+	if set, ok := manager.items.(interface{ Has(string) bool }); ok {
+		return set.Has(id)
+	}
+	_, err := manager.items.Get(id)
+	return err == nil
+}
+
 func (manager *Manager[T]) Update(updatedItem T) (T, error) {
-	updatedItem.SetUpdatedAt(time.Now())
-	if err := manager.storage.UpdateItem(updatedItem); err != nil {
+	updatedItem.SetUpdatedAt(manager.clock.Now())
+	endWrite := manager.beginWrite()
+	err := manager.storage.UpdateItem(updatedItem)
+	endWrite()
+	if err != nil {
 		return updatedItem, err
 	}
 	manager.items.Update(updatedItem.GetID(), updatedItem)
+	manager.emit(ChangeUpdate, updatedItem.GetID(), updatedItem)
 	return updatedItem, nil
 }
 
 func (manager *Manager[T]) Delete(id string) error {
-	if err := manager.storage.DeleteItem(id); err != nil {
+	_, refused := manager.beforeDelete([]string{id})
+	if err := refused[id]; err != nil {
+		return err
+	}
+
+	old, _ := manager.items.Get(id)
+	endWrite := manager.beginWrite()
+	err := manager.storage.DeleteItem(id)
+	endWrite()
+	if err != nil {
 		return err
 	}
 	manager.items.Delete(id)
-	return nil
+	manager.emit(ChangeDelete, id, old)
+	return manager.afterDelete([]string{id})
 }
 
 func (manager *Manager[T]) Get(id string) (T, error) {
-	return manager.items.Get(id)
+	return manager.lookup(id)
 }
 
 func (manager *Manager[T]) GetList(filterFunc func(T) bool) ([]T, error) {
-	allItems := manager.items.GetAllValues()
+	allItems := manager.values()
 	var result []T
 	for _, item := range allItems {
 		if filterFunc == nil || filterFunc(item) {
@@ -263,46 +579,13 @@ func (manager *Manager[T]) GetList(filterFunc func(T) bool) ([]T, error) {
 }
 
 func (manager *Manager[T]) GetAll() ([]T, error) {
-	return manager.items.GetAllValues(), nil
+	return manager.values(), nil
 }
 
 func (manager *Manager[T]) GetBy(filterFunc func(T) bool) ([]T, error) {
 	return manager.GetList(filterFunc)
 }
 
-func (manager *Manager[T]) SortItems(items []T, options SortOptions) []T {
-	if options.SortBy == "" {
-		return items
-	}
-
-	sort.Slice(items, func(i, j int) bool {
-		a := items[i]
-		b := items[j]
-
-		switch options.SortBy {
-		case "id":
-			if options.SortOrder == "asc" {
-				return a.GetID() < b.GetID()
-			}
-			return a.GetID() > b.GetID()
-		case "creationDate":
-			if options.SortOrder == "asc" {
-				return a.GetCreatedAt().Before(b.GetCreatedAt())
-			}
-			return a.GetCreatedAt().After(b.GetCreatedAt())
-		case "modificationDate":
-			if options.SortOrder == "asc" {
-				return a.GetUpdatedAt().Before(b.GetUpdatedAt())
-			}
-			return a.GetUpdatedAt().After(b.GetUpdatedAt())
-		default:
-			return false
-		}
-	})
-
-	return items
-}
-
 func (manager *Manager[T]) GetSortedList(filterFunc func(T) bool, sortBy string, sortOrder string) ([]T, error) {
 	items, err := manager.GetList(filterFunc)
 	if err != nil {
@@ -311,7 +594,7 @@ func (manager *Manager[T]) GetSortedList(filterFunc func(T) bool, sortBy string,
 	return manager.SortItems(items, SortOptions{
 		SortBy:    sortBy,
 		SortOrder: sortOrder,
-	}), nil
+	})
 }
 
 func (manager *Manager[T]) GetAllSorted(sortBy string, sortOrder string) ([]T, error) {
@@ -319,5 +602,5 @@ func (manager *Manager[T]) GetAllSorted(sortBy string, sortOrder string) ([]T, e
 	if err != nil {
 		return nil, err
 	}
-	return manager.SortItems(items, SortOptions{SortBy: sortBy, SortOrder: sortOrder}), nil
+	return manager.SortItems(items, SortOptions{SortBy: sortBy, SortOrder: sortOrder})
 }
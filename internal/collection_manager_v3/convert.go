@@ -0,0 +1,245 @@
+package collection_manager_v3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StorageKind names the on-disk form of a collection.
+type StorageKind string
+
+const (
+	// SingleFile keeps every item in one JSON array file.
+	SingleFile StorageKind = "file"
+	// Directory keeps one JSON file per item, optionally sharded.
+	Directory StorageKind = "directory"
+)
+
+var (
+	ErrUnknownStorageKind = errors.New("unknown storage kind")
+	ErrNotConvertible     = errors.New("collection storage cannot be converted")
+	ErrConvertMismatch    = errors.New("converted collection does not match the source")
+)
+
+// ConvertReport describes a finished conversion.
+type ConvertReport struct {
+	From     StorageKind `json:"from"`
+	To       StorageKind `json:"to"`
+	Items    int         `json:"items"`
+	Checksum string      `json:"checksum"`
+	Backup   string      `json:"backup,omitempty"`
+}
+
+// Convert rewrites the collection in place into the given storage kind while
+// the manager keeps serving reads. Writes wait until it finishes. The items
+// are copied next to the collection, read back and compared by count and
+// per-item checksum; only then is the original moved aside to a backup path
+// and the copy renamed into its place. On any failure the copy is removed
+// and the collection is left as it was. shardDepth applies when converting
+// to a directory. A directory holding anything besides its items is not
+// turned into a file, as that content would be left behind in the backup.
+func (manager *Manager[T]) Convert(to StorageKind, shardDepth int) (ConvertReport, error) {
+	if to != SingleFile && to != Directory {
+		return ConvertReport{}, fmt.Errorf("%w: %s", ErrUnknownStorageKind, to)
+	}
+	if shardDepth < 0 || shardDepth > maxShardDepth {
+		return ConvertReport{}, ErrInvalidShardDepth
+	}
+
+	defer manager.gate.BeginWrite()()
+	manager.storageMu.Lock()
+	defer manager.storageMu.Unlock()
+
+	var from StorageKind
+	var path string
+	var cipher Cipher
+	switch s := manager.storage.(type) {
+	case *singleFileStorage[T]:
+		from, path, cipher = SingleFile, s.path, s.cipher
+	case *directoryStorage[T]:
+		from, path, cipher = Directory, s.baseDir, s.cipher
+	default:
+		return ConvertReport{}, ErrNotConvertible
+	}
+	if _, lazy := manager.items.(*lazyItems[T]); lazy && to != Directory {
+		return ConvertReport{}, ErrLazyNeedsDirectory
+	}
+	if from == Directory && to == SingleFile {
+		foreign, err := foreignEntries(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return ConvertReport{}, err
+		}
+		if len(foreign) > 0 {
+			return ConvertReport{}, fmt.Errorf("%w: %s also holds %s", ErrNotConvertible, path, strings.Join(foreign, ", "))
+		}
+	}
+
+	items, err := manager.storage.ReadAll(false)
+	if err != nil {
+		return ConvertReport{}, fmt.Errorf("failed to read collection: %w", err)
+	}
+	report := ConvertReport{From: from, To: to, Items: len(items)}
+
+	if from == to {
+		if dir, ok := manager.storage.(*directoryStorage[T]); ok && dir.depth != shardDepth {
+			if _, err := Reshard(path, shardDepth); err != nil {
+				return report, err
+			}
+			dir.depth = shardDepth
+		}
+		report.Checksum, err = checksums(items)
+		return report, err
+	}
+
+	tmp := path + ".converting"
+	removeTmp := func() {
+		os.RemoveAll(tmp)
+		os.Remove(tmp + checksumSuffix)
+	}
+	removeTmp()
+	if err := writeConverted(openConverted[T](tmp, to, shardDepth, cipher), items); err != nil {
+		removeTmp()
+		return report, fmt.Errorf("failed to write converted collection: %w", err)
+	}
+
+	copied, err := openConverted[T](tmp, to, shardDepth, cipher).ReadAll(true)
+	if err == nil {
+		report.Checksum, err = verifyConverted(items, copied)
+	}
+	if err != nil {
+		removeTmp()
+		return report, err
+	}
+
+	backup := backupPath(path, manager.clock.Now())
+	if err := os.Rename(path, backup); err == nil {
+		report.Backup = backup
+		if from == SingleFile {
+			os.Rename(path+checksumSuffix, backup+checksumSuffix)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		removeTmp()
+		return report, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		if report.Backup != "" {
+			os.Rename(report.Backup, path)
+		}
+		removeTmp()
+		return report, err
+	}
+	if to == SingleFile {
+		if err := os.Rename(tmp+checksumSuffix, path+checksumSuffix); err != nil {
+			return report, err
+		}
+	}
+
+	manager.storage = openConverted[T](path, to, shardDepth, cipher)
+	return report, nil
+}
+
+// backupPath names a free path next to path, stamped with now.
+func backupPath(path string, now time.Time) string {
+	backup := path + ".bak-" + now.UTC().Format("20060102T150405")
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(backup); errors.Is(err, os.ErrNotExist) {
+			return backup
+		}
+		backup = fmt.Sprintf("%s.bak-%s-%d", path, now.UTC().Format("20060102T150405"), i)
+	}
+}
+
+func openConverted[T CollectionItem](path string, kind StorageKind, shardDepth int, cipher Cipher) storage[T] {
+	if kind == SingleFile {
+		file := newSingleFileStorage[T](path)
+		file.cipher = cipher
+		return file
+	}
+	dir := newDirectoryStorage[T](path)
+	dir.depth, dir.cipher = shardDepth, cipher
+	return dir
+}
+
+// writeConverted stores items in target. An empty collection still gets its
+// file or directory, so the result opens as the right kind.
+func writeConverted[T CollectionItem](target storage[T], items []T) error {
+	switch s := target.(type) {
+	case *singleFileStorage[T]:
+		return s.write(items)
+	case *directoryStorage[T]:
+		if err := os.MkdirAll(s.baseDir, 0755); err != nil {
+			return err
+		}
+		if err := writeLayout(s.baseDir, layout{ShardDepth: s.depth}); err != nil {
+			return err
+		}
+		return errors.Join(s.CreateItems(items)...)
+	}
+	return ErrNotConvertible
+}
+
+// verifyConverted compares the items read back from the copy with the
+// source, by ID, and returns the checksum they share.
+func verifyConverted[T CollectionItem](source, copied []T) (string, error) {
+	if len(source) != len(copied) {
+		return "", fmt.Errorf("%w: %d items instead of %d", ErrConvertMismatch, len(copied), len(source))
+	}
+
+	want, err := itemChecksums(source)
+	if err != nil {
+		return "", err
+	}
+	got, err := itemChecksums(copied)
+	if err != nil {
+		return "", err
+	}
+	for id, sum := range want {
+		if got[id] != sum {
+			return "", fmt.Errorf("%w: item %s", ErrConvertMismatch, id)
+		}
+	}
+	return combineChecksums(want), nil
+}
+
+// itemChecksums maps each item ID to its content checksum.
+func itemChecksums[T CollectionItem](items []T) (map[string]string, error) {
+	sums := make(map[string]string, len(items))
+	for _, item := range items {
+		sum, err := itemSum(item)
+		if err != nil {
+			return nil, err
+		}
+		sums[item.GetID()] = sum
+	}
+	return sums, nil
+}
+
+func checksums[T CollectionItem](items []T) (string, error) {
+	sums, err := itemChecksums(items)
+	if err != nil {
+		return "", err
+	}
+	return combineChecksums(sums), nil
+}
+
+// combineChecksums hashes the per-item checksums in ID order, giving one
+// checksum for the whole collection that does not depend on storage order.
+func combineChecksums(sums map[string]string) string {
+	ids := make([]string, 0, len(sums))
+	for id := range sums {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	h := sha256.New()
+	for _, id := range ids {
+		fmt.Fprintf(h, "%s:%s\n", id, sums[id])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,71 @@
+package collection_manager_v3
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newDirectoryNotes(t *testing.T, ids ...string) (*Manager[*note], string) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "notes")
+	manager, err := NewCollectionManager[*note](dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if _, err := manager.CreateWithID(&note{ID: id, Title: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return manager, dir
+}
+
+func TestConvertDirectoryToFile(t *testing.T) {
+	manager, dir := newDirectoryNotes(t, "a", "b")
+
+	report, err := manager.Convert(SingleFile, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Items != 2 || report.Backup == "" {
+		t.Fatalf("report = %+v", report)
+	}
+	if fi, err := os.Stat(dir); err != nil || fi.IsDir() {
+		t.Fatalf("%s is not a file after conversion: %v", dir, err)
+	}
+
+	reopened, err := NewCollectionManager[*note](dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := reopened.GetAll(); len(got) != 2 {
+		t.Fatalf("reopened collection holds %d items", len(got))
+	}
+}
+
+func TestConvertRefusesDirectoryWithOtherContent(t *testing.T) {
+	manager, dir := newDirectoryNotes(t, "a")
+	if err := os.MkdirAll(filepath.Join(dir, "alice", "assets"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "thumb.jpg"), []byte("jpeg"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := manager.Convert(SingleFile, 0)
+	if !errors.Is(err, ErrNotConvertible) {
+		t.Fatalf("err = %v, want ErrNotConvertible", err)
+	}
+	for _, path := range []string{"a.json", "thumb.jpg", filepath.Join("alice", "assets")} {
+		if _, err := os.Stat(filepath.Join(dir, path)); err != nil {
+			t.Errorf("%s: %v", path, err)
+		}
+	}
+
+	// Resharding keeps the other content where it is, so it is allowed.
+	if _, err := manager.Convert(Directory, 1); err != nil {
+		t.Fatalf("reshard: %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package collection_manager_v3
+
+import "time"
+
+// Document is a schema-less CollectionItem for tools that handle collections
+// without knowing their item type, such as import/export. It expects the
+// "id", "creationDate" and "modificationDate" keys used by the typed models.
+type Document map[string]any
+
+func (d Document) SetID(id string)          { d["id"] = id }
+func (d Document) SetCreatedAt(t time.Time) { d["creationDate"] = t }
+func (d Document) SetUpdatedAt(t time.Time) { d["modificationDate"] = t }
+func (d Document) GetID() string {
+	id, _ := d["id"].(string)
+	return id
+}
+func (d Document) GetCreatedAt() time.Time { return d.timeField("creationDate") }
+func (d Document) GetUpdatedAt() time.Time { return d.timeField("modificationDate") }
+
+// GetExpiresAt reads the optional "expiresAt" key, making Document an Expirer.
+func (d Document) GetExpiresAt() time.Time { return d.timeField("expiresAt") }
+
+func (d Document) timeField(key string) time.Time {
+	switch v := d[key].(type) {
+	case time.Time:
+		return v
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return time.Time{}
+		}
+		return t
+	default:
+		return time.Time{}
+	}
+}
+
+// Field returns the value at a dotted JSON path, or nil if there is none.
+func (d Document) Field(path string) any {
+	return lookupPath(d, path)
+}
@@ -0,0 +1,411 @@
+package collection_manager_v3
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// sealedMagic starts every encrypted collection file. Files without it are
+// read as plain JSON, so encryption can be enabled on existing collections;
+// they are sealed as they are next written, or all at once by Reencrypt.
+var sealedMagic = []byte("IRISENC1")
+
+const keySize = 32 // AES-256
+
+var (
+	ErrUnknownKey  = errors.New("unknown encryption key")
+	ErrNoMasterKey = errors.New("keyfile holds no master key")
+	ErrDecrypt     = errors.New("cannot decrypt collection file")
+)
+
+// Cipher seals collection files before they are written and opens them after
+// they are read. DataKeys is the implementation used in production.
+type Cipher interface {
+	Seal(plain []byte) ([]byte, error)
+	Open(sealed []byte) ([]byte, error)
+}
+
+func isSealed(raw []byte) bool {
+	return bytes.HasPrefix(raw, sealedMagic)
+}
+
+// readRaw returns the plain JSON stored at path, opening it with c when it
+// is sealed.
+func readRaw(c Cipher, path string) ([]byte, error) {
+	stored, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return openRaw(c, path, stored)
+}
+
+// openRaw returns the plain JSON of stored, the bytes read from path.
+func openRaw(c Cipher, path string, stored []byte) ([]byte, error) {
+	if !isSealed(stored) {
+		return stored, nil
+	}
+	if c == nil {
+		return nil, fmt.Errorf("%w: %s is encrypted and no key was given", ErrDecrypt, path)
+	}
+	plain, err := c.Open(stored)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrDecrypt, path, err)
+	}
+	return plain, nil
+}
+
+// sealJSON returns v as sealed JSON.
+func sealJSON(c Cipher, v any) ([]byte, error) {
+	plain, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return c.Seal(plain)
+}
+
+// writeFile writes data to path through a temporary file.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	return b, err
+}
+
+// Keyring holds the versioned master keys of a keyfile. The keyfile has one
+// "<version> <hex key>" line per key; the highest version is current and
+// wraps new data keys, older ones only unwrap.
+type Keyring struct {
+	keys    map[int][]byte
+	current int
+}
+
+// LoadKeyring reads the master keys from keyfile.
+func LoadKeyring(keyfile string) (*Keyring, error) {
+	f, err := os.Open(keyfile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ring := &Keyring{keys: map[int][]byte{}}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("malformed keyfile line %q", line)
+		}
+		version, err := strconv.Atoi(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("malformed key version %q", fields[0])
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("master key %d is not %d hex bytes", version, keySize)
+		}
+		ring.keys[version] = key
+		if version > ring.current {
+			ring.current = version
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ring.keys) == 0 {
+		return nil, ErrNoMasterKey
+	}
+	return ring, nil
+}
+
+// AddMasterKey appends a new random master key to keyfile, creating it if
+// needed, and returns the version it got. Data keys keep unwrapping with the
+// older versions until DataKeys.Rewrap moves them to the new one.
+func AddMasterKey(keyfile string) (int, error) {
+	version := 1
+	if ring, err := LoadKeyring(keyfile); err == nil {
+		version = ring.current + 1
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+
+	key, err := randomBytes(keySize)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyfile), 0700); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(keyfile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := fmt.Fprintf(f, "%d %s\n", version, hex.EncodeToString(key)); err != nil {
+		f.Close()
+		return 0, err
+	}
+	return version, f.Close()
+}
+
+type wrappedKey struct {
+	ID            uint32 `json:"id"`
+	MasterVersion int    `json:"masterVersion"`
+	Wrapped       []byte `json:"wrapped"`
+}
+
+type dataKeyFile struct {
+	Current uint32       `json:"current"`
+	Keys    []wrappedKey `json:"keys"`
+}
+
+// DataKeys is the set of data keys of one user, stored wrapped by the master
+// key in a file of their own, typically config.GetUserPath(user, ".datakey").
+// Files are sealed with AES-GCM under the current data key and name the key
+// they were sealed with, so rotated-out keys keep opening older files.
+type DataKeys struct {
+	ring *Keyring
+	path string
+
+	mu      sync.RWMutex
+	file    dataKeyFile
+	plain   map[uint32][]byte
+	current uint32
+}
+
+// OpenDataKeys loads the data keys stored at path, creating a first one when
+// the file does not exist yet.
+func OpenDataKeys(ring *Keyring, path string) (*DataKeys, error) {
+	keys := &DataKeys{ring: ring, path: path, plain: map[uint32][]byte{}}
+
+	raw, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		if err := keys.Rotate(); err != nil {
+			return nil, err
+		}
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &keys.file); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	for _, wk := range keys.file.Keys {
+		key, err := ring.unwrap(wk)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unwrap data key %d: %w", wk.ID, err)
+		}
+		keys.plain[wk.ID] = key
+	}
+	if _, ok := keys.plain[keys.file.Current]; !ok {
+		return nil, fmt.Errorf("%w: data key %d", ErrUnknownKey, keys.file.Current)
+	}
+	keys.current = keys.file.Current
+	return keys, nil
+}
+
+// Rotate adds a new data key and makes it current. Existing files stay
+// sealed with the key they were written with until Reencrypt rewrites them.
+func (k *DataKeys) Rotate() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key, err := randomBytes(keySize)
+	if err != nil {
+		return err
+	}
+	id := uint32(1)
+	for existing := range k.plain {
+		if existing >= id {
+			id = existing + 1
+		}
+	}
+	wk, err := k.ring.wrap(id, key)
+	if err != nil {
+		return err
+	}
+
+	file := k.file
+	file.Keys = append(append([]wrappedKey(nil), file.Keys...), wk)
+	file.Current = id
+	if err := k.save(file); err != nil {
+		return err
+	}
+	k.file = file
+	k.plain[id] = key
+	k.current = id
+	return nil
+}
+
+// Rewrap wraps every data key with the current master key, so older master
+// keys can be retired from the keyfile.
+func (k *DataKeys) Rewrap() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	file := dataKeyFile{Current: k.file.Current}
+	for _, old := range k.file.Keys {
+		wk, err := k.ring.wrap(old.ID, k.plain[old.ID])
+		if err != nil {
+			return err
+		}
+		file.Keys = append(file.Keys, wk)
+	}
+	if err := k.save(file); err != nil {
+		return err
+	}
+	k.file = file
+	return nil
+}
+
+func (k *DataKeys) save(file dataKeyFile) error {
+	raw, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(k.path), 0700); err != nil {
+		return err
+	}
+	tmp := k.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, k.path)
+}
+
+// Seal encrypts plain under the current data key. The output is the magic,
+// the key ID, the nonce and the ciphertext; magic and key ID are
+// authenticated as additional data.
+func (k *DataKeys) Seal(plain []byte) ([]byte, error) {
+	k.mu.RLock()
+	id, key := k.current, k.plain[k.current]
+	k.mu.RUnlock()
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := randomBytes(gcm.NonceSize())
+	if err != nil {
+		return nil, err
+	}
+
+	header := binary.BigEndian.AppendUint32(append([]byte(nil), sealedMagic...), id)
+	out := append(header, nonce...)
+	return gcm.Seal(out, nonce, plain, header), nil
+}
+
+// Open decrypts a file sealed by Seal with any of the user's data keys.
+func (k *DataKeys) Open(sealed []byte) ([]byte, error) {
+	headerLen := len(sealedMagic) + 4
+	if !isSealed(sealed) || len(sealed) < headerLen {
+		return nil, errors.New("not a sealed file")
+	}
+	header := sealed[:headerLen]
+	id := binary.BigEndian.Uint32(header[len(sealedMagic):])
+
+	k.mu.RLock()
+	key, ok := k.plain[id]
+	k.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: data key %d", ErrUnknownKey, id)
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	rest := sealed[headerLen:]
+	if len(rest) < gcm.NonceSize() {
+		return nil, errors.New("sealed file is truncated")
+	}
+	return gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], header)
+}
+
+func wrapAAD(id uint32) []byte {
+	return []byte("datakey:" + strconv.FormatUint(uint64(id), 10))
+}
+
+func (r *Keyring) wrap(id uint32, key []byte) (wrappedKey, error) {
+	gcm, err := newGCM(r.keys[r.current])
+	if err != nil {
+		return wrappedKey{}, err
+	}
+	nonce, err := randomBytes(gcm.NonceSize())
+	if err != nil {
+		return wrappedKey{}, err
+	}
+	return wrappedKey{
+		ID:            id,
+		MasterVersion: r.current,
+		Wrapped:       gcm.Seal(nonce, nonce, key, wrapAAD(id)),
+	}, nil
+}
+
+func (r *Keyring) unwrap(wk wrappedKey) ([]byte, error) {
+	master, ok := r.keys[wk.MasterVersion]
+	if !ok {
+		return nil, fmt.Errorf("%w: master key %d", ErrUnknownKey, wk.MasterVersion)
+	}
+	gcm, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wk.Wrapped) < gcm.NonceSize() {
+		return nil, errors.New("wrapped key is truncated")
+	}
+	nonce, sealed := wk.Wrapped[:gcm.NonceSize()], wk.Wrapped[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, wrapAAD(wk.ID))
+}
+
+// Reencrypt rewrites every item, so all of them end up sealed with the
+// current data key: after DataKeys.Rotate, or to seal a collection that was
+// plain JSON before encryption was enabled. Writes wait until it finishes.
+func (manager *Manager[T]) Reencrypt() (int, error) {
+	defer manager.gate.BeginWrite()()
+	manager.storageMu.Lock()
+	defer manager.storageMu.Unlock()
+
+	items, err := manager.storage.ReadAll(false)
+	if err != nil {
+		return 0, err
+	}
+	if len(items) == 0 {
+		return 0, nil
+	}
+	if err := errors.Join(manager.storage.UpdateItems(items)...); err != nil {
+		return 0, err
+	}
+	return len(items), nil
+}
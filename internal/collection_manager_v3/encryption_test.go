@@ -0,0 +1,117 @@
+package collection_manager_v3
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedCollectionNeedsItsKeys(t *testing.T) {
+	dir := t.TempDir()
+	keys := testDataKeys(t, filepath.Join(dir, "alice"))
+	other := testDataKeys(t, filepath.Join(dir, "bob"))
+
+	for _, name := range []string{"notes", "notes.json"} {
+		path := filepath.Join(dir, name)
+		manager, err := NewCollectionManager[*note](path, false, WithEncryption(keys))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := manager.CreateWithID(&note{ID: "a", Title: "secret"}); err != nil {
+			t.Fatal(err)
+		}
+
+		reopened, err := NewCollectionManager[*note](path, true, WithEncryption(keys))
+		if err != nil {
+			t.Fatalf("%s: reopen with its keys: %v", name, err)
+		}
+		if got, err := reopened.Get("a"); err != nil || got.Title != "secret" {
+			t.Fatalf("%s: Get = %+v, %v", name, got, err)
+		}
+
+		// Another user's data key has the same ID but is a different key.
+		if _, err := NewCollectionManager[*note](path, true, WithEncryption(other)); err == nil {
+			t.Fatalf("%s: opened with another user's keys", name)
+		}
+		if _, err := NewCollectionManager[*note](path, true); err == nil || !strings.Contains(err.Error(), "no key") {
+			t.Fatalf("%s: opened without keys: %v", name, err)
+		}
+	}
+}
+
+func TestRotatedOutDataKeyIsUnknown(t *testing.T) {
+	dir := t.TempDir()
+	keys := testDataKeys(t, dir)
+	keyPath := filepath.Join(dir, ".datakey")
+	before, err := os.ReadFile(keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := keys.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "notes")
+	manager, err := NewCollectionManager[*note](path, false, WithEncryption(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.CreateWithID(&note{ID: "a", Title: "secret"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A key file restored from before the rotation lacks the key the item
+	// was sealed with.
+	if err := os.WriteFile(keyPath, before, 0600); err != nil {
+		t.Fatal(err)
+	}
+	ring, err := LoadKeyring(filepath.Join(dir, "keys", "master.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale, err := OpenDataKeys(ring, keyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewCollectionManager[*note](path, true, WithEncryption(stale)); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("opened with a rotated-out key set: %v", err)
+	}
+}
+
+func TestDataKeysNeedTheirMasterKey(t *testing.T) {
+	dir := t.TempDir()
+	keyfile := filepath.Join(dir, "master.key")
+	for range 2 {
+		if _, err := AddMasterKey(keyfile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ring, err := LoadKeyring(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, ".datakey")
+	if _, err := OpenDataKeys(ring, keyPath); err != nil {
+		t.Fatal(err)
+	}
+
+	// Retiring master key 2 before the data keys were rewrapped with
+	// another leaves them unreadable.
+	lines, err := os.ReadFile(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _, _ := strings.Cut(string(lines), "\n")
+	if err := os.WriteFile(keyfile, []byte(first+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	retired, err := LoadKeyring(keyfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDataKeys(retired, keyPath); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("data keys opened without their master key: %v", err)
+	}
+}
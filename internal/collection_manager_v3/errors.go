@@ -0,0 +1,16 @@
+package collection_manager_v3
+
+import "errors"
+
+var (
+	ErrMissingID   = errors.New("item has no ID")
+	ErrDuplicateID = errors.New("item ID already exists")
+	ErrInvalidID   = errors.New("item ID cannot name a file")
+
+	// ErrItemNotFound is what every storage reports for an update or delete
+	// of an item it does not hold.
+	ErrItemNotFound = errors.New("item not found")
+
+	ErrLazyNeedsDirectory   = errors.New("lazy loading needs a directory collection")
+	ErrEncryptionNeedsFiles = errors.New("encryption needs a file or directory collection")
+)
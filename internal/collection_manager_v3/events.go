@@ -0,0 +1,45 @@
+package collection_manager_v3
+
+import "sync"
+
+// ChangeOp names the kind of change a ChangeEvent reports.
+type ChangeOp string
+
+const (
+	ChangeCreate ChangeOp = "create"
+	ChangeUpdate ChangeOp = "update"
+	ChangeDelete ChangeOp = "delete"
+	ChangeExpire ChangeOp = "expire"
+)
+
+// ChangeEvent is delivered to OnChange listeners after a change has been
+// persisted. For deletes and expiries, Item is the item as it was before
+// removal, or the zero value if the manager did not know it.
+type ChangeEvent[T CollectionItem] struct {
+	Op   ChangeOp
+	ID   string
+	Item T
+}
+
+type listeners[T CollectionItem] struct {
+	mu  sync.RWMutex
+	fns []func(ChangeEvent[T])
+}
+
+// OnChange registers fn to be called synchronously after every successful
+// create, update and delete, including the bulk forms.
+func (manager *Manager[T]) OnChange(fn func(ChangeEvent[T])) {
+	manager.listeners.mu.Lock()
+	defer manager.listeners.mu.Unlock()
+	manager.listeners.fns = append(manager.listeners.fns, fn)
+}
+
+func (manager *Manager[T]) emit(op ChangeOp, id string, item T) {
+	manager.listeners.mu.RLock()
+	fns := manager.listeners.fns
+	manager.listeners.mu.RUnlock()
+
+	for _, fn := range fns {
+		fn(ChangeEvent[T]{Op: op, ID: id, Item: item})
+	}
+}
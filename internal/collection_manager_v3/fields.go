@@ -0,0 +1,171 @@
+package collection_manager_v3
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+)
+
+// jsonFieldType finds the Go type behind a JSON field path of t.
+func jsonFieldType(t reflect.Type, path []string) (reflect.Type, bool) {
+	for _, name := range path {
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Struct:
+			f, ok := structFieldByJSONName(t, name)
+			if !ok {
+				return nil, false
+			}
+			t = f.Type
+		case reflect.Map:
+			t = t.Elem()
+		default:
+			return nil, false
+		}
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t, true
+}
+
+// structFieldByJSONName finds the field encoding/json would use for name,
+// looking through embedded structs.
+func structFieldByJSONName(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		tagName, _, _ := strings.Cut(tag, ",")
+		if f.Anonymous && tagName == "" {
+			embedded := f.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				if inner, ok := structFieldByJSONName(embedded, name); ok {
+					inner.Index = append([]int{i}, inner.Index...)
+					return inner, true
+				}
+			}
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if tagName == "" {
+			tagName = f.Name
+		}
+		if tagName == name || (tag == "" && strings.EqualFold(f.Name, name)) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func toJSONMap(v any) (map[string]any, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	row := map[string]any{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	return row, dec.Decode(&row)
+}
+
+func lookupPath(row map[string]any, path string) any {
+	var cur any = row
+	for _, key := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil
+		}
+		cur = m[key]
+	}
+	return cur
+}
+
+func setPath(row map[string]any, path string, v any) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := row[key].(map[string]any)
+		if !ok {
+			next = map[string]any{}
+			row[key] = next
+		}
+		row = next
+	}
+	row[keys[len(keys)-1]] = v
+}
+
+// fieldValue walks a JSON field path through structs, maps, pointers and
+// interfaces. It reports false when any step is missing or nil.
+func fieldValue(v reflect.Value, path []string) (reflect.Value, bool) {
+	for _, name := range path {
+		v = indirect(v)
+		if !v.IsValid() {
+			return reflect.Value{}, false
+		}
+		switch v.Kind() {
+		case reflect.Struct:
+			f, ok := structFieldByJSONName(v.Type(), name)
+			if !ok {
+				return reflect.Value{}, false
+			}
+			fv, err := v.FieldByIndexErr(f.Index)
+			if err != nil {
+				return reflect.Value{}, false
+			}
+			v = fv
+		case reflect.Map:
+			if v.Type().Key().Kind() != reflect.String {
+				return reflect.Value{}, false
+			}
+			v = v.MapIndex(reflect.ValueOf(name).Convert(v.Type().Key()))
+		default:
+			return reflect.Value{}, false
+		}
+	}
+	v = indirect(v)
+	return v, v.IsValid()
+}
+
+func indirect(v reflect.Value) reflect.Value {
+	for v.IsValid() && (v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface) {
+		if v.IsNil() {
+			return reflect.Value{}
+		}
+		v = v.Elem()
+	}
+	return v
+}
+
+// checkFieldPath reports whether path can exist on values of type t. Paths
+// that pass through maps or interfaces can only be checked at runtime and
+// are accepted.
+func checkFieldPath(t reflect.Type, path []string) bool {
+	for _, name := range path {
+		for t.Kind() == reflect.Pointer {
+			t = t.Elem()
+		}
+		switch t.Kind() {
+		case reflect.Struct:
+			f, ok := structFieldByJSONName(t, name)
+			if !ok {
+				return false
+			}
+			t = f.Type
+		case reflect.Map, reflect.Interface:
+			return true
+		default:
+			return false
+		}
+	}
+	return true
+}
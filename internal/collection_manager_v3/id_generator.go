@@ -0,0 +1,133 @@
+package collection_manager_v3
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+// UUIDv7Generator issues time-ordered UUIDv7 strings. It is the default.
+type UUIDv7Generator struct{}
+
+func (UUIDv7Generator) NewID() (string, error) {
+	u7, err := uuid.NewV7()
+	if err != nil {
+		return "", fmt.Errorf("error generating UUIDv7: %w", err)
+	}
+	return u7.String(), nil
+}
+
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULIDGenerator issues 26 character ULIDs: a 48 bit millisecond timestamp
+// followed by 80 random bits, Crockford base32 encoded.
+type ULIDGenerator struct {
+	Clock Clock
+}
+
+func (g ULIDGenerator) NewID() (string, error) {
+	var raw [16]byte
+	ms := uint64(clockOrSystem(g.Clock).Now().UnixMilli())
+	raw[0] = byte(ms >> 40)
+	raw[1] = byte(ms >> 32)
+	binary.BigEndian.PutUint32(raw[2:6], uint32(ms))
+	if _, err := rand.Read(raw[6:]); err != nil {
+		return "", fmt.Errorf("error generating ULID: %w", err)
+	}
+	return encodeBase(raw[:], crockfordAlphabet, 26), nil
+}
+
+const (
+	base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	ksuidEpoch     = 1400000000
+)
+
+// KSUIDGenerator issues 27 character KSUIDs: a 32 bit second timestamp
+// relative to the KSUID epoch followed by 128 random bits, base62 encoded.
+type KSUIDGenerator struct {
+	Clock Clock
+}
+
+func (g KSUIDGenerator) NewID() (string, error) {
+	var raw [20]byte
+	ts := clockOrSystem(g.Clock).Now().Unix() - ksuidEpoch
+	if ts < 0 {
+		return "", errors.New("error generating KSUID: time before KSUID epoch")
+	}
+	binary.BigEndian.PutUint32(raw[:4], uint32(ts))
+	if _, err := rand.Read(raw[4:]); err != nil {
+		return "", fmt.Errorf("error generating KSUID: %w", err)
+	}
+	return encodeBase(raw[:], base62Alphabet, 27), nil
+}
+
+// NaturalKey derives each ID from the item being created, for collections
+// keyed by something the caller already has, such as a phone number or a
+// settings key. Create fails with ErrDuplicateID if the key is taken, and
+// with ErrInvalidID if it could not name a file inside the collection.
+func NaturalKey(key func(item CollectionItem) (string, error)) IDGenerator {
+	return naturalKeyGenerator{key: key}
+}
+
+type naturalKeyGenerator struct {
+	key func(item CollectionItem) (string, error)
+}
+
+func (naturalKeyGenerator) NewID() (string, error) {
+	return "", errors.New("natural key generator needs the item")
+}
+
+func (g naturalKeyGenerator) NewIDFor(item CollectionItem) (string, error) {
+	id, err := g.key(item)
+	if err != nil {
+		return "", err
+	}
+	if err := checkID(id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// checkID fails for IDs that cannot safely name the item's file: empty ones,
+// ones that could reach outside the collection directory, ones starting with
+// a dot, whose files would pass for hidden ones, and ones holding whitespace
+// or control characters, which would break the "<id> <sum>" lines of the
+// checksum log.
+func checkID(id string) error {
+	if id == "" {
+		return ErrMissingID
+	}
+	if strings.HasPrefix(id, ".") || strings.ContainsAny(id, "/\\") || strings.Contains(id, "..") ||
+		strings.IndexFunc(id, func(r rune) bool { return unicode.IsSpace(r) || unicode.IsControl(r) }) >= 0 {
+		return fmt.Errorf("%w: %q", ErrInvalidID, id)
+	}
+	return nil
+}
+
+// encodeBase renders raw as a big-endian number in the given alphabet,
+// left padded with the zero digit to width characters.
+func encodeBase(raw []byte, alphabet string, width int) string {
+	n := new(big.Int).SetBytes(raw)
+	base := big.NewInt(int64(len(alphabet)))
+	mod := new(big.Int)
+
+	out := make([]byte, width)
+	for i := width - 1; i >= 0; i-- {
+		n.DivMod(n, base, mod)
+		out[i] = alphabet[mod.Int64()]
+	}
+	return string(out)
+}
+
+func clockOrSystem(clock Clock) Clock {
+	if clock == nil {
+		return systemClock{}
+	}
+	return clock
+}
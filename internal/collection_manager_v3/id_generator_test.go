@@ -0,0 +1,139 @@
+package collection_manager_v3
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var badIDs = []string{"", "..", ".hidden", "../../escaped", "a/b", `a\b`, "a\x00b", "a b", "a\nb", "a\tb", "a\u00a0b"}
+
+func TestCreateWithIDRefusesUnsafeIDs(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "notes")
+	manager, err := NewCollectionManager[*note](dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range badIDs {
+		if _, err := manager.CreateWithID(&note{ID: id}); err == nil {
+			t.Errorf("CreateWithID(%q) succeeded", id)
+		} else if id != "" && !errors.Is(err, ErrInvalidID) {
+			t.Errorf("CreateWithID(%q): err = %v, want ErrInvalidID", id, err)
+		}
+	}
+
+	var batch []*note
+	for _, id := range badIDs {
+		batch = append(batch, &note{ID: id})
+	}
+	batch = append(batch, &note{ID: "fine"})
+	results, _ := manager.CreateManyWithID(batch)
+	for i, r := range results[:len(badIDs)] {
+		if r.Err == nil {
+			t.Errorf("CreateManyWithID kept %q", badIDs[i])
+		}
+	}
+	if last := results[len(results)-1]; last.Err != nil {
+		t.Fatalf("CreateManyWithID refused a valid ID: %v", last.Err)
+	}
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "notes" {
+		t.Fatalf("files written outside the collection: %v", entries)
+	}
+	if _, err := manager.Get("fine"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnsafeIDsCannotReachOutsideTheCollection(t *testing.T) {
+	root := t.TempDir()
+	outside := filepath.Join(root, "x.json")
+	if err := os.WriteFile(outside, []byte(`{"id":"../x","title":"outside"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, lazy := range []bool{false, true} {
+		var opts []Option
+		if lazy {
+			opts = append(opts, WithLazyLoading(1<<20))
+		}
+		manager, err := NewCollectionManager[*note](filepath.Join(root, "notes"), false, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := manager.Get("../x"); !errors.Is(err, ErrInvalidID) {
+			t.Errorf("lazy=%v Get: err = %v, want ErrInvalidID", lazy, err)
+		}
+		if _, err := manager.Update(&note{ID: "../x", Title: "overwritten"}); !errors.Is(err, ErrInvalidID) {
+			t.Errorf("lazy=%v Update: err = %v, want ErrInvalidID", lazy, err)
+		}
+		if _, err := manager.UpdateMany([]*note{{ID: "../x", Title: "overwritten"}}); !errors.Is(err, ErrInvalidID) {
+			t.Errorf("lazy=%v UpdateMany: err = %v, want ErrInvalidID", lazy, err)
+		}
+		if err := manager.Delete("../x"); !errors.Is(err, ErrInvalidID) {
+			t.Errorf("lazy=%v Delete: err = %v, want ErrInvalidID", lazy, err)
+		}
+		if _, err := manager.DeleteMany([]string{"../x"}); !errors.Is(err, ErrInvalidID) {
+			t.Errorf("lazy=%v DeleteMany: err = %v, want ErrInvalidID", lazy, err)
+		}
+		if _, err := manager.GetMany([]string{"../x"}); !errors.Is(err, ErrInvalidID) {
+			t.Errorf("lazy=%v GetMany: err = %v, want ErrInvalidID", lazy, err)
+		}
+	}
+
+	data, err := os.ReadFile(outside)
+	if err != nil {
+		t.Fatalf("file outside the collection: %v", err)
+	}
+	if string(data) != `{"id":"../x","title":"outside"}` {
+		t.Fatalf("file outside the collection changed: %s", data)
+	}
+}
+
+func TestSequentialIDs(t *testing.T) {
+	manager, _, clock := newTestManager(t)
+	first, err := manager.Create(&note{Title: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := manager.Create(&note{Title: "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ID == second.ID || first.ID == "" {
+		t.Fatalf("IDs %q and %q", first.ID, second.ID)
+	}
+	if !first.CreatedAt.Equal(clock.Now()) {
+		t.Fatalf("CreatedAt = %v, want the fake clock's %v", first.CreatedAt, clock.Now())
+	}
+}
+
+func TestNaturalKeyRefusesUnsafeKeys(t *testing.T) {
+	byTitle := NaturalKey(func(item CollectionItem) (string, error) {
+		return item.(*note).Title, nil
+	})
+	manager, _, _ := newTestManager(t, WithIDGenerator(byTitle))
+
+	for _, title := range badIDs {
+		if _, err := manager.Create(&note{Title: title}); err == nil {
+			t.Errorf("Create with key %q succeeded", title)
+		}
+	}
+	created, err := manager.Create(&note{Title: "settings"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID != "settings" {
+		t.Fatalf("ID = %q", created.ID)
+	}
+	if _, err := manager.Create(&note{Title: "settings"}); !errors.Is(err, ErrDuplicateID) {
+		t.Fatalf("second Create: err = %v, want ErrDuplicateID", err)
+	}
+}
@@ -0,0 +1,220 @@
+package collection_manager_v3
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+)
+
+// itemSet is the in-memory view a Manager keeps of its items. The default
+// is a registery.Registry holding every item; lazyItems holds only IDs.
+type itemSet[T CollectionItem] interface {
+	Register(key string, value T)
+	Update(key string, value T)
+	Delete(key string)
+	Get(key string) (T, error)
+	GetAllValues() []T
+}
+
+type lazyEntry[T CollectionItem] struct {
+	id   string
+	item T
+	size int64
+}
+
+// lazyItems indexes a directory collection by ID and caches item bodies in
+// an LRU bounded by the total size of their JSON.
+type lazyItems[T CollectionItem] struct {
+	dir    *directoryStorage[T]
+	budget int64
+
+	mu    sync.Mutex
+	ids   map[string]struct{}
+	lru   *list.List // front is most recently used
+	cache map[string]*list.Element
+	used  int64
+}
+
+func newLazyItems[T CollectionItem](dir *directoryStorage[T], budget int64, requireExist bool) (*lazyItems[T], error) {
+	ids, err := dir.ListIDs(requireExist)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &lazyItems[T]{
+		dir:    dir,
+		budget: budget,
+		ids:    make(map[string]struct{}, len(ids)),
+		lru:    list.New(),
+		cache:  map[string]*list.Element{},
+	}
+	for _, id := range ids {
+		l.ids[id] = struct{}{}
+	}
+	return l, nil
+}
+
+func (l *lazyItems[T]) Register(key string, value T) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.ids[key] = struct{}{}
+	l.cacheLocked(key, value, encodedSize(value))
+}
+
+func (l *lazyItems[T]) Update(key string, value T) {
+	l.Register(key, value)
+}
+
+func (l *lazyItems[T]) Delete(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.ids, key)
+	l.evictLocked(key)
+}
+
+// errKeyNotFound is what a lookup of an unknown ID fails with, matching
+// the error of registery.Registry so both item sets report alike.
+var errKeyNotFound = errors.New("key not found")
+
+func (l *lazyItems[T]) Get(key string) (T, error) {
+	l.mu.Lock()
+	if _, ok := l.ids[key]; !ok {
+		l.mu.Unlock()
+		var zero T
+		return zero, errKeyNotFound
+	}
+	if el, ok := l.cache[key]; ok {
+		l.lru.MoveToFront(el)
+		item := el.Value.(*lazyEntry[T]).item
+		l.mu.Unlock()
+		return item, nil
+	}
+	l.mu.Unlock()
+
+	item, size, err := l.load(key)
+	if errors.Is(err, os.ErrNotExist) {
+		// Deleted since the index was checked.
+		var zero T
+		return zero, errKeyNotFound
+	}
+	if err != nil {
+		return item, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.ids[key]; !ok {
+		return item, nil
+	}
+	// Another Get or an Update may have cached the item meanwhile; theirs
+	// is at least as recent as what was read here.
+	if el, ok := l.cache[key]; ok {
+		l.lru.MoveToFront(el)
+		return el.Value.(*lazyEntry[T]).item, nil
+	}
+	l.cacheLocked(key, item, size)
+	return item, nil
+}
+
+// GetAllValues reads every item, in ID order. Items not already cached are
+// read from disk without being cached, so a scan does not flush the LRU.
+func (l *lazyItems[T]) GetAllValues() []T {
+	items := make([]T, 0, l.Len())
+	l.each(func(item T) error {
+		items = append(items, item)
+		return nil
+	})
+	return items
+}
+
+// each calls fn with every item in ID order, reading the ones not cached
+// from disk one at a time, and stops at the first error fn returns. Items
+// that can no longer be read, usually because they were deleted meanwhile,
+// are skipped.
+func (l *lazyItems[T]) each(fn func(T) error) error {
+	l.mu.Lock()
+	ids := make([]string, 0, len(l.ids))
+	for id := range l.ids {
+		ids = append(ids, id)
+	}
+	l.mu.Unlock()
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		l.mu.Lock()
+		el, cached := l.cache[id]
+		var item T
+		if cached {
+			item = el.Value.(*lazyEntry[T]).item
+		}
+		l.mu.Unlock()
+
+		if !cached {
+			var err error
+			if item, _, err = l.load(id); err != nil {
+				continue
+			}
+		}
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Has reports whether id is indexed, without loading the item.
+func (l *lazyItems[T]) Has(id string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, ok := l.ids[id]
+	return ok
+}
+
+// Len reports how many items the index holds.
+func (l *lazyItems[T]) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.ids)
+}
+
+func (l *lazyItems[T]) load(id string) (T, int64, error) {
+	item, err := l.dir.readItem(id)
+	if err != nil {
+		return item, 0, err
+	}
+	return item, encodedSize(item), nil
+}
+
+func (l *lazyItems[T]) cacheLocked(id string, item T, size int64) {
+	l.evictLocked(id)
+	if size > l.budget {
+		return
+	}
+	l.cache[id] = l.lru.PushFront(&lazyEntry[T]{id: id, item: item, size: size})
+	l.used += size
+	for l.used > l.budget {
+		oldest := l.lru.Back()
+		l.evictLocked(oldest.Value.(*lazyEntry[T]).id)
+	}
+}
+
+func (l *lazyItems[T]) evictLocked(id string) {
+	el, ok := l.cache[id]
+	if !ok {
+		return
+	}
+	l.lru.Remove(el)
+	delete(l.cache, id)
+	l.used -= el.Value.(*lazyEntry[T]).size
+}
+
+func encodedSize(v any) int64 {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return 0
+	}
+	return int64(len(raw))
+}
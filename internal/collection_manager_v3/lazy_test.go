@@ -0,0 +1,132 @@
+package collection_manager_v3
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// newTestLazyItems returns lazyItems over a directory holding the notes
+// n1..n<count>, all of the same encoded size, and that size.
+func newTestLazyItems(t *testing.T, count int, budgetItems float64) (*lazyItems[*note], int64) {
+	t.Helper()
+	dir := newDirectoryStorage[*note](filepath.Join(t.TempDir(), "notes"))
+	for i := 1; i <= count; i++ {
+		n := &note{ID: fmt.Sprintf("n%d", i), Title: "same length"}
+		if err := dir.CreateItem(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := encodedSize(&note{ID: "n1", Title: "same length"})
+	l, err := newLazyItems(dir, int64(budgetItems*float64(size)), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l, size
+}
+
+func cachedIDs[T CollectionItem](l *lazyItems[T]) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var ids []string
+	for el := l.lru.Front(); el != nil; el = el.Next() {
+		ids = append(ids, el.Value.(*lazyEntry[T]).id)
+	}
+	return ids
+}
+
+func TestLazyItemsEvictLeastRecentlyUsed(t *testing.T) {
+	l, size := newTestLazyItems(t, 4, 2.5)
+
+	for _, id := range []string{"n1", "n2"} {
+		if _, err := l.Get(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := cachedIDs(l); !reflect.DeepEqual(got, []string{"n2", "n1"}) {
+		t.Fatalf("cached %v", got)
+	}
+
+	// Touching n1 makes n2 the one to go when n3 is loaded.
+	if _, err := l.Get("n1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Get("n3"); err != nil {
+		t.Fatal(err)
+	}
+	if got := cachedIDs(l); !reflect.DeepEqual(got, []string{"n3", "n1"}) {
+		t.Fatalf("cached %v after eviction", got)
+	}
+	if l.used != 2*size || l.used > l.budget {
+		t.Fatalf("used %d of %d, want %d", l.used, l.budget, 2*size)
+	}
+
+	// Registering counts against the budget as well.
+	l.Register("n5", &note{ID: "n5", Title: "same length"})
+	if got := cachedIDs(l); !reflect.DeepEqual(got, []string{"n5", "n3"}) {
+		t.Fatalf("cached %v after Register", got)
+	}
+	l.Delete("n3")
+	if got := cachedIDs(l); !reflect.DeepEqual(got, []string{"n5"}) || l.used != size {
+		t.Fatalf("cached %v using %d after Delete", got, l.used)
+	}
+}
+
+func TestLazyItemsSkipItemsAboveBudget(t *testing.T) {
+	l, _ := newTestLazyItems(t, 1, 0.5)
+	item, err := l.Get("n1")
+	if err != nil || item.ID != "n1" {
+		t.Fatalf("Get: %+v, %v", item, err)
+	}
+	if got := cachedIDs(l); len(got) != 0 || l.used != 0 {
+		t.Fatalf("cached %v using %d, over budget %d", got, l.used, l.budget)
+	}
+}
+
+func TestLazyItemsScanLeavesCacheAlone(t *testing.T) {
+	l, _ := newTestLazyItems(t, 4, 2)
+	if _, err := l.Get("n2"); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, item := range l.GetAllValues() {
+		ids = append(ids, item.ID)
+	}
+	if !sort.StringsAreSorted(ids) || len(ids) != 4 {
+		t.Fatalf("GetAllValues = %v, want all four in ID order", ids)
+	}
+	if got := cachedIDs(l); !reflect.DeepEqual(got, []string{"n2"}) {
+		t.Fatalf("scan changed the cache to %v", got)
+	}
+
+	// An item gone from disk is skipped by scans and not found by Get.
+	if err := os.Remove(l.dir.itemPath("n3")); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(l.GetAllValues()); n != 3 {
+		t.Fatalf("scan found %d items, want 3", n)
+	}
+	if _, err := l.Get("n3"); err != errKeyNotFound {
+		t.Fatalf("Get of a removed item: %v", err)
+	}
+}
+
+func TestLazyItemsNotFoundMatchesRegistry(t *testing.T) {
+	eager, err := NewCollectionManager[*note](filepath.Join(t.TempDir(), "eager"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lazy, err := NewCollectionManager[*note](filepath.Join(t.TempDir(), "lazy"), false, WithLazyLoading(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, eagerErr := eager.Get("missing")
+	_, lazyErr := lazy.Get("missing")
+	if eagerErr == nil || lazyErr == nil || eagerErr.Error() != lazyErr.Error() {
+		t.Fatalf("not found: eager %v, lazy %v", eagerErr, lazyErr)
+	}
+}
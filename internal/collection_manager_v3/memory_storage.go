@@ -0,0 +1,160 @@
+package collection_manager_v3
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// MemoryStorage keeps a collection in process memory instead of on disk.
+// Items are stored JSON encoded, so they round-trip exactly as they would
+// through singleFileStorage or directoryStorage, and writes can be made to
+// fail on demand to exercise error paths.
+type MemoryStorage[T CollectionItem] struct {
+	mu       sync.Mutex
+	order    []string
+	data     map[string][]byte
+	writes   int
+	failNext []error
+	failAll  error
+}
+
+// NewMemoryStorage returns an empty MemoryStorage seeded with items.
+func NewMemoryStorage[T CollectionItem](items ...T) (*MemoryStorage[T], error) {
+	m := &MemoryStorage[T]{data: make(map[string][]byte)}
+	for _, item := range items {
+		if err := m.put(item); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// NewMemoryCollectionManager returns a Manager backed by store, loading the
+// items it already holds.
+func NewMemoryCollectionManager[T CollectionItem](store *MemoryStorage[T], opts ...Option) (*Manager[T], error) {
+	return newManager[T](store, false, opts)
+}
+
+// FailNextWrite makes the next write fail with err. Calls queue up, so
+// FailNextWrite(a); FailNextWrite(b) fails the next two writes in order.
+func (m *MemoryStorage[T]) FailNextWrite(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failNext = append(m.failNext, err)
+}
+
+// FailWrites makes every write fail with err until called again with nil.
+func (m *MemoryStorage[T]) FailWrites(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failAll = err
+}
+
+// Writes reports how many writes have reached the storage, failed or not.
+func (m *MemoryStorage[T]) Writes() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.writes
+}
+
+// Len reports how many items are stored.
+func (m *MemoryStorage[T]) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.order)
+}
+
+func (m *MemoryStorage[T]) ReadAll(requireExist bool) ([]T, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	items := make([]T, 0, len(m.order))
+	for _, id := range m.order {
+		item, err := m.decode(id)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func (m *MemoryStorage[T]) CreateItem(item T) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.beginWrite(); err != nil {
+		return err
+	}
+	return m.put(item)
+}
+
+func (m *MemoryStorage[T]) UpdateItem(item T) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.beginWrite(); err != nil {
+		return err
+	}
+	if _, ok := m.data[item.GetID()]; !ok {
+		return fmt.Errorf("%w: %s", ErrItemNotFound, item.GetID())
+	}
+	return m.put(item)
+}
+
+func (m *MemoryStorage[T]) DeleteItem(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.beginWrite(); err != nil {
+		return err
+	}
+	return m.remove(id)
+}
+
+// beginWrite counts a write and returns the injected fault for it, if any.
+func (m *MemoryStorage[T]) beginWrite() error {
+	m.writes++
+	if len(m.failNext) > 0 {
+		err := m.failNext[0]
+		m.failNext = m.failNext[1:]
+		return err
+	}
+	return m.failAll
+}
+
+func (m *MemoryStorage[T]) put(item T) error {
+	raw, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	id := item.GetID()
+	if _, ok := m.data[id]; !ok {
+		m.order = append(m.order, id)
+	}
+	m.data[id] = raw
+	return nil
+}
+
+func (m *MemoryStorage[T]) remove(id string) error {
+	if _, ok := m.data[id]; !ok {
+		return fmt.Errorf("%w: %s", ErrItemNotFound, id)
+	}
+	delete(m.data, id)
+	for i, existing := range m.order {
+		if existing == id {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *MemoryStorage[T]) decode(id string) (T, error) {
+	var item T
+	if err := json.Unmarshal(m.data[id], &item); err != nil {
+		return item, err
+	}
+	return item, nil
+}
@@ -0,0 +1,129 @@
+package collection_manager_v3
+
+import (
+	"time"
+)
+
+// Clock supplies the timestamps a Manager stamps on items in Create and Update.
+type Clock interface {
+	Now() time.Time
+}
+
+// IDGenerator supplies the identifiers a Manager assigns to new items in Create.
+type IDGenerator interface {
+	NewID() (string, error)
+}
+
+// ItemIDGenerator is implemented by generators that derive the ID from the
+// item itself, such as NaturalKey. Create prefers NewIDFor over NewID when the
+// configured generator implements it.
+type ItemIDGenerator interface {
+	IDGenerator
+	NewIDFor(item CollectionItem) (string, error)
+}
+
+// WriteGate coordinates a Manager's writes with something that must not see
+// them half done, such as a snapshot of the data tree. BeginWrite may be
+// called while another write of the same goroutine is in progress.
+type WriteGate interface {
+	BeginWrite() (end func())
+}
+
+type noGate struct{}
+
+func (noGate) BeginWrite() func() { return func() {} }
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+type options struct {
+	clock Clock
+	ids   IDGenerator
+	ttl   time.Duration
+
+	lazyBudget int64
+	shardDepth int // -1 keeps the layout found on disk
+	cipher     Cipher
+	gate       WriteGate
+}
+
+// Option configures a Manager at construction time.
+type Option func(*options)
+
+// WithClock replaces time.Now as the source of CreatedAt and UpdatedAt.
+func WithClock(clock Clock) Option {
+	return func(o *options) {
+		o.clock = clock
+	}
+}
+
+// WithIDGenerator replaces UUIDv7Generator as the source of item IDs.
+func WithIDGenerator(ids IDGenerator) Option {
+	return func(o *options) {
+		o.ids = ids
+	}
+}
+
+// WithTTL makes items expire ttl after their CreatedAt, unless the item
+// reports its own expiry through Expirer.
+func WithTTL(ttl time.Duration) Option {
+	return func(o *options) {
+		o.ttl = ttl
+	}
+}
+
+// WithLazyLoading keeps only the item IDs of a directory collection in memory
+// and loads item bodies on demand into an LRU cache of about budgetBytes of
+// JSON. Lookups by ID stay cheap; scans such as GetAll and GetList read every
+// uncached item from disk.
+func WithLazyLoading(budgetBytes int64) Option {
+	return func(o *options) {
+		o.lazyBudget = budgetBytes
+	}
+}
+
+// WithShardedLayout stores each item of a directory collection under depth
+// levels of two-character directories derived from a hash of its ID, e.g.
+// 3f/a2/<id>.json for depth 2, so no directory grows too large. A collection
+// found in another layout is migrated when opened; depth 0 restores the flat
+// layout. Without this option the layout recorded on disk is kept.
+func WithShardedLayout(depth int) Option {
+	return func(o *options) {
+		o.shardDepth = depth
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		clock: systemClock{},
+		ids:   UUIDv7Generator{},
+		gate:  noGate{},
+
+		shardDepth: -1,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithEncryption seals the collection files on disk with c, usually the
+// DataKeys of the user owning the collection. Plain files already there are
+// still read and get sealed when next written.
+func WithEncryption(c Cipher) Option {
+	return func(o *options) {
+		o.cipher = c
+	}
+}
+
+// WithWriteGate makes every write, conversion and re-encryption of the
+// collection pass through gate, typically snapshot.DefaultGate for
+// collections inside the data tree.
+func WithWriteGate(gate WriteGate) Option {
+	return func(o *options) {
+		o.gate = gate
+	}
+}
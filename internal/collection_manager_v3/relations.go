@@ -0,0 +1,362 @@
+package collection_manager_v3
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// OnDelete decides what happens to referencing items when the item they
+// reference is deleted.
+type OnDelete string
+
+const (
+	// Restrict refuses the delete while any item still references it.
+	Restrict OnDelete = "restrict"
+	// Cascade deletes the referencing items too.
+	Cascade OnDelete = "cascade"
+	// SetNull clears the reference, removing it from ID lists.
+	SetNull OnDelete = "set-null"
+)
+
+var (
+	ErrRestricted      = errors.New("item is still referenced")
+	ErrUnknownRelation = errors.New("unknown relation")
+	ErrUnknownOnDelete = errors.New("unknown on-delete policy")
+	ErrSetNullNeedsRef = errors.New("set-null needs a pointer or map item type")
+)
+
+// dependent is the parent-side view of a relation declared with Reference.
+type dependent interface {
+	restricted(id string) error
+	release(ids []string) error
+}
+
+// reference is the child-side view of a relation, used by Expand.
+type reference struct {
+	path    []string
+	resolve func(id string) (any, bool)
+}
+
+type relations struct {
+	mu         sync.RWMutex
+	dependents []dependent
+	references map[string]reference
+}
+
+// Reference declares that field of child items (a dotted JSON path holding
+// an ID or a list of IDs) references items of parent. Deleting a parent item
+// then applies onDelete to the children referencing it, and child reads can
+// expand the field with Expand. Relations must not form cycles. SetNull
+// clears the field through reflection, so it needs C to be a pointer or map
+// type.
+func Reference[C CollectionItem, P CollectionItem](child *Manager[C], field string, parent *Manager[P], onDelete OnDelete) error {
+	switch onDelete {
+	case Restrict, Cascade, SetNull:
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownOnDelete, onDelete)
+	}
+	if kind := reflect.TypeOf((*C)(nil)).Elem().Kind(); onDelete == SetNull && kind != reflect.Pointer && kind != reflect.Map {
+		return fmt.Errorf("%w: %s", ErrSetNullNeedsRef, field)
+	}
+
+	path := strings.Split(field, ".")
+	if !checkFieldPath(reflect.TypeOf((*C)(nil)).Elem(), path) {
+		return fmt.Errorf("%w: %s", ErrUnknownRelation, field)
+	}
+
+	rel := &relation[C]{child: child, field: field, path: path, onDelete: onDelete}
+
+	parent.relations.mu.Lock()
+	parent.relations.dependents = append(parent.relations.dependents, rel)
+	parent.relations.mu.Unlock()
+
+	child.relations.mu.Lock()
+	defer child.relations.mu.Unlock()
+	if child.relations.references == nil {
+		child.relations.references = map[string]reference{}
+	}
+	child.relations.references[field] = reference{
+		path: path,
+		resolve: func(id string) (any, bool) {
+			item, err := parent.Get(id)
+			return item, err == nil
+		},
+	}
+	return nil
+}
+
+type relation[C CollectionItem] struct {
+	child    *Manager[C]
+	field    string
+	path     []string
+	onDelete OnDelete
+}
+
+// referencing returns the children that reference any of ids.
+func (r *relation[C]) referencing(ids []string) []C {
+	wanted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		wanted[id] = true
+	}
+	children, _ := r.child.GetList(func(item C) bool {
+		for _, ref := range referenceIDs(item, r.path) {
+			if wanted[ref] {
+				return true
+			}
+		}
+		return false
+	})
+	return children
+}
+
+func (r *relation[C]) restricted(id string) error {
+	if r.onDelete != Restrict {
+		return nil
+	}
+	if children := r.referencing([]string{id}); len(children) > 0 {
+		return fmt.Errorf("%w by %d item(s) through %s", ErrRestricted, len(children), r.field)
+	}
+	return nil
+}
+
+func (r *relation[C]) release(ids []string) error {
+	children := r.referencing(ids)
+	if len(children) == 0 {
+		return nil
+	}
+
+	switch r.onDelete {
+	case Cascade:
+		childIDs := make([]string, len(children))
+		for i, child := range children {
+			childIDs[i] = child.GetID()
+		}
+		_, err := r.child.DeleteMany(childIDs)
+		return err
+	case SetNull:
+		// The children are the manager's cached items, so the references
+		// are cleared on copies that replace them once stored.
+		updated := make([]C, 0, len(children))
+		for _, child := range children {
+			next, err := cloneItem(child)
+			if err != nil {
+				return err
+			}
+			for _, id := range ids {
+				clearReference(reflect.ValueOf(next), r.path, id)
+			}
+			updated = append(updated, next)
+		}
+		_, err := r.child.UpdateMany(updated)
+		return err
+	}
+	return nil
+}
+
+func (manager *Manager[T]) dependents() []dependent {
+	manager.relations.mu.RLock()
+	defer manager.relations.mu.RUnlock()
+	return manager.relations.dependents
+}
+
+// beforeDelete enforces the Restrict relations other collections hold on
+// ids. It returns the IDs that may be deleted and the errors of those that
+// may not. Nothing is changed until the delete has gone through.
+func (manager *Manager[T]) beforeDelete(ids []string) ([]string, map[string]error) {
+	dependents := manager.dependents()
+	if len(dependents) == 0 {
+		return ids, nil
+	}
+
+	refused := map[string]error{}
+	var allowed []string
+	for _, id := range ids {
+		for _, dep := range dependents {
+			if err := dep.restricted(id); err != nil {
+				refused[id] = err
+				break
+			}
+		}
+		if refused[id] == nil {
+			allowed = append(allowed, id)
+		}
+	}
+	return allowed, refused
+}
+
+// afterDelete applies Cascade and SetNull to the children of the deleted
+// ids. It runs once the parents are gone, so a failed delete leaves the
+// children untouched; a failure here leaves children referencing a parent
+// that no longer exists, and is returned.
+func (manager *Manager[T]) afterDelete(deleted []string) error {
+	if len(deleted) == 0 {
+		return nil
+	}
+	var errs []error
+	for _, dep := range manager.dependents() {
+		if err := dep.release(deleted); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("failed to release references to deleted items: %w", err)
+	}
+	return nil
+}
+
+// Expand returns the JSON form of item with each named relation field
+// replaced by the item it references, or a list of them for ID lists.
+// References to missing items expand to null.
+func (manager *Manager[T]) Expand(item T, fields ...string) (map[string]any, error) {
+	row, err := toJSONMap(item)
+	if err != nil {
+		return nil, err
+	}
+
+	manager.relations.mu.RLock()
+	defer manager.relations.mu.RUnlock()
+
+	for _, field := range fields {
+		ref, ok := manager.relations.references[field]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnknownRelation, field)
+		}
+
+		fv, ok := fieldValue(reflect.ValueOf(item), ref.path)
+		if !ok {
+			continue
+		}
+		resolve := func(id string) any {
+			if parent, ok := ref.resolve(id); ok {
+				return parent
+			}
+			return nil
+		}
+
+		if fv.Kind() == reflect.Slice || fv.Kind() == reflect.Array {
+			var expanded []any
+			for _, id := range stringsOf(fv) {
+				expanded = append(expanded, resolve(id))
+			}
+			setPath(row, field, expanded)
+		} else if fv.Kind() == reflect.String && fv.String() != "" {
+			setPath(row, field, resolve(fv.String()))
+		}
+	}
+	return row, nil
+}
+
+// cloneItem returns a deep copy of item, made through its JSON form as that
+// is all a stored item keeps.
+func cloneItem[T CollectionItem](item T) (T, error) {
+	var clone T
+	raw, err := json.Marshal(item)
+	if err != nil {
+		return clone, err
+	}
+	err = json.Unmarshal(raw, &clone)
+	return clone, err
+}
+
+func referenceIDs(item any, path []string) []string {
+	fv, ok := fieldValue(reflect.ValueOf(item), path)
+	if !ok {
+		return nil
+	}
+	return stringsOf(fv)
+}
+
+// clearReference removes id from the field at path: a matching string or
+// string pointer becomes its zero value and a list loses the matching entry.
+func clearReference(v reflect.Value, path []string, id string) bool {
+	v = indirect(v)
+	if !v.IsValid() {
+		return false
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		f, ok := structFieldByJSONName(v.Type(), path[0])
+		if !ok {
+			return false
+		}
+		fv, err := v.FieldByIndexErr(f.Index)
+		if err != nil {
+			return false
+		}
+		if len(path) > 1 {
+			return clearReference(fv, path[1:], id)
+		}
+		cleared, changed := withoutReference(fv, id)
+		if !changed || !fv.CanSet() {
+			return false
+		}
+		fv.Set(cleared)
+		return true
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return false
+		}
+		key := reflect.ValueOf(path[0]).Convert(v.Type().Key())
+		mv := v.MapIndex(key)
+		if !mv.IsValid() {
+			return false
+		}
+		if len(path) > 1 {
+			return clearReference(mv, path[1:], id)
+		}
+		cleared, changed := withoutReference(mv, id)
+		if changed {
+			v.SetMapIndex(key, cleared)
+		}
+		return changed
+	}
+	return false
+}
+
+// withoutReference returns v with id removed, and whether anything changed.
+func withoutReference(v reflect.Value, id string) (reflect.Value, bool) {
+	inner := indirect(v)
+	if !inner.IsValid() {
+		return v, false
+	}
+
+	switch inner.Kind() {
+	case reflect.String:
+		if inner.String() == id {
+			return reflect.Zero(v.Type()), true
+		}
+	case reflect.Slice:
+		out := reflect.MakeSlice(inner.Type(), 0, inner.Len())
+		for i := 0; i < inner.Len(); i++ {
+			elem := inner.Index(i)
+			if refs := stringsOf(elem); len(refs) == 1 && refs[0] == id {
+				continue
+			}
+			out = reflect.Append(out, elem)
+		}
+		if out.Len() != inner.Len() {
+			if v.Kind() == reflect.Pointer {
+				ptr := reflect.New(inner.Type())
+				ptr.Elem().Set(out)
+				return ptr, true
+			}
+			return out, true
+		}
+	}
+	return v, false
+}
+
+// GetExpanded is Get followed by Expand. With no fields it returns the plain
+// JSON form of the item.
+func (manager *Manager[T]) GetExpanded(id string, expand ...string) (map[string]any, error) {
+	item, err := manager.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	return manager.Expand(item, expand...)
+}
@@ -0,0 +1,131 @@
+package collection_manager_v3
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// label has value receivers, so a Manager[label] cannot change its items in
+// place.
+type label struct {
+	ID    string `json:"id"`
+	Owner string `json:"owner"`
+}
+
+func (l label) SetID(string)            {}
+func (l label) SetCreatedAt(time.Time)  {}
+func (l label) SetUpdatedAt(time.Time)  {}
+func (l label) GetID() string           { return l.ID }
+func (l label) GetCreatedAt() time.Time { return time.Time{} }
+func (l label) GetUpdatedAt() time.Time { return time.Time{} }
+
+func newOwnedNotes(t *testing.T, onDelete OnDelete) (parents, children *Manager[*note], parentStore *MemoryStorage[*note]) {
+	t.Helper()
+	parents, parentStore, _ = newTestManager(t)
+	children, _, _ = newTestManager(t)
+	if err := Reference(children, "owner", parents, onDelete); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parents.CreateWithID(&note{ID: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	owner := "alice"
+	for _, id := range []string{"n1", "n2"} {
+		if _, err := children.CreateWithID(&note{ID: id, Owner: &owner}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return parents, children, parentStore
+}
+
+func TestFailedDeleteLeavesChildrenAlone(t *testing.T) {
+	for _, onDelete := range []OnDelete{Cascade, SetNull} {
+		parents, children, parentStore := newOwnedNotes(t, onDelete)
+		parentStore.FailNextWrite(errors.New("disk full"))
+
+		if err := parents.Delete("alice"); err == nil {
+			t.Fatalf("%s: delete succeeded despite the failed write", onDelete)
+		}
+		if _, err := parents.Get("alice"); err != nil {
+			t.Fatalf("%s: parent gone after a failed delete: %v", onDelete, err)
+		}
+		for _, id := range []string{"n1", "n2"} {
+			child, err := children.Get(id)
+			if err != nil || child.Owner == nil || *child.Owner != "alice" {
+				t.Errorf("%s: child %s changed by a failed delete: %+v, %v", onDelete, id, child, err)
+			}
+		}
+	}
+}
+
+func TestDeleteReleasesChildren(t *testing.T) {
+	parents, children, _ := newOwnedNotes(t, SetNull)
+	if err := parents.Delete("alice"); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"n1", "n2"} {
+		if child, err := children.Get(id); err != nil || child.Owner != nil {
+			t.Errorf("child %s: %+v, %v", id, child, err)
+		}
+	}
+
+	parents, children, _ = newOwnedNotes(t, Cascade)
+	if _, err := parents.DeleteMany([]string{"alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if n := children.Count(nil); n != 0 {
+		t.Fatalf("%d children left after a cascading delete", n)
+	}
+
+	parents, _, _ = newOwnedNotes(t, Restrict)
+	if err := parents.Delete("alice"); !errors.Is(err, ErrRestricted) {
+		t.Fatalf("restricted delete: err = %v", err)
+	}
+}
+
+func TestSetNullLeavesCachedChildrenAlone(t *testing.T) {
+	parents, _, _ := newTestManager(t)
+	children, childStore, _ := newTestManager(t)
+	if err := Reference(children, "owner", parents, SetNull); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parents.CreateWithID(&note{ID: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	owner := "alice"
+	if _, err := children.CreateWithID(&note{ID: "n1", Owner: &owner}); err != nil {
+		t.Fatal(err)
+	}
+	cached, _ := children.Get("n1")
+
+	// The parent goes, but storing the released child fails.
+	childStore.FailNextWrite(errors.New("disk full"))
+	if err := parents.Delete("alice"); err == nil {
+		t.Fatal("delete reported no error although releasing the child failed")
+	}
+	if cached.Owner == nil || *cached.Owner != "alice" {
+		t.Fatalf("cached child changed: %+v", cached)
+	}
+	if child, _ := children.Get("n1"); child.Owner == nil || *child.Owner != "alice" {
+		t.Fatalf("child released in memory but not in storage: %+v", child)
+	}
+}
+
+func TestSetNullNeedsSettableItems(t *testing.T) {
+	parents, _, _ := newTestManager(t)
+	store, err := NewMemoryStorage[label]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	labels, err := NewMemoryCollectionManager(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Reference(labels, "owner", parents, SetNull); !errors.Is(err, ErrSetNullNeedsRef) {
+		t.Fatalf("err = %v, want ErrSetNullNeedsRef", err)
+	}
+	if err := Reference(labels, "owner", parents, Cascade); err != nil {
+		t.Fatalf("cascade on value items: %v", err)
+	}
+}
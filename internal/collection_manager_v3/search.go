@@ -0,0 +1,207 @@
+package collection_manager_v3
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// SearchHit is one result of SearchIndex.Search.
+type SearchHit[T CollectionItem] struct {
+	Item  T       `json:"item"`
+	Score float64 `json:"score"`
+}
+
+// SearchIndex is an in-memory inverted index over some string fields of a
+// Manager's items. It follows the manager through OnChange, so it never
+// needs rebuilding by hand.
+type SearchIndex[T CollectionItem] struct {
+	manager *Manager[T]
+	fields  [][]string
+
+	mu       sync.Mutex
+	postings map[string]map[string]int // term -> item ID -> occurrences
+	docTerms map[string][]string       // item ID -> distinct terms, for removal
+	terms    []string                  // sorted distinct terms, for prefix lookups
+	dirty    bool
+}
+
+// NewSearchIndex indexes the given JSON fields (dotted for nested fields) of
+// every item in manager and keeps the index current from then on. String
+// fields and string slices are indexed; other values are ignored.
+func NewSearchIndex[T CollectionItem](manager *Manager[T], fields ...string) *SearchIndex[T] {
+	idx := &SearchIndex[T]{
+		manager:  manager,
+		postings: map[string]map[string]int{},
+		docTerms: map[string][]string{},
+	}
+	for _, field := range fields {
+		idx.fields = append(idx.fields, strings.Split(field, "."))
+	}
+
+	manager.OnChange(idx.apply)
+
+	items, _ := manager.GetAll()
+	for _, item := range items {
+		idx.add(item.GetID(), item)
+	}
+	return idx
+}
+
+func (idx *SearchIndex[T]) apply(event ChangeEvent[T]) {
+	switch event.Op {
+	case ChangeCreate, ChangeUpdate:
+		idx.add(event.ID, event.Item)
+	default:
+		idx.remove(event.ID)
+	}
+}
+
+func (idx *SearchIndex[T]) add(id string, item T) {
+	counts := map[string]int{}
+	v := reflect.ValueOf(item)
+	for _, path := range idx.fields {
+		fv, ok := fieldValue(v, path)
+		if !ok {
+			continue
+		}
+		for _, text := range stringsOf(fv) {
+			for _, term := range tokenize(text) {
+				counts[term]++
+			}
+		}
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.removeLocked(id)
+	terms := make([]string, 0, len(counts))
+	for term, n := range counts {
+		docs, ok := idx.postings[term]
+		if !ok {
+			docs = map[string]int{}
+			idx.postings[term] = docs
+			idx.dirty = true
+		}
+		docs[id] = n
+		terms = append(terms, term)
+	}
+	idx.docTerms[id] = terms
+}
+
+func (idx *SearchIndex[T]) remove(id string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeLocked(id)
+}
+
+func (idx *SearchIndex[T]) removeLocked(id string) {
+	for _, term := range idx.docTerms[id] {
+		docs := idx.postings[term]
+		delete(docs, id)
+		if len(docs) == 0 {
+			delete(idx.postings, term)
+			idx.dirty = true
+		}
+	}
+	delete(idx.docTerms, id)
+}
+
+// Search returns up to limit items (all if limit <= 0) containing every
+// query token, either as a whole word or as a word prefix, best match first.
+// Scores are TF-IDF weighted, with whole-word matches counting double.
+func (idx *SearchIndex[T]) Search(query string, limit int) []SearchHit[T] {
+	tokens := tokenize(query)
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	idx.mu.Lock()
+	if idx.dirty {
+		idx.terms = idx.terms[:0]
+		for term := range idx.postings {
+			idx.terms = append(idx.terms, term)
+		}
+		sort.Strings(idx.terms)
+		idx.dirty = false
+	}
+
+	total := float64(len(idx.docTerms))
+	var scores map[string]float64
+	for _, token := range tokens {
+		tokenScores := map[string]float64{}
+		start := sort.SearchStrings(idx.terms, token)
+		for _, term := range idx.terms[start:] {
+			if !strings.HasPrefix(term, token) {
+				break
+			}
+			docs := idx.postings[term]
+			weight := math.Log(1 + total/float64(len(docs)))
+			if term == token {
+				weight *= 2
+			}
+			for id, n := range docs {
+				tokenScores[id] += float64(n) * weight
+			}
+		}
+
+		if scores == nil {
+			scores = tokenScores
+			continue
+		}
+		for id := range scores {
+			if s, ok := tokenScores[id]; ok {
+				scores[id] += s
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+	idx.mu.Unlock()
+
+	hits := make([]SearchHit[T], 0, len(scores))
+	for id, score := range scores {
+		item, err := idx.manager.Get(id)
+		if err != nil {
+			continue
+		}
+		hits = append(hits, SearchHit[T]{Item: item, Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Item.GetID() < hits[j].Item.GetID()
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	return hits
+}
+
+// tokenize lowercases text and splits it into runs of letters and digits,
+// so "IMG_2041.JPG" becomes img, 2041 and jpg.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+func stringsOf(v reflect.Value) []string {
+	v = indirect(v)
+	switch v.Kind() {
+	case reflect.String:
+		return []string{v.String()}
+	case reflect.Slice, reflect.Array:
+		var out []string
+		for i := 0; i < v.Len(); i++ {
+			out = append(out, stringsOf(v.Index(i))...)
+		}
+		return out
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package collection_manager_v3
+
+import (
+	"reflect"
+	"testing"
+)
+
+func hitIDs(hits []SearchHit[*note]) []string {
+	ids := make([]string, len(hits))
+	for i, hit := range hits {
+		ids[i] = hit.Item.ID
+	}
+	return ids
+}
+
+func TestSearchIndex(t *testing.T) {
+	ann := "Ann"
+	manager, _, _ := newTestManager(t)
+	if _, err := manager.CreateManyWithID([]*note{
+		{ID: "n1", Title: "Summer Holiday photos", Owner: &ann},
+		{ID: "n2", Title: "summer, summer camp"},
+		{ID: "n3", Title: "Winter holiday"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	idx := NewSearchIndex(manager, "title", "owner")
+	// Created after the index, so it arrives through OnChange.
+	if _, err := manager.CreateWithID(&note{ID: "n4", Title: "Summertime"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		limit int
+		want  []string
+	}{
+		// Repeated whole words outrank single ones, which outrank prefixes.
+		{"summer", 0, []string{"n2", "n1", "n4"}},
+		{"SUMMER", 1, []string{"n2"}},
+		{"hol", 0, []string{"n1", "n3"}},
+		{"summer hol", 0, []string{"n1"}},
+		{"ann", 0, []string{"n1"}},
+		{"autumn", 0, []string{}},
+		{"", 0, []string{}},
+		{"  ,. ", 0, []string{}},
+	}
+	for _, tt := range tests {
+		if got := hitIDs(idx.Search(tt.query, tt.limit)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Search(%q, %d) = %v, want %v", tt.query, tt.limit, got, tt.want)
+		}
+	}
+
+	hits := idx.Search("summer", 0)
+	for i := 1; i < len(hits); i++ {
+		if hits[i].Score > hits[i-1].Score {
+			t.Fatalf("hits out of order: %+v", hits)
+		}
+	}
+}
+
+func TestSearchIndexFollowsUpdatesAndDeletes(t *testing.T) {
+	manager, _, _ := newTestManager(t)
+	if _, err := manager.CreateManyWithID([]*note{
+		{ID: "n1", Title: "winter holiday"},
+		{ID: "n2", Title: "summer camp"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	idx := NewSearchIndex(manager, "title")
+
+	updated, _ := manager.Get("n1")
+	changed := *updated
+	changed.Title = "summer night"
+	if _, err := manager.Update(&changed); err != nil {
+		t.Fatal(err)
+	}
+	if got := hitIDs(idx.Search("winter", 0)); len(got) != 0 {
+		t.Errorf("old title still matches: %v", got)
+	}
+	if got := hitIDs(idx.Search("summer", 0)); !reflect.DeepEqual(got, []string{"n1", "n2"}) {
+		t.Errorf("summer = %v after the update", got)
+	}
+
+	if err := manager.Delete("n2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := hitIDs(idx.Search("camp", 0)); len(got) != 0 {
+		t.Errorf("deleted item still matches: %v", got)
+	}
+	if got := hitIDs(idx.Search("sum", 0)); !reflect.DeepEqual(got, []string{"n1"}) {
+		t.Errorf("sum = %v after the delete", got)
+	}
+}
@@ -0,0 +1,248 @@
+package collection_manager_v3
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	maxShardDepth = 3
+	layoutFile    = ".layout"
+)
+
+var ErrInvalidShardDepth = fmt.Errorf("shard depth must be between 0 and %d", maxShardDepth)
+
+// layout is what a directory collection records in its .layout file. The
+// file is absent for the flat layout.
+type layout struct {
+	ShardDepth int `json:"shardDepth"`
+}
+
+// shardedPath places id under depth levels of directories named after the
+// leading bytes of the SHA-256 of the ID. Hashing keeps the shards even for
+// time-ordered UUIDv7s and natural keys alike.
+func shardedPath(baseDir string, id string, depth int) string {
+	parts := make([]string, 0, depth+2)
+	parts = append(parts, baseDir)
+	if depth > 0 {
+		sum := sha256.Sum256([]byte(id))
+		digest := hex.EncodeToString(sum[:depth])
+		for i := 0; i < depth; i++ {
+			parts = append(parts, digest[2*i:2*i+2])
+		}
+	}
+	parts = append(parts, id+".json")
+	return filepath.Join(parts...)
+}
+
+func isShardDir(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
+
+// isItemFile reports whether entry of a collection directory holds an item:
+// a regular "<id>.json" file named by an ID checkID accepts. Hidden files,
+// such as the collection's own and those other tools leave behind, never
+// are.
+func isItemFile(entry os.DirEntry) bool {
+	name := entry.Name()
+	if !entry.Type().IsRegular() || filepath.Ext(name) != ".json" || strings.HasPrefix(name, ".") {
+		return false
+	}
+	return checkID(strings.TrimSuffix(name, ".json")) == nil
+}
+
+// itemFiles maps the ID of every item file under baseDir, in any layout, to
+// its path. Only two-character hex directories are descended into, so other
+// content of the directory (thumbnails and the like) is left alone.
+func itemFiles(baseDir string) (map[string]string, error) {
+	files := map[string]string{}
+	var walk func(dir string, level int) error
+	walk = func(dir string, level int) error {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() {
+				if level < maxShardDepth && isShardDir(name) {
+					if err := walk(filepath.Join(dir, name), level+1); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if !isItemFile(entry) {
+				continue
+			}
+			files[strings.TrimSuffix(name, ".json")] = filepath.Join(dir, name)
+		}
+		return nil
+	}
+	return files, walk(baseDir, 0)
+}
+
+// foreignEntries lists the paths under baseDir, relative to it, that are not
+// part of the collection: anything but item files, shard directories and the
+// collection's own .layout and .checksums files.
+func foreignEntries(baseDir string) ([]string, error) {
+	var foreign []string
+	var walk func(dir string, level int) error
+	walk = func(dir string, level int) error {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			path := filepath.Join(dir, name)
+			switch {
+			case entry.IsDir() && level < maxShardDepth && isShardDir(name):
+				if err := walk(path, level+1); err != nil {
+					return err
+				}
+				continue
+			case isItemFile(entry):
+				continue
+			case level == 0 && (name == layoutFile || name == checksumFile):
+				continue
+			}
+			rel, _ := filepath.Rel(baseDir, path)
+			foreign = append(foreign, rel)
+		}
+		return nil
+	}
+	return foreign, walk(baseDir, 0)
+}
+
+func readLayout(baseDir string) (layout, error) {
+	var l layout
+	raw, err := os.ReadFile(filepath.Join(baseDir, layoutFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return l, err
+	}
+	return l, json.Unmarshal(raw, &l)
+}
+
+func writeLayout(baseDir string, l layout) error {
+	path := filepath.Join(baseDir, layoutFile)
+	if l.ShardDepth == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	raw, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// openLayout adopts the layout recorded on disk, or migrates the collection
+// to depth when depth is not negative and differs from it. A collection that
+// does not exist yet records its layout when the first item is created.
+func (d *directoryStorage[T]) openLayout(depth int) error {
+	if depth > maxShardDepth {
+		return ErrInvalidShardDepth
+	}
+	if _, err := os.Stat(d.baseDir); errors.Is(err, os.ErrNotExist) {
+		if depth > 0 {
+			d.depth = depth
+			d.layoutPending = true
+		}
+		return nil
+	}
+
+	current, err := readLayout(d.baseDir)
+	if err != nil {
+		return err
+	}
+	d.depth = current.ShardDepth
+	if depth < 0 || depth == current.ShardDepth {
+		return nil
+	}
+
+	if _, err := Reshard(d.baseDir, depth); err != nil {
+		return err
+	}
+	d.depth = depth
+	return nil
+}
+
+// Reshard moves every item file of the directory collection at baseDir into
+// the layout with the given shard depth, removes shard directories left
+// empty and records the new layout. It is safe to run again after an
+// interruption. It reports how many files were moved.
+func Reshard(baseDir string, depth int) (int, error) {
+	if depth < 0 || depth > maxShardDepth {
+		return 0, ErrInvalidShardDepth
+	}
+	if _, err := os.Stat(baseDir); errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+
+	files, err := itemFiles(baseDir)
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for id, path := range files {
+		target := shardedPath(baseDir, id, depth)
+		if target == path {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return moved, err
+		}
+		if err := os.Rename(path, target); err != nil {
+			return moved, err
+		}
+		moved++
+	}
+
+	if err := removeEmptyShards(baseDir, 0); err != nil {
+		return moved, err
+	}
+	return moved, writeLayout(baseDir, layout{ShardDepth: depth})
+}
+
+func removeEmptyShards(dir string, level int) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() || !isShardDir(entry.Name()) || level >= maxShardDepth {
+			continue
+		}
+		sub := filepath.Join(dir, entry.Name())
+		if err := removeEmptyShards(sub, level+1); err != nil {
+			return err
+		}
+		if rest, err := os.ReadDir(sub); err == nil && len(rest) == 0 {
+			if err := os.Remove(sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
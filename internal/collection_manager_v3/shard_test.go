@@ -0,0 +1,170 @@
+package collection_manager_v3
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newShardedNotes creates a directory collection of count notes at depth.
+func newShardedNotes(t *testing.T, count int, depth int) (string, []string) {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "notes")
+	manager, err := NewCollectionManager[*note](dir, false, WithShardedLayout(depth))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for i := 0; i < count; i++ {
+		id := fmt.Sprintf("note-%02d", i)
+		if _, err := manager.CreateWithID(&note{ID: id, Title: id}); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	return dir, ids
+}
+
+// checkLayout fails unless every id is stored where depth puts it and the
+// collection reopens with all of them.
+func checkLayout(t *testing.T, dir string, ids []string, depth int) {
+	t.Helper()
+	for _, id := range ids {
+		if _, err := os.Stat(shardedPath(dir, id, depth)); err != nil {
+			t.Errorf("depth %d: %s not in place: %v", depth, id, err)
+		}
+	}
+	if l, err := readLayout(dir); err != nil || l.ShardDepth != depth {
+		t.Errorf("recorded layout %+v, %v; want depth %d", l, err, depth)
+	}
+
+	manager, err := NewCollectionManager[*note](dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if item, err := manager.Get(id); err != nil || item.Title != id {
+			t.Errorf("depth %d: reopened %s: %+v, %v", depth, id, item, err)
+		}
+	}
+}
+
+func TestReshardBetweenDepths(t *testing.T) {
+	dir, ids := newShardedNotes(t, 20, 0)
+	checkLayout(t, dir, ids, 0)
+
+	for _, depth := range []int{2, 1, 3, 0} {
+		moved, err := Reshard(dir, depth)
+		if err != nil {
+			t.Fatalf("reshard to %d: %v", depth, err)
+		}
+		if moved != len(ids) {
+			t.Errorf("reshard to %d moved %d files, want %d", depth, moved, len(ids))
+		}
+		checkLayout(t, dir, ids, depth)
+
+		// Shard directories of deeper layouts are removed once empty.
+		var dirs []string
+		filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+			if d != nil && d.IsDir() && path != dir && len(strings.Split(strings.TrimPrefix(path, dir+"/"), "/")) > depth {
+				dirs = append(dirs, path)
+			}
+			return nil
+		})
+		if len(dirs) > 0 {
+			t.Errorf("depth %d leaves shard directories behind: %v", depth, dirs)
+		}
+	}
+
+	if moved, err := Reshard(dir, 0); err != nil || moved != 0 {
+		t.Fatalf("reshard to the current depth: moved %d, %v", moved, err)
+	}
+	if _, err := Reshard(dir, maxShardDepth+1); err != ErrInvalidShardDepth {
+		t.Fatalf("err = %v, want ErrInvalidShardDepth", err)
+	}
+}
+
+func TestReshardResumesAfterInterruption(t *testing.T) {
+	dir, ids := newShardedNotes(t, 10, 0)
+
+	// A reshard to depth 2 that stopped half way: some files moved, the
+	// layout not yet recorded.
+	for _, id := range ids[:5] {
+		target := shardedPath(dir, id, 2)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(shardedPath(dir, id, 0), target); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The half moved collection still lists and reads completely.
+	manager, err := NewCollectionManager[*note](dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := manager.Count(nil); n != len(ids) {
+		t.Fatalf("half way: %d items, want %d", n, len(ids))
+	}
+
+	moved, err := Reshard(dir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if moved != 5 {
+		t.Errorf("resumed reshard moved %d files, want 5", moved)
+	}
+	checkLayout(t, dir, ids, 2)
+}
+
+func TestItemFilesSkipsOtherFiles(t *testing.T) {
+	dir, ids := newShardedNotes(t, 3, 0)
+	others := map[string]string{
+		".contents.json":        `{}`,
+		"._note-00.json":        `junk`,
+		"readme.txt":            `not an item`,
+		"thumbnails/a.json":     `{}`,
+		"zz/b.json":             `{}`,
+		"note-01.json.tmp":      `{}`,
+		"ab/cd/ef/gh/deep.json": `{}`,
+	}
+	for name, content := range others {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(dir, "readme.txt"), filepath.Join(dir, "link.json")); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := itemFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found []string
+	for id := range files {
+		found = append(found, id)
+	}
+	sort.Strings(found)
+	if strings.Join(found, ",") != strings.Join(ids, ",") {
+		t.Fatalf("itemFiles found %v, want %v", found, ids)
+	}
+
+	if _, err := Reshard(dir, 1); err != nil {
+		t.Fatal(err)
+	}
+	for name := range others {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("reshard moved %s: %v", name, err)
+		}
+	}
+	checkLayout(t, dir, ids, 1)
+}
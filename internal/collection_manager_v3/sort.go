@@ -0,0 +1,200 @@
+package collection_manager_v3
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrUnknownSortField = errors.New("unknown sort field")
+
+// SortOptions selects the ordering of SortItems. SortBy is a comma separated
+// list of JSON field names, dotted for nested fields, e.g.
+// "albumType,-settings.size". A "-" or "+" prefix forces descending or
+// ascending order for that key; other keys use SortOrder, where "asc" is
+// ascending and anything else descending. Keys, when set, replace SortBy.
+type SortOptions struct {
+	SortBy    string
+	SortOrder string
+	Keys      []SortKey
+}
+
+// SortKey is one level of a multi-key sort.
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// ParseSortKeys turns SortBy and SortOrder into sort keys.
+func ParseSortKeys(sortBy string, sortOrder string) []SortKey {
+	var keys []SortKey
+	for _, field := range strings.Split(sortBy, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		desc := sortOrder != "asc"
+		switch field[0] {
+		case '-':
+			desc, field = true, field[1:]
+		case '+':
+			desc, field = false, field[1:]
+		}
+		keys = append(keys, SortKey{Field: field, Desc: desc})
+	}
+	return keys
+}
+
+// SortItems sorts items in place by the requested keys and returns them.
+// The sort is stable, so items equal on every key keep their relative order;
+// items missing a field sort after those that have it. "id", "creationDate"
+// and "modificationDate" always use GetID, GetCreatedAt and GetUpdatedAt.
+// A field that T cannot have yields ErrUnknownSortField.
+func (manager *Manager[T]) SortItems(items []T, options SortOptions) ([]T, error) {
+	keys := options.Keys
+	if len(keys) == 0 {
+		keys = ParseSortKeys(options.SortBy, options.SortOrder)
+	}
+	if len(keys) == 0 {
+		return items, nil
+	}
+
+	itemType := reflect.TypeOf((*T)(nil)).Elem()
+	extractors := make([]func(T) reflect.Value, len(keys))
+	for i, key := range keys {
+		extract, err := sortExtractor[T](itemType, key.Field)
+		if err != nil {
+			return items, err
+		}
+		extractors[i] = extract
+	}
+
+	// Extract every key once up front instead of on every comparison.
+	type row struct {
+		item   T
+		values []reflect.Value
+	}
+	rows := make([]row, len(items))
+	for i, item := range items {
+		values := make([]reflect.Value, len(extractors))
+		for k, extract := range extractors {
+			values[k] = extract(item)
+		}
+		rows[i] = row{item: item, values: values}
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		for k, key := range keys {
+			c := compareValues(rows[i].values[k], rows[j].values[k])
+			if c == 0 {
+				continue
+			}
+			// Missing values stay last whatever the direction.
+			if !rows[i].values[k].IsValid() || !rows[j].values[k].IsValid() {
+				return c < 0
+			}
+			if key.Desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+
+	for i := range rows {
+		items[i] = rows[i].item
+	}
+	return items, nil
+}
+
+func sortExtractor[T CollectionItem](itemType reflect.Type, field string) (func(T) reflect.Value, error) {
+	switch field {
+	case "id":
+		return func(item T) reflect.Value { return reflect.ValueOf(item.GetID()) }, nil
+	case "creationDate":
+		return func(item T) reflect.Value { return reflect.ValueOf(item.GetCreatedAt()) }, nil
+	case "modificationDate":
+		return func(item T) reflect.Value { return reflect.ValueOf(item.GetUpdatedAt()) }, nil
+	}
+
+	path := strings.Split(field, ".")
+	if !checkFieldPath(itemType, path) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownSortField, field)
+	}
+	return func(item T) reflect.Value {
+		v, _ := fieldValue(reflect.ValueOf(item), path)
+		return v
+	}, nil
+}
+
+// compareValues orders two field values: numbers numerically, strings
+// lexically, false before true, times chronologically. Invalid (missing)
+// values sort after everything else; mismatched kinds fall back to their
+// printed form.
+func compareValues(a, b reflect.Value) int {
+	switch {
+	case !a.IsValid() && !b.IsValid():
+		return 0
+	case !a.IsValid():
+		return 1
+	case !b.IsValid():
+		return -1
+	}
+
+	if a.Type() == timeType && b.Type() == timeType && a.CanInterface() && b.CanInterface() {
+		return a.Interface().(time.Time).Compare(b.Interface().(time.Time))
+	}
+
+	switch {
+	case isNumber(a) && isNumber(b):
+		fa, fb := toFloat(a), toFloat(b)
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	case a.Kind() == reflect.String && b.Kind() == reflect.String:
+		return strings.Compare(a.String(), b.String())
+	case a.Kind() == reflect.Bool && b.Kind() == reflect.Bool:
+		switch {
+		case a.Bool() == b.Bool():
+			return 0
+		case !a.Bool():
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(printed(a), printed(b))
+}
+
+func printed(v reflect.Value) string {
+	if v.CanInterface() {
+		return fmt.Sprint(v.Interface())
+	}
+	return v.String()
+}
+
+func isNumber(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+func toFloat(v reflect.Value) float64 {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint())
+	}
+	return v.Float()
+}
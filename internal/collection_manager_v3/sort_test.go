@@ -0,0 +1,74 @@
+package collection_manager_v3
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSortItems(t *testing.T) {
+	ann, bob := "ann", "bob"
+	manager, _, _ := newTestManager(t)
+	if _, err := manager.CreateManyWithID([]*note{
+		{ID: "n1", Title: "b", Size: 2, Owner: &ann},
+		{ID: "n2", Title: "a", Size: 2},
+		{ID: "n3", Title: "b", Size: 1, Owner: &bob},
+		{ID: "n4", Title: "a", Size: 3, Owner: &ann},
+		{ID: "n5", Title: "c", Size: 2},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		options SortOptions
+		want    []string
+	}{
+		{"unsorted", SortOptions{}, []string{"n1", "n2", "n3", "n4", "n5"}},
+		{"ascending is stable", SortOptions{SortBy: "title", SortOrder: "asc"}, []string{"n2", "n4", "n1", "n3", "n5"}},
+		{"descending is stable", SortOptions{SortBy: "title", SortOrder: "desc"}, []string{"n5", "n1", "n3", "n2", "n4"}},
+		{"second key breaks ties", SortOptions{SortBy: "title,-size", SortOrder: "asc"}, []string{"n4", "n2", "n1", "n3", "n5"}},
+		{"two ascending keys", SortOptions{SortBy: "size, title", SortOrder: "asc"}, []string{"n3", "n2", "n1", "n5", "n4"}},
+		{"prefix overrides order", SortOptions{SortBy: "+size", SortOrder: "desc"}, []string{"n3", "n1", "n2", "n5", "n4"}},
+		{"missing last ascending", SortOptions{SortBy: "owner", SortOrder: "asc"}, []string{"n1", "n4", "n3", "n2", "n5"}},
+		{"missing last descending", SortOptions{SortBy: "owner", SortOrder: "desc"}, []string{"n3", "n1", "n4", "n2", "n5"}},
+		{"id", SortOptions{SortBy: "id"}, []string{"n5", "n4", "n3", "n2", "n1"}},
+		{"keys replace sortBy", SortOptions{SortBy: "title", Keys: []SortKey{{Field: "size", Desc: true}, {Field: "id"}}}, []string{"n4", "n1", "n2", "n5", "n3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := manager.GetMany([]string{"n1", "n2", "n3", "n4", "n5"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			items := make([]*note, len(results))
+			for i, r := range results {
+				items[i] = r.Item
+			}
+
+			sorted, err := manager.SortItems(items, tt.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, len(sorted))
+			for i, item := range sorted {
+				got[i] = item.ID
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSortItemsUnknownField(t *testing.T) {
+	manager, _, _ := newTestManager(t)
+	for _, field := range []string{"nope", "size.digits", "title,nope"} {
+		if _, err := manager.SortItems([]*note{{ID: "a"}, {ID: "b"}}, SortOptions{SortBy: field}); !errors.Is(err, ErrUnknownSortField) {
+			t.Errorf("SortBy %q: err = %v, want ErrUnknownSortField", field, err)
+		}
+	}
+	if _, err := manager.GetSortedList(nil, "nope", "asc"); !errors.Is(err, ErrUnknownSortField) {
+		t.Errorf("GetSortedList: err = %v, want ErrUnknownSortField", err)
+	}
+}
@@ -0,0 +1,61 @@
+package collection_manager_v3
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+// testStorages returns one empty storage of every kind.
+func testStorages(t *testing.T) map[string]storage[*note] {
+	t.Helper()
+	memory, err := NewMemoryStorage[*note]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	return map[string]storage[*note]{
+		"file":      newSingleFileStorage[*note](filepath.Join(dir, "notes.json")),
+		"directory": newDirectoryStorage[*note](filepath.Join(dir, "notes")),
+		"memory":    memory,
+	}
+}
+
+func TestStoragesReportMissingItemsAlike(t *testing.T) {
+	for name, store := range testStorages(t) {
+		if errs := store.CreateItems([]*note{{ID: "a"}, {ID: "b"}}); errors.Join(errs...) != nil {
+			t.Fatalf("%s: create: %v", name, errs)
+		}
+
+		if err := store.UpdateItem(&note{ID: "missing"}); !errors.Is(err, ErrItemNotFound) {
+			t.Errorf("%s: UpdateItem: err = %v", name, err)
+		}
+		if err := store.DeleteItem("missing"); !errors.Is(err, ErrItemNotFound) {
+			t.Errorf("%s: DeleteItem: err = %v", name, err)
+		}
+
+		errs := store.UpdateItems([]*note{{ID: "a", Title: "x"}, {ID: "missing"}})
+		if errs[0] != nil || !errors.Is(errs[1], ErrItemNotFound) {
+			t.Errorf("%s: UpdateItems: %v", name, errs)
+		}
+		errs = store.DeleteItems([]string{"missing", "b"})
+		if !errors.Is(errs[0], ErrItemNotFound) || errs[1] != nil {
+			t.Errorf("%s: DeleteItems: %v", name, errs)
+		}
+
+		items, err := store.ReadAll(true)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if len(items) != 1 || items[0].ID != "a" || items[0].Title != "x" {
+			t.Errorf("%s: left with %+v", name, items)
+		}
+	}
+}
+
+func TestManagerDeleteMissing(t *testing.T) {
+	manager, _, _ := newTestManager(t)
+	if err := manager.Delete("missing"); !errors.Is(err, ErrItemNotFound) {
+		t.Fatalf("err = %v, want ErrItemNotFound", err)
+	}
+}
@@ -0,0 +1,59 @@
+package collection_manager_v3
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// FakeClock is a Clock that only moves when told to.
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFakeClock returns a FakeClock stopped at start.
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to t.
+func (c *FakeClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+}
+
+// SequentialIDGenerator is an IDGenerator that hands out UUID-shaped IDs
+// 00000000-0000-7000-8000-000000000001, ...-000000000002 and so on, which
+// sort in creation order just like UUIDv7.
+type SequentialIDGenerator struct {
+	mu   sync.Mutex
+	next uint64
+}
+
+// NewSequentialIDGenerator returns a generator whose first ID ends in 1.
+func NewSequentialIDGenerator() *SequentialIDGenerator {
+	return &SequentialIDGenerator{next: 1}
+}
+
+func (g *SequentialIDGenerator) NewID() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	id := fmt.Sprintf("00000000-0000-7000-8000-%012x", g.next)
+	g.next++
+	return id, nil
+}
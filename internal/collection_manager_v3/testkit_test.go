@@ -0,0 +1,42 @@
+package collection_manager_v3
+
+import (
+	"testing"
+	"time"
+)
+
+// note is the item type the tests store.
+type note struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Size      int       `json:"size"`
+	Owner     *string   `json:"owner,omitempty"`
+	CreatedAt time.Time `json:"creationDate"`
+	UpdatedAt time.Time `json:"modificationDate"`
+}
+
+func (n *note) SetID(id string)          { n.ID = id }
+func (n *note) SetCreatedAt(t time.Time) { n.CreatedAt = t }
+func (n *note) SetUpdatedAt(t time.Time) { n.UpdatedAt = t }
+func (n *note) GetID() string            { return n.ID }
+func (n *note) GetCreatedAt() time.Time  { return n.CreatedAt }
+func (n *note) GetUpdatedAt() time.Time  { return n.UpdatedAt }
+
+var testEpoch = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// newTestManager returns a Manager over a MemoryStorage with a FakeClock and
+// sequential IDs, so that tests can assert on both.
+func newTestManager(t *testing.T, opts ...Option) (*Manager[*note], *MemoryStorage[*note], *FakeClock) {
+	t.Helper()
+	store, err := NewMemoryStorage[*note]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewFakeClock(testEpoch)
+	opts = append([]Option{WithClock(clock), WithIDGenerator(NewSequentialIDGenerator())}, opts...)
+	manager, err := NewMemoryCollectionManager(store, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return manager, store, clock
+}
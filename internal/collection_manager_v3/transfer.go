@@ -0,0 +1,401 @@
+package collection_manager_v3
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Format is an export/import encoding.
+type Format string
+
+const (
+	FormatJSONL Format = "jsonl"
+	FormatCSV   Format = "csv"
+)
+
+// ConflictPolicy decides what Import does with an item whose ID already
+// exists in the collection.
+type ConflictPolicy string
+
+const (
+	ConflictUpsert ConflictPolicy = "upsert"
+	ConflictSkip   ConflictPolicy = "skip"
+	ConflictFail   ConflictPolicy = "fail"
+)
+
+var (
+	ErrUnknownFormat  = errors.New("unknown transfer format")
+	ErrImportConflict = errors.New("item already exists")
+)
+
+const defaultImportBatchSize = 500
+
+// Column maps a CSV header to a JSON field of the item. Field may be a dotted
+// path into nested objects, e.g. "settings.theme".
+type Column struct {
+	Header string
+	Field  string
+}
+
+// ParseColumns parses a column spec of the form "header:field,field,...".
+// An entry without a colon uses the field name as its header.
+func ParseColumns(spec string) []Column {
+	var columns []Column
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		header, field, found := strings.Cut(part, ":")
+		if !found {
+			field = header
+		}
+		columns = append(columns, Column{Header: header, Field: field})
+	}
+	return columns
+}
+
+type ExportOptions struct {
+	Format  Format
+	Columns []Column // CSV only; defaults to every top-level field
+}
+
+type ImportOptions struct {
+	Format     Format
+	OnConflict ConflictPolicy // defaults to ConflictFail
+	Columns    []Column       // CSV only; defaults to the header row as field names
+	BatchSize  int
+}
+
+// ImportReport counts what Import did with each record.
+type ImportReport struct {
+	Created int      `json:"created"`
+	Updated int      `json:"updated"`
+	Skipped int      `json:"skipped"`
+	Failed  int      `json:"failed"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// Export streams every item, ordered by ID, to w. Lazy collections are read
+// from disk one item at a time, so exporting one never loads it whole.
+func (manager *Manager[T]) Export(w io.Writer, opts ExportOptions) error {
+	switch opts.Format {
+	case FormatJSONL, "":
+		enc := json.NewEncoder(w)
+		return manager.eachItem(func(item T) error {
+			return enc.Encode(item)
+		})
+	case FormatCSV:
+		return manager.exportCSV(w, opts.Columns)
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownFormat, opts.Format)
+	}
+}
+
+// eachItem calls fn with every live item in ID order and stops at the first
+// error. Lazy collections hand over each item as it is read; the others
+// already hold every item in memory.
+func (manager *Manager[T]) eachItem(fn func(T) error) error {
+	now := manager.clock.Now()
+	visit := func(item T) error {
+		if manager.expired(item, now) {
+			return nil
+		}
+		return fn(item)
+	}
+
+	if lazy, ok := manager.items.(interface{ each(func(T) error) error }); ok {
+		return lazy.each(visit)
+	}
+	items := manager.items.GetAllValues()
+	sort.Slice(items, func(i, j int) bool { return items[i].GetID() < items[j].GetID() })
+	for _, item := range items {
+		if err := visit(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportCSV writes one row per item. Without columns it first scans the
+// items for their top-level keys, so the collection is read twice rather
+// than held in memory.
+func (manager *Manager[T]) exportCSV(w io.Writer, columns []Column) error {
+	if len(columns) == 0 {
+		seen := map[string]bool{}
+		err := manager.eachItem(func(item T) error {
+			row, err := toJSONMap(item)
+			for key := range row {
+				seen[key] = true
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		columns = defaultColumns(seen)
+	}
+
+	cw := csv.NewWriter(w)
+	header := make([]string, len(columns))
+	for i, col := range columns {
+		header[i] = col.Header
+	}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	record := make([]string, len(columns))
+	err := manager.eachItem(func(item T) error {
+		row, err := toJSONMap(item)
+		if err != nil {
+			return err
+		}
+		for i, col := range columns {
+			cell, err := csvCell(lookupPath(row, col.Field))
+			if err != nil {
+				return err
+			}
+			record[i] = cell
+		}
+		return cw.Write(record)
+	})
+	if err != nil {
+		return err
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// defaultColumns lists every top-level key seen, "id" first.
+func defaultColumns(seen map[string]bool) []Column {
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		if key != "id" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	keys = append([]string{"id"}, keys...)
+
+	columns := make([]Column, len(keys))
+	for i, key := range keys {
+		columns[i] = Column{Header: key, Field: key}
+	}
+	return columns
+}
+
+func csvCell(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	default:
+		raw, err := json.Marshal(v)
+		return string(raw), err
+	}
+}
+
+// Import reads items from r and stores them in batches. Items without an ID
+// get a new one; items with an ID keep it and are resolved against existing
+// items with opts.OnConflict. With ConflictFail, Import stops at the first
+// conflict; everything stored before it stays stored.
+func (manager *Manager[T]) Import(r io.Reader, opts ImportOptions) (ImportReport, error) {
+	var report ImportReport
+
+	if opts.OnConflict == "" {
+		opts.OnConflict = ConflictFail
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultImportBatchSize
+	}
+
+	var next func() (T, error)
+	switch opts.Format {
+	case FormatJSONL, "":
+		next = jsonlReader[T](r)
+	case FormatCSV:
+		var err error
+		if next, err = csvReader[T](r, opts.Columns); err != nil {
+			return report, err
+		}
+	default:
+		return report, fmt.Errorf("%w: %s", ErrUnknownFormat, opts.Format)
+	}
+
+	batch := make([]T, 0, opts.BatchSize)
+	for {
+		item, err := next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return report, err
+		}
+		batch = append(batch, item)
+		if len(batch) == opts.BatchSize {
+			if err := manager.importBatch(batch, opts.OnConflict, &report); err != nil {
+				return report, err
+			}
+			batch = batch[:0]
+		}
+	}
+	return report, manager.importBatch(batch, opts.OnConflict, &report)
+}
+
+func (manager *Manager[T]) importBatch(batch []T, policy ConflictPolicy, report *ImportReport) error {
+	var fresh, withID, existing []T
+	pending := map[string]int{}
+
+	for _, item := range batch {
+		id := item.GetID()
+		if id == "" {
+			fresh = append(fresh, item)
+			continue
+		}
+
+		pos, inBatch := pending[id]
+		if !inBatch && !manager.exists(id) {
+			pending[id] = len(withID)
+			withID = append(withID, item)
+			continue
+		}
+
+		switch policy {
+		case ConflictSkip:
+			report.Skipped++
+		case ConflictUpsert:
+			if inBatch {
+				withID[pos] = item
+			} else {
+				existing = append(existing, item)
+			}
+		default:
+			manager.storeImported(fresh, withID, existing, report)
+			return fmt.Errorf("%w: %s", ErrImportConflict, id)
+		}
+	}
+
+	manager.storeImported(fresh, withID, existing, report)
+	return nil
+}
+
+func (manager *Manager[T]) storeImported(fresh, withID, existing []T, report *ImportReport) {
+	tally := func(results []BatchResult[T], ok *int) {
+		for _, r := range results {
+			if r.Err != nil {
+				report.Failed++
+				report.Errors = append(report.Errors, fmt.Sprintf("%s: %v", r.ID, r.Err))
+				continue
+			}
+			*ok++
+		}
+	}
+
+	results, _ := manager.CreateMany(fresh)
+	tally(results, &report.Created)
+	results, _ = manager.CreateManyWithID(withID)
+	tally(results, &report.Created)
+	results, _ = manager.UpdateMany(existing)
+	tally(results, &report.Updated)
+}
+
+func jsonlReader[T CollectionItem](r io.Reader) func() (T, error) {
+	dec := json.NewDecoder(r)
+	line := 0
+	return func() (T, error) {
+		var item T
+		line++
+		if err := dec.Decode(&item); err != nil {
+			if errors.Is(err, io.EOF) {
+				return item, io.EOF
+			}
+			return item, fmt.Errorf("record %d: %w", line, err)
+		}
+		return item, nil
+	}
+}
+
+func csvReader[T CollectionItem](r io.Reader, columns []Column) (func() (T, error), error) {
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV header: %w", err)
+	}
+
+	// Map each CSV position to the field it fills, by header name.
+	fieldFor := map[string]string{}
+	for _, col := range columns {
+		fieldFor[col.Header] = col.Field
+	}
+	fields := make([]string, len(header))
+	for i, name := range header {
+		if len(columns) == 0 {
+			fields[i] = name
+		} else {
+			fields[i] = fieldFor[name]
+		}
+	}
+
+	itemType := reflect.TypeOf((*T)(nil)).Elem()
+	line := 1
+	return func() (T, error) {
+		var item T
+		record, err := cr.Read()
+		line++
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return item, io.EOF
+			}
+			return item, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		row := map[string]any{}
+		for i, cell := range record {
+			if i >= len(fields) || fields[i] == "" || cell == "" {
+				continue
+			}
+			setPath(row, fields[i], csvValue(itemType, fields[i], cell))
+		}
+
+		raw, err := json.Marshal(row)
+		if err != nil {
+			return item, err
+		}
+		if err := json.Unmarshal(raw, &item); err != nil {
+			return item, fmt.Errorf("line %d: %w", line, err)
+		}
+		return item, nil
+	}, nil
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// csvValue turns a CSV cell into the JSON value the item's field expects:
+// a string for string and time fields, the literal otherwise. Cells that are
+// not valid JSON literals fall back to strings.
+func csvValue(itemType reflect.Type, field, cell string) any {
+	if field == "id" {
+		return cell
+	}
+	if t, ok := jsonFieldType(itemType, strings.Split(field, ".")); ok {
+		if t.Kind() == reflect.String || t == timeType {
+			return cell
+		}
+	}
+	var v any
+	dec := json.NewDecoder(strings.NewReader(cell))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return cell
+	}
+	return v
+}
@@ -0,0 +1,66 @@
+package collection_manager_v3
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportLazyCollectionStreamsInIDOrder(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "notes")
+	manager, err := NewCollectionManager[*note](dir, false, WithLazyLoading(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"c", "a", "b"} {
+		if _, err := manager.CreateWithID(&note{ID: id, Title: "note " + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := manager.Export(&out, ExportOptions{Format: FormatJSONL}); err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	dec := json.NewDecoder(&out)
+	for dec.More() {
+		var n note
+		if err := dec.Decode(&n); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, n.ID)
+	}
+	if strings.Join(ids, ",") != "a,b,c" {
+		t.Fatalf("exported %v", ids)
+	}
+}
+
+func TestExportCSVSkipsExpired(t *testing.T) {
+	manager, _, clock := newTestManager(t, WithTTL(time.Hour))
+	if _, err := manager.Create(&note{Title: "old"}); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Hour)
+	if _, err := manager.Create(&note{Title: "new", Size: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := manager.Export(&out, ExportOptions{Format: FormatCSV}); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("export = %q", out.String())
+	}
+	if lines[0] != "id,creationDate,modificationDate,size,title" {
+		t.Fatalf("header = %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], ",3,new") {
+		t.Fatalf("row = %q", lines[1])
+	}
+}
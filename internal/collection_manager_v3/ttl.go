@@ -0,0 +1,108 @@
+package collection_manager_v3
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+var ErrExpired = errors.New("item expired")
+
+// Expirer is implemented by items that carry their own expiry time, such as
+// upload sessions or one-time tokens. A zero time means the item does not
+// expire on its own; the collection TTL, if any, applies instead.
+type Expirer interface {
+	GetExpiresAt() time.Time
+}
+
+// ExpiresAt reports when item expires, if ever.
+func (manager *Manager[T]) ExpiresAt(item T) (time.Time, bool) {
+	if e, ok := any(item).(Expirer); ok {
+		if at := e.GetExpiresAt(); !at.IsZero() {
+			return at, true
+		}
+	}
+	if manager.ttl > 0 {
+		return item.GetCreatedAt().Add(manager.ttl), true
+	}
+	return time.Time{}, false
+}
+
+func (manager *Manager[T]) expired(item T, now time.Time) bool {
+	at, ok := manager.ExpiresAt(item)
+	return ok && !now.Before(at)
+}
+
+// lookup is items.Get that refuses IDs checkID rejects and hides items past
+// their expiry, which the sweeper may not have removed yet.
+func (manager *Manager[T]) lookup(id string) (T, error) {
+	if err := checkID(id); err != nil {
+		var zero T
+		return zero, err
+	}
+	item, err := manager.items.Get(id)
+	if err != nil {
+		return item, err
+	}
+	if manager.expired(item, manager.clock.Now()) {
+		var zero T
+		return zero, ErrExpired
+	}
+	return item, nil
+}
+
+// values is items.GetAllValues without expired items.
+func (manager *Manager[T]) values() []T {
+	all := manager.items.GetAllValues()
+	now := manager.clock.Now()
+	live := all[:0]
+	for _, item := range all {
+		if !manager.expired(item, now) {
+			live = append(live, item)
+		}
+	}
+	return live
+}
+
+// SweepExpired deletes every item past its expiry in one batch and reports
+// how many went. Listeners see ChangeExpire for each of them.
+func (manager *Manager[T]) SweepExpired() (int, error) {
+	now := manager.clock.Now()
+	var ids []string
+	for _, item := range manager.items.GetAllValues() {
+		if manager.expired(item, now) {
+			ids = append(ids, item.GetID())
+		}
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	results, err := manager.deleteMany(ids, ChangeExpire)
+	swept := 0
+	for _, r := range results {
+		if r.Err == nil {
+			swept++
+		}
+	}
+	return swept, err
+}
+
+// StartSweeper runs SweepExpired every interval until ctx is cancelled.
+func (manager *Manager[T]) StartSweeper(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := manager.SweepExpired(); err != nil {
+					log.Printf("failed to sweep expired items: %v", err)
+				}
+			}
+		}
+	}()
+}
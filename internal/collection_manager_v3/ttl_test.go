@@ -0,0 +1,133 @@
+package collection_manager_v3
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTTLHidesAndSweepsExpiredItems(t *testing.T) {
+	manager, store, clock := newTestManager(t, WithTTL(time.Hour))
+	var expired []string
+	manager.OnChange(func(e ChangeEvent[*note]) {
+		if e.Op == ChangeExpire {
+			expired = append(expired, e.ID)
+		}
+	})
+
+	old, err := manager.Create(&note{Title: "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(30 * time.Minute)
+	young, err := manager.Create(&note{Title: "young"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := manager.SweepExpired(); n != 0 || err != nil {
+		t.Fatalf("sweep before expiry: %d, %v", n, err)
+	}
+
+	clock.Advance(30*time.Minute - time.Nanosecond)
+	if _, err := manager.Get(old.ID); err != nil {
+		t.Fatalf("Get just before expiry: %v", err)
+	}
+
+	clock.Advance(time.Nanosecond)
+	if _, err := manager.Get(old.ID); !errors.Is(err, ErrExpired) {
+		t.Fatalf("Get at expiry: err = %v, want ErrExpired", err)
+	}
+	if n := manager.Count(nil); n != 1 {
+		t.Fatalf("Count = %d, want the unexpired item only", n)
+	}
+	if store.Len() != 2 {
+		t.Fatalf("expired item removed before the sweep")
+	}
+
+	n, err := manager.SweepExpired()
+	if err != nil || n != 1 {
+		t.Fatalf("sweep: %d, %v", n, err)
+	}
+	if store.Len() != 1 {
+		t.Fatalf("stored %d items after the sweep, want 1", store.Len())
+	}
+	if len(expired) != 1 || expired[0] != old.ID {
+		t.Fatalf("expire events for %v, want %s", expired, old.ID)
+	}
+	if _, err := manager.Get(young.ID); err != nil {
+		t.Fatalf("young item: %v", err)
+	}
+
+	clock.Advance(30 * time.Minute)
+	if n, err := manager.SweepExpired(); n != 1 || err != nil {
+		t.Fatalf("second sweep: %d, %v", n, err)
+	}
+	if store.Len() != 0 {
+		t.Fatalf("stored %d items after the second sweep", store.Len())
+	}
+}
+
+func TestItemExpiryOverridesTTL(t *testing.T) {
+	store, err := NewMemoryStorage[Document]()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := NewFakeClock(testEpoch)
+	manager, err := NewMemoryCollectionManager(store, WithClock(clock), WithTTL(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	docs := []Document{
+		{"id": "short", "expiresAt": testEpoch.Add(time.Minute)},
+		{"id": "long", "expiresAt": testEpoch.Add(24 * time.Hour)},
+		{"id": "ttl"},
+	}
+	for _, doc := range docs {
+		if _, err := manager.CreateWithID(doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		after time.Duration
+		left  int
+	}{
+		{time.Minute, 2},
+		{time.Hour, 1},
+		{24 * time.Hour, 0},
+	}
+	for _, tt := range tests {
+		clock.Set(testEpoch.Add(tt.after))
+		if _, err := manager.SweepExpired(); err != nil {
+			t.Fatal(err)
+		}
+		if store.Len() != tt.left {
+			t.Errorf("after %v: %d items left, want %d", tt.after, store.Len(), tt.left)
+		}
+	}
+}
+
+func TestFailedSweepKeepsItems(t *testing.T) {
+	manager, store, clock := newTestManager(t, WithTTL(time.Minute))
+	item, err := manager.Create(&note{Title: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(time.Minute)
+
+	store.FailNextWrite(errDiskFull)
+	if n, err := manager.SweepExpired(); n != 0 || !errors.Is(err, errDiskFull) {
+		t.Fatalf("sweep: %d, %v", n, err)
+	}
+	if store.Len() != 1 {
+		t.Fatal("item removed by a failed sweep")
+	}
+	if n, err := manager.SweepExpired(); n != 1 || err != nil {
+		t.Fatalf("retried sweep: %d, %v", n, err)
+	}
+	if _, err := manager.Get(item.ID); err == nil {
+		t.Fatal("swept item still found")
+	}
+}
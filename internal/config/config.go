@@ -1,12 +1,13 @@
 package config
 
 import (
-	"fmt"
 	"path/filepath"
 )
 
+// root is the directory all data is kept under; see SetRootDir.
+var root = "/app/iris/"
+
 const (
-	root        = "/app/iris/"
 	application = "com.iris.photos"
 	users       = "users"
 	Metadata    = "metadata"
@@ -18,14 +19,37 @@ func GetRootDir() string {
 	return root
 }
 
+// SetRootDir moves the root directory to dir, for tests and installations
+// that keep their data elsewhere. It must be called before any path is used.
+func SetRootDir(dir string) {
+	root = dir
+}
+
 // GetPath returns a file path within the application directory.
 func GetPath(file string) string {
 	return filepath.Join(root, application, file)
 }
 
+// GetKeyFilePath returns the keyfile holding the master keys that wrap the
+// per-user data keys. It lives outside the application directory so backups
+// of user data do not carry it along.
+func GetKeyFilePath() string {
+	return filepath.Join(root, "keys", "master.key")
+}
+
+// GetTokenKeyPath returns the key bearer tokens are signed with, kept with
+// the master keys.
+func GetTokenKeyPath() string {
+	return filepath.Join(root, "keys", "token.key")
+}
+
+// GetSnapshotDir returns where snapshots of the root directory are kept,
+// next to it rather than inside it.
+func GetSnapshotDir() string {
+	return filepath.Join(filepath.Dir(filepath.Clean(root)), "iris-snapshots")
+}
+
 // GetUserPath returns a file path specific to a user.
 func GetUserPath(phone string, file string) string {
-	pp := filepath.Join(root, application, users, phone, file)
-	fmt.Println(pp)
-	return pp
+	return filepath.Join(root, application, users, phone, file)
 }
@@ -0,0 +1,200 @@
+package imagemeta
+
+import (
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exifValuePattern splits the string libvips gives for an EXIF field,
+// "<raw> (<readable>, <type>, <n> components, <n> bytes)", where raw is the
+// value as stored, rationals as "n/d" separated by spaces.
+var exifValuePattern = regexp.MustCompile(`^(.*?) \((.*), ([A-Za-z ]+)(?:, \d+ components?)?, \d+ bytes?\)$`)
+
+const exifTimeLayout = "2006:01:02 15:04:05"
+
+type exifValue struct {
+	raw  string
+	text string
+}
+
+func parseExifValue(s string) exifValue {
+	m := exifValuePattern.FindStringSubmatch(s)
+	if m == nil {
+		return exifValue{raw: s, text: s}
+	}
+	return exifValue{raw: strings.TrimSpace(m[1]), text: strings.TrimSpace(m[2])}
+}
+
+// exifTags maps the exif-ifd<N>-<Tag> fields to their tag names. IFD1
+// describes the embedded thumbnail and is skipped; otherwise the lowest IFD
+// wins when a tag appears twice.
+func exifTags(fields map[string]string) map[string]exifValue {
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+
+	tags := make(map[string]exifValue, len(names))
+	for _, field := range names {
+		ifd, tag, ok := strings.Cut(strings.TrimPrefix(field, exifPrefix), "-")
+		if !ok || ifd == "ifd1" {
+			continue
+		}
+		if _, seen := tags[tag]; !seen {
+			tags[tag] = parseExifValue(fields[field])
+		}
+	}
+	return tags
+}
+
+func (meta *Metadata) fromExif(tags map[string]exifValue) {
+	text := func(tag string) string { return tags[tag].text }
+
+	meta.Make = text("Make")
+	meta.Model = text("Model")
+	meta.Lens = text("LensModel")
+	if meta.Lens == "" {
+		meta.Lens = text("LensMake")
+	}
+	meta.Description = text("ImageDescription")
+	meta.Creator = text("Artist")
+	meta.Copyright = text("Copyright")
+
+	if v, ok := tags["ExposureTime"]; ok {
+		meta.ExposureTime = exposure(v.raw)
+	}
+	if f, ok := rational(tags["FNumber"].raw); ok {
+		meta.FNumber = round(f, 1)
+	}
+	if f, ok := rational(tags["FocalLength"].raw); ok {
+		meta.FocalLength = round(f, 1)
+	}
+	for _, tag := range []string{"ISOSpeedRatings", "PhotographicSensitivity"} {
+		if iso, err := strconv.Atoi(firstField(tags[tag].raw)); err == nil && iso > 0 {
+			meta.ISO = iso
+			break
+		}
+	}
+
+	for _, pair := range [][2]string{
+		{"DateTimeOriginal", "OffsetTimeOriginal"},
+		{"DateTimeDigitized", "OffsetTimeDigitized"},
+		{"DateTime", "OffsetTime"},
+	} {
+		if t, ok := exifTime(tags[pair[0]].raw, tags[pair[1]].raw); ok {
+			meta.setCaptureTime(t)
+			break
+		}
+	}
+
+	meta.GPS = exifGPS(tags)
+}
+
+// exifTime parses an EXIF date in the zone of offset, "+02:00", or in UTC
+// when the image does not say which zone it was taken in.
+func exifTime(value string, offset string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	if offset != "" {
+		if t, err := time.Parse(exifTimeLayout+"-07:00", value+offset); err == nil {
+			return t, true
+		}
+	}
+	t, err := time.Parse(exifTimeLayout, value)
+	return t, err == nil && !t.IsZero()
+}
+
+func exifGPS(tags map[string]exifValue) *GPS {
+	lat, okLat := degrees(tags["GPSLatitude"].raw)
+	lon, okLon := degrees(tags["GPSLongitude"].raw)
+	if !okLat || !okLon {
+		return nil
+	}
+	if strings.HasPrefix(strings.ToUpper(tags["GPSLatitudeRef"].text), "S") {
+		lat = -lat
+	}
+	if strings.HasPrefix(strings.ToUpper(tags["GPSLongitudeRef"].text), "W") {
+		lon = -lon
+	}
+
+	gps := &GPS{Latitude: round(lat, 6), Longitude: round(lon, 6)}
+	if alt, ok := rational(tags["GPSAltitude"].raw); ok {
+		ref := tags["GPSAltitudeRef"]
+		if ref.raw == "1" || strings.Contains(strings.ToLower(ref.text), "below") {
+			alt = -alt
+		}
+		gps.Altitude, gps.HasAltitude = round(alt, 1), true
+	}
+	return gps
+}
+
+// degrees converts "d/1 m/1 s/100" to decimal degrees.
+func degrees(raw string) (float64, bool) {
+	parts := strings.Fields(raw)
+	if len(parts) == 0 || len(parts) > 3 {
+		return 0, false
+	}
+	value, scale := 0.0, 1.0
+	for _, part := range parts {
+		f, ok := rational(part)
+		if !ok {
+			return 0, false
+		}
+		value += f / scale
+		scale *= 60
+	}
+	return value, true
+}
+
+// rational parses the first component of a raw value, "n/d" or a plain
+// number.
+func rational(raw string) (float64, bool) {
+	raw = firstField(raw)
+	if raw == "" {
+		return 0, false
+	}
+	num, den, isFraction := strings.Cut(raw, "/")
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, false
+	}
+	if !isFraction {
+		return n, true
+	}
+	d, err := strconv.ParseFloat(den, 64)
+	if err != nil || d == 0 {
+		return 0, false
+	}
+	return n / d, true
+}
+
+// exposure renders an exposure time as photographers write it: "1/125"
+// below a second, "2.5" from a second up.
+func exposure(raw string) string {
+	f, ok := rational(raw)
+	if !ok || f <= 0 {
+		return ""
+	}
+	if f >= 1 {
+		return strconv.FormatFloat(round(f, 1), 'f', -1, 64)
+	}
+	return "1/" + strconv.FormatFloat(round(1/f, 0), 'f', -1, 64)
+}
+
+func firstField(raw string) string {
+	if fields := strings.Fields(raw); len(fields) > 0 {
+		return fields[0]
+	}
+	return ""
+}
+
+func round(f float64, digits int) float64 {
+	scale := math.Pow10(digits)
+	return math.Round(f*scale) / scale
+}
@@ -0,0 +1,128 @@
+// Package imagemeta reads the EXIF, XMP and IPTC metadata libvips exposes on
+// a decoded image into one Metadata record.
+package imagemeta
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/cshum/vipsgen/vips"
+)
+
+const (
+	exifPrefix = "exif-"
+	xmpField   = "xmp-data"
+	iptcField  = "iptc-data"
+)
+
+// GPS is a position in decimal degrees; Altitude is in metres above sea
+// level and only meaningful when HasAltitude is set.
+type GPS struct {
+	Latitude    float64 `json:"latitude"`
+	Longitude   float64 `json:"longitude"`
+	Altitude    float64 `json:"altitude,omitempty"`
+	HasAltitude bool    `json:"hasAltitude,omitempty"`
+}
+
+// Metadata is what an image says about itself. The typed fields are filled
+// from whichever of EXIF, XMP and IPTC carries them, in that order; the raw
+// maps keep everything that was found.
+type Metadata struct {
+	CaptureTime  *time.Time `json:"captureTime,omitempty"`
+	Make         string     `json:"make,omitempty"`
+	Model        string     `json:"model,omitempty"`
+	Lens         string     `json:"lens,omitempty"`
+	ExposureTime string     `json:"exposureTime,omitempty"` // as a fraction of a second, "1/125"
+	FNumber      float64    `json:"fNumber,omitempty"`
+	ISO          int        `json:"iso,omitempty"`
+	FocalLength  float64    `json:"focalLength,omitempty"` // millimetres
+	Orientation  int        `json:"orientation,omitempty"`
+	GPS          *GPS       `json:"gps,omitempty"`
+
+	Title       string   `json:"title,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Creator     string   `json:"creator,omitempty"`
+	Copyright   string   `json:"copyright,omitempty"`
+	Keywords    []string `json:"keywords,omitempty"`
+
+	EXIF map[string]string   `json:"exif,omitempty"` // tag name to its readable value
+	XMP  map[string]string   `json:"xmp,omitempty"`  // "prefix:Property" to value
+	IPTC map[string][]string `json:"iptc,omitempty"` // dataset name to values
+}
+
+// Extract reads the metadata of img. Metadata that does not parse is left
+// out rather than failing the whole extraction.
+func Extract(img *vips.Image) Metadata {
+	exif := map[string]string{}
+	for _, field := range img.GetFields() {
+		if !strings.HasPrefix(field, exifPrefix) || field == "exif-data" {
+			continue
+		}
+		if value, err := img.GetString(field); err == nil {
+			exif[field] = value
+		}
+	}
+	xmp, _ := img.GetBlob(xmpField)
+	iptc, _ := img.GetBlob(iptcField)
+	return parse(exif, xmp, iptc, img.Orientation())
+}
+
+// ExtractFile decodes the header of the image at path and extracts its
+// metadata.
+func ExtractFile(path string) (Metadata, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Metadata{}, err
+	}
+	source := vips.NewSource(f)
+	defer source.Close()
+	img, err := vips.NewImageFromSource(source, nil)
+	if err != nil {
+		return Metadata{}, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	defer img.Close()
+	return Extract(img), nil
+}
+
+// parse builds Metadata from the exif-* fields libvips sets, keyed by field
+// name, and the raw XMP packet and IPTC block.
+func parse(exif map[string]string, xmp []byte, iptc []byte, orientation int) Metadata {
+	var meta Metadata
+	if orientation > 0 {
+		meta.Orientation = orientation
+	}
+	if tags := exifTags(exif); len(tags) > 0 {
+		meta.EXIF = make(map[string]string, len(tags))
+		for tag, value := range tags {
+			meta.EXIF[tag] = value.text
+		}
+		meta.fromExif(tags)
+	}
+	if props := parseXMP(xmp); len(props) > 0 {
+		meta.XMP = make(map[string]string, len(props))
+		for name, values := range props {
+			meta.XMP[name] = strings.Join(values, ", ")
+		}
+		meta.fromXMP(props)
+	}
+	if sets := parseIPTC(iptc); len(sets) > 0 {
+		meta.IPTC = sets
+		meta.fromIPTC(sets)
+	}
+	return meta
+}
+
+// setCaptureTime keeps the first capture time found.
+func (meta *Metadata) setCaptureTime(t time.Time) {
+	if meta.CaptureTime == nil {
+		meta.CaptureTime = &t
+	}
+}
+
+func setIfEmpty(dst *string, value string) {
+	if *dst == "" {
+		*dst = strings.TrimSpace(value)
+	}
+}
@@ -0,0 +1,260 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// iim encodes datasets of the application record as an IIM block.
+func iim(datasets ...any) []byte {
+	var block []byte
+	for i := 0; i < len(datasets); i += 2 {
+		value := []byte(datasets[i+1].(string))
+		block = append(block, iimMarker, iimApplication, byte(datasets[i].(int)), 0, 0)
+		binary.BigEndian.PutUint16(block[len(block)-2:], uint16(len(value)))
+		block = append(block, value...)
+	}
+	return block
+}
+
+// photoshop wraps data in a Photoshop image resource block holding it as
+// resource id, behind an unrelated resource.
+func photoshop(id uint16, data []byte) []byte {
+	block := []byte(photoshopSignature)
+	resource := func(id uint16, name string, data []byte) {
+		block = append(block, "8BIM"...)
+		block = binary.BigEndian.AppendUint16(block, id)
+		block = append(block, byte(len(name)))
+		block = append(block, name...)
+		if (len(name)+1)%2 != 0 {
+			block = append(block, 0)
+		}
+		block = binary.BigEndian.AppendUint32(block, uint32(len(data)))
+		block = append(block, data...)
+		if len(data)%2 != 0 {
+			block = append(block, 0)
+		}
+	}
+	resource(0x0425, "digest", []byte{1, 2, 3})
+	resource(id, "", data)
+	return block
+}
+
+func TestParseExif(t *testing.T) {
+	exif := map[string]string{
+		"exif-ifd0-Make":               "Canon (Canon, ASCII, 6 bytes)",
+		"exif-ifd0-Model":              "Canon EOS R5 (Canon EOS R5, ASCII, 13 bytes)",
+		"exif-ifd0-Artist":             "Ann (Ann, ASCII, 4 bytes)",
+		"exif-ifd0-DateTime":           "2024:01:02 03:04:05 (2024:01:02 03:04:05, ASCII, 20 bytes)",
+		"exif-ifd1-Make":               "Thumb (Thumb, ASCII, 6 bytes)",
+		"exif-ifd2-ExposureTime":       "1/125 (1/125 sec., Rational, 1 components, 8 bytes)",
+		"exif-ifd2-FNumber":            "28/10 (f/2.8, Rational, 1 components, 8 bytes)",
+		"exif-ifd2-FocalLength":        "50/1 (50.0 mm, Rational, 1 components, 8 bytes)",
+		"exif-ifd2-ISOSpeedRatings":    "400 (400, Short, 1 components, 2 bytes)",
+		"exif-ifd2-DateTimeOriginal":   "2023:07:14 18:30:00 (2023:07:14 18:30:00, ASCII, 20 bytes)",
+		"exif-ifd2-OffsetTimeOriginal": "+02:00 (+02:00, ASCII, 7 bytes)",
+		"exif-ifd2-LensModel":          "RF50mm F1.8 STM (RF50mm F1.8 STM, ASCII, 16 bytes)",
+		"exif-ifd3-GPSLatitudeRef":     "S (S, ASCII, 2 bytes)",
+		"exif-ifd3-GPSLatitude":        "33/1 51/1 3540/100 (33, 51, 35.40, Rational, 3 components, 24 bytes)",
+		"exif-ifd3-GPSLongitudeRef":    "E (E, ASCII, 2 bytes)",
+		"exif-ifd3-GPSLongitude":       "151/1 12/1 3060/100 (151, 12, 30.60, Rational, 3 components, 24 bytes)",
+		"exif-ifd3-GPSAltitudeRef":     "1 (Below sea level, Byte, 1 components, 1 bytes)",
+		"exif-ifd3-GPSAltitude":        "125/10 (12.5 m, Rational, 1 components, 8 bytes)",
+	}
+	meta := parse(exif, nil, nil, 6)
+
+	want := Metadata{
+		Make:         "Canon",
+		Model:        "Canon EOS R5",
+		Lens:         "RF50mm F1.8 STM",
+		Creator:      "Ann",
+		ExposureTime: "1/125",
+		FNumber:      2.8,
+		FocalLength:  50,
+		ISO:          400,
+		Orientation:  6,
+		GPS:          &GPS{Latitude: -33.859833, Longitude: 151.2085, Altitude: -12.5, HasAltitude: true},
+	}
+	captured := time.Date(2023, 7, 14, 16, 30, 0, 0, time.UTC)
+	if meta.CaptureTime == nil || !meta.CaptureTime.Equal(captured) {
+		t.Errorf("CaptureTime = %v, want %v", meta.CaptureTime, captured)
+	}
+	want.CaptureTime, want.EXIF = meta.CaptureTime, meta.EXIF
+	if !reflect.DeepEqual(meta, want) {
+		t.Errorf("parse =\n%+v\nwant\n%+v", meta, want)
+	}
+	if meta.EXIF["Make"] != "Canon" || meta.EXIF["FNumber"] != "f/2.8" {
+		t.Errorf("raw EXIF %v: want readable values from IFD0 and IFD2", meta.EXIF)
+	}
+}
+
+func TestParseXMP(t *testing.T) {
+	packet := []byte(`<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:tiff="http://ns.adobe.com/tiff/1.0/"
+    xmlns:exif="http://ns.adobe.com/exif/1.0/"
+    xmlns:photoshop="http://ns.adobe.com/photoshop/1.0/"
+    xmlns:other="http://example.com/other/"
+    tiff:Make="Nikon" exif:FNumber="4/1" exif:ExposureTime="2/1"
+    exif:GPSLatitude="48,51.4N" exif:GPSLongitude="2,17,40W"
+    photoshop:DateCreated="2022-05-01T10:00:00+01:00" other:Secret="x">
+   <dc:title><rdf:Alt><rdf:li xml:lang="x-default">Bridge</rdf:li></rdf:Alt></dc:title>
+   <dc:creator><rdf:Seq><rdf:li>Ann</rdf:li><rdf:li>Bob</rdf:li></rdf:Seq></dc:creator>
+   <dc:subject><rdf:Bag><rdf:li>river</rdf:li><rdf:li>night</rdf:li></rdf:Bag></dc:subject>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`)
+	meta := parse(nil, packet, nil, 0)
+
+	if meta.Make != "Nikon" || meta.Title != "Bridge" || meta.Creator != "Ann, Bob" {
+		t.Errorf("Make %q, Title %q, Creator %q", meta.Make, meta.Title, meta.Creator)
+	}
+	if !reflect.DeepEqual(meta.Keywords, []string{"river", "night"}) {
+		t.Errorf("Keywords = %v", meta.Keywords)
+	}
+	if meta.FNumber != 4 || meta.ExposureTime != "2" {
+		t.Errorf("FNumber %v, ExposureTime %q", meta.FNumber, meta.ExposureTime)
+	}
+	if meta.GPS == nil || meta.GPS.Latitude != 48.856667 || meta.GPS.Longitude != -2.294444 {
+		t.Errorf("GPS = %+v", meta.GPS)
+	}
+	if want := time.Date(2022, 5, 1, 9, 0, 0, 0, time.UTC); meta.CaptureTime == nil || !meta.CaptureTime.Equal(want) {
+		t.Errorf("CaptureTime = %v, want %v", meta.CaptureTime, want)
+	}
+	if _, ok := meta.XMP["other:Secret"]; ok {
+		t.Errorf("property of an unknown schema read: %v", meta.XMP)
+	}
+	if meta.XMP["dc:subject"] != "river, night" {
+		t.Errorf("raw XMP dc:subject = %q", meta.XMP["dc:subject"])
+	}
+
+	// A broken packet keeps what was read before the break.
+	broken := packet[:bytes.Index(packet, []byte("<dc:creator>"))+len("<dc:creator><rdf:Seq><rdf:li>An")]
+	if props := parseXMP(broken); len(props["tiff:Make"]) != 1 || len(props["dc:title"]) != 1 {
+		t.Errorf("truncated packet: %v", props)
+	}
+}
+
+func TestParseIPTC(t *testing.T) {
+	block := iim(
+		5, "Harbour",
+		25, "boats",
+		25, "sea",
+		80, "Caf\xe9 Press", // Latin-1
+		116, "(c) Ann",
+		55, "20210310",
+		60, "143000+0100",
+		200, "unknown dataset",
+	)
+
+	for name, data := range map[string][]byte{
+		"plain":     block,
+		"photoshop": photoshop(photoshopIPTC, block),
+	} {
+		meta := parse(nil, nil, data, 0)
+		if meta.Title != "Harbour" || meta.Creator != "Café Press" || meta.Copyright != "(c) Ann" {
+			t.Errorf("%s: Title %q, Creator %q, Copyright %q", name, meta.Title, meta.Creator, meta.Copyright)
+		}
+		if !reflect.DeepEqual(meta.Keywords, []string{"boats", "sea"}) {
+			t.Errorf("%s: Keywords = %v", name, meta.Keywords)
+		}
+		if want := time.Date(2021, 3, 10, 13, 30, 0, 0, time.UTC); meta.CaptureTime == nil || !meta.CaptureTime.Equal(want) {
+			t.Errorf("%s: CaptureTime = %v, want %v", name, meta.CaptureTime, want)
+		}
+		if len(meta.IPTC) != 6 {
+			t.Errorf("%s: IPTC = %v", name, meta.IPTC)
+		}
+	}
+
+	if sets := parseIPTC(photoshop(0x0425, block)); len(sets) != 0 {
+		t.Errorf("resource without IIM data read as %v", sets)
+	}
+	truncated := iim(5, "Harbour", 116, "(c) Ann")
+	if sets := parseIPTC(truncated[:len(truncated)-3]); len(sets["ObjectName"]) != 1 || len(sets["CopyrightNotice"]) != 0 {
+		t.Errorf("truncated block read as %v", sets)
+	}
+}
+
+func TestSourcePrecedence(t *testing.T) {
+	exif := map[string]string{
+		"exif-ifd0-Make":             "Canon (Canon, ASCII, 6 bytes)",
+		"exif-ifd2-DateTimeOriginal": "2020:01:01 00:00:00 (2020:01:01 00:00:00, ASCII, 20 bytes)",
+	}
+	packet := []byte(`<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+ <rdf:Description xmlns:tiff="http://ns.adobe.com/tiff/1.0/" xmlns:dc="http://purl.org/dc/elements/1.1/"
+   tiff:Make="Nikon" tiff:Model="D850">
+  <dc:title><rdf:Alt><rdf:li>From XMP</rdf:li></rdf:Alt></dc:title>
+ </rdf:Description>
+</rdf:RDF>`)
+	meta := parse(exif, packet, iim(5, "From IPTC", 55, "19991231"), 0)
+
+	if meta.Make != "Canon" || meta.Model != "D850" || meta.Title != "From XMP" {
+		t.Errorf("Make %q, Model %q, Title %q", meta.Make, meta.Model, meta.Title)
+	}
+	if want := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC); !meta.CaptureTime.Equal(want) {
+		t.Errorf("CaptureTime = %v, want the EXIF one", meta.CaptureTime)
+	}
+}
+
+func TestExifValues(t *testing.T) {
+	tests := []struct {
+		raw      string
+		exposure string
+		degrees  float64
+		ok       bool
+	}{
+		{"1/250", "1/250", 0.004, true},
+		{"10/3", "3.3", 3.333333, true},
+		{"5", "5", 5, true},
+		{"1/0", "", 0, false},
+		{"", "", 0, false},
+		{"x/2", "", 0, false},
+	}
+	for _, tt := range tests {
+		if got := exposure(tt.raw); got != tt.exposure {
+			t.Errorf("exposure(%q) = %q, want %q", tt.raw, got, tt.exposure)
+		}
+		if got, ok := degrees(tt.raw); ok != tt.ok || round(got, 6) != tt.degrees {
+			t.Errorf("degrees(%q) = %v, %v", tt.raw, got, ok)
+		}
+	}
+	if _, ok := degrees("1/1 2/1 3/1 4/1"); ok {
+		t.Error("degrees with four components parsed")
+	}
+
+	if v := parseExifValue("not the libvips form"); v.raw != v.text {
+		t.Errorf("unparsed value split into %+v", v)
+	}
+	if _, ok := exifTime("0000:00:00 00:00:00", ""); ok {
+		t.Error("zero EXIF date parsed")
+	}
+	if tm, ok := exifTime("2024:02:29 12:00:00", "bogus"); !ok || tm.Location() != time.UTC {
+		t.Errorf("date with a bad offset: %v, %v; want it in UTC", tm, ok)
+	}
+}
+
+func TestXMPCoordinate(t *testing.T) {
+	tests := []struct {
+		value string
+		want  float64
+		ok    bool
+	}{
+		{"48,51.4N", 48.856667, true},
+		{"2,17,40W", -2.294444, true},
+		{"33,30S", -33.5, true},
+		{" 10,0E ", 10, true},
+		{"48,51.4", 0, false},
+		{"N", 0, false},
+		{"a,bN", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := xmpCoordinate(tt.value)
+		if ok != tt.ok || round(got, 6) != tt.want {
+			t.Errorf("xmpCoordinate(%q) = %v, %v; want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
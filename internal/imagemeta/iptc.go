@@ -0,0 +1,144 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	iimMarker          = 0x1c
+	iimApplication     = 2 // the IIM record holding descriptive datasets
+	photoshopSignature = "Photoshop 3.0\x00"
+	photoshopIPTC      = 0x0404 // image resource holding the IIM block
+)
+
+// iimDatasets names the application record datasets that are read.
+var iimDatasets = map[byte]string{
+	5:   "ObjectName",
+	25:  "Keywords",
+	55:  "DateCreated",
+	60:  "TimeCreated",
+	80:  "By-line",
+	90:  "City",
+	92:  "Sub-location",
+	95:  "Province-State",
+	101: "Country-PrimaryLocationName",
+	105: "Headline",
+	110: "Credit",
+	115: "Source",
+	116: "CopyrightNotice",
+	120: "Caption-Abstract",
+	122: "Writer-Editor",
+}
+
+// parseIPTC reads the IIM application record from block, which libvips
+// passes on as it was stored: a Photoshop image resource block in JPEG,
+// plain IIM elsewhere. Values are UTF-8, or Latin-1 converted to it.
+func parseIPTC(block []byte) map[string][]string {
+	sets := map[string][]string{}
+	if bytes.HasPrefix(block, []byte(photoshopSignature)) {
+		block = photoshopResource(block[len(photoshopSignature):], photoshopIPTC)
+	}
+
+	for i := 0; i+5 <= len(block); {
+		if block[i] != iimMarker {
+			i++
+			continue
+		}
+		record, dataset := block[i+1], block[i+2]
+		size := int(binary.BigEndian.Uint16(block[i+3 : i+5]))
+		if size&0x8000 != 0 {
+			// Extended lengths are only used for binary datasets.
+			return sets
+		}
+		start, end := i+5, i+5+size
+		if end > len(block) {
+			return sets
+		}
+		if name, ok := iimDatasets[dataset]; ok && record == iimApplication {
+			if value := strings.TrimSpace(iimString(block[start:end])); value != "" {
+				sets[name] = append(sets[name], value)
+			}
+		}
+		i = end
+	}
+	return sets
+}
+
+// photoshopResource returns the data of image resource id from a sequence
+// of "8BIM" resources, or nil.
+func photoshopResource(block []byte, id uint16) []byte {
+	for len(block) >= 12 && string(block[:4]) == "8BIM" {
+		resource := binary.BigEndian.Uint16(block[4:6])
+		// A Pascal string name, padded to an even length.
+		nameLen := int(block[6]) + 1
+		nameLen += nameLen % 2
+		at := 6 + nameLen
+		if at+4 > len(block) {
+			return nil
+		}
+		size := int(binary.BigEndian.Uint32(block[at : at+4]))
+		start, end := at+4, at+4+size
+		if size < 0 || end > len(block) {
+			return nil
+		}
+		if resource == id {
+			return block[start:end]
+		}
+		block = block[end+size%2:]
+	}
+	return nil
+}
+
+func iimString(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+func (meta *Metadata) fromIPTC(sets map[string][]string) {
+	first := func(name string) string {
+		if values := sets[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	setIfEmpty(&meta.Title, first("ObjectName"))
+	setIfEmpty(&meta.Title, first("Headline"))
+	setIfEmpty(&meta.Description, first("Caption-Abstract"))
+	setIfEmpty(&meta.Creator, strings.Join(sets["By-line"], ", "))
+	setIfEmpty(&meta.Copyright, first("CopyrightNotice"))
+	if len(meta.Keywords) == 0 {
+		meta.Keywords = sets["Keywords"]
+	}
+	if t, ok := iptcTime(first("DateCreated"), first("TimeCreated")); ok {
+		meta.setCaptureTime(t)
+	}
+}
+
+// iptcTime combines DateCreated, CCYYMMDD, with TimeCreated, HHMMSS±HHMM,
+// if there is one.
+func iptcTime(date string, clock string) (time.Time, bool) {
+	if date == "" {
+		return time.Time{}, false
+	}
+	if clock != "" {
+		if t, err := time.Parse("20060102150405-0700", date+clock); err == nil {
+			return t, true
+		}
+		if t, err := time.Parse("20060102150405", date+clock); err == nil {
+			return t, true
+		}
+	}
+	t, err := time.Parse("20060102", date)
+	return t, err == nil
+}
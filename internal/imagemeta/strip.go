@@ -0,0 +1,175 @@
+package imagemeta
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cshum/vipsgen/vips"
+)
+
+// stripQuality is the quality images are re-encoded at once stripped.
+const stripQuality = 90
+
+// ErrCannotStrip is returned by StripBuffer for formats it cannot write back.
+var ErrCannotStrip = errors.New("cannot strip metadata of this format")
+
+// Policy says which personal metadata Strip removes. Orientation and the ICC
+// colour profile are always kept, so a stripped image displays as before.
+//
+// The XMP packet and IPTC block repeat the same information in free form and
+// libvips can only keep or drop them whole, so any policy that removes
+// something drops them.
+type Policy struct {
+	GPS     bool // every GPS tag
+	Serials bool // body and lens serial numbers, the image unique ID and the maker note that repeats them
+	Owner   bool // the camera owner's and the artist's names
+}
+
+// Private removes everything a policy can. Thumbnails are always stripped
+// with it.
+var Private = Policy{GPS: true, Serials: true, Owner: true}
+
+var (
+	serialTags = map[string]bool{
+		"BodySerialNumber": true,
+		"LensSerialNumber": true,
+		"ImageUniqueID":    true,
+		"MakerNote":        true,
+	}
+	ownerTags = map[string]bool{
+		"CameraOwnerName": true,
+		"Artist":          true,
+		"XPAuthor":        true,
+	}
+)
+
+// IsZero reports whether p removes nothing.
+func (p Policy) IsZero() bool {
+	return p == Policy{}
+}
+
+// Keep is the metadata to write when saving an image stripped under p.
+func (p Policy) Keep() vips.Keep {
+	if p.IsZero() {
+		return vips.KeepAll
+	}
+	return vips.KeepExif | vips.KeepIcc
+}
+
+// removes reports whether p removes the exif-ifd<N>-<Tag> field. IFD1 only
+// describes the embedded thumbnail, which stripping never keeps.
+func (p Policy) removes(field string) bool {
+	ifd, tag, _ := strings.Cut(strings.TrimPrefix(field, exifPrefix), "-")
+	switch {
+	case ifd == "ifd1":
+		return true
+	case p.GPS && (ifd == "ifd3" || strings.HasPrefix(tag, "GPS")):
+		return true
+	case p.Serials && serialTags[tag]:
+		return true
+	case p.Owner && ownerTags[tag]:
+		return true
+	}
+	return false
+}
+
+// finds reports whether an image with the given fields carries anything p
+// removes.
+func (p Policy) finds(fields []string) bool {
+	if p.IsZero() {
+		return false
+	}
+	for _, field := range fields {
+		if field == xmpField || field == iptcField {
+			return true
+		}
+		if strings.HasPrefix(field, exifPrefix) && field != "exif-data" && p.removes(field) {
+			return true
+		}
+	}
+	return false
+}
+
+// Strip removes the metadata p names from img. The EXIF tags p keeps are
+// rebuilt from img's fields, which libvips writes back when the image is
+// saved with p.Keep(). Without that the original metadata is saved as is.
+func Strip(img *vips.Image, p Policy) error {
+	if p.IsZero() {
+		return nil
+	}
+	kept := map[string]string{}
+	for _, field := range img.GetFields() {
+		if !strings.HasPrefix(field, exifPrefix) || field == "exif-data" || p.removes(field) {
+			continue
+		}
+		if value, err := img.GetString(field); err == nil {
+			kept[field] = value
+		}
+	}
+
+	// RemoveExif drops every field but orientation and the ICC profile.
+	if err := img.RemoveExif(); err != nil {
+		return fmt.Errorf("failed to strip metadata: %w", err)
+	}
+	for field, value := range kept {
+		img.SetString(field, value)
+	}
+	return nil
+}
+
+// StripBuffer returns the encoded image buf stripped under p, re-encoded in
+// its own format. Images carrying nothing p removes are returned unchanged.
+func StripBuffer(buf []byte, p Policy) ([]byte, error) {
+	img, err := vips.NewImageFromBuffer(buf, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+	defer img.Close()
+	if !p.finds(img.GetFields()) {
+		return buf, nil
+	}
+	if img.Pages() > 1 {
+		// Load every frame, not just the first.
+		all, err := vips.NewImageFromBuffer(buf, &vips.LoadOptions{N: -1})
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode image: %w", err)
+		}
+		defer all.Close()
+		img = all
+	}
+
+	if err := Strip(img, p); err != nil {
+		return nil, err
+	}
+	keep := p.Keep()
+	format := img.Format()
+	if format == vips.ImageTypeHeif && isAVIF(buf) {
+		// libvips loads AVIF with its HEIF loader and reports it as HEIF.
+		format = vips.ImageTypeAvif
+	}
+	switch format {
+	case vips.ImageTypeJpeg:
+		return img.JpegsaveBuffer(&vips.JpegsaveBufferOptions{Q: stripQuality, Keep: keep})
+	case vips.ImageTypePng:
+		return img.PngsaveBuffer(&vips.PngsaveBufferOptions{Keep: keep})
+	case vips.ImageTypeWebp:
+		return img.WebpsaveBuffer(&vips.WebpsaveBufferOptions{Q: stripQuality, Keep: keep})
+	case vips.ImageTypeHeif:
+		return img.HeifsaveBuffer(&vips.HeifsaveBufferOptions{Q: stripQuality, Keep: keep})
+	case vips.ImageTypeAvif:
+		return img.HeifsaveBuffer(&vips.HeifsaveBufferOptions{Q: stripQuality, Compression: vips.HeifCompressionAv1, Keep: keep})
+	case vips.ImageTypeTiff:
+		return img.TiffsaveBuffer(&vips.TiffsaveBufferOptions{Keep: keep})
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrCannotStrip, format)
+	}
+}
+
+func isAVIF(buf []byte) bool {
+	if len(buf) < 12 || string(buf[4:8]) != "ftyp" {
+		return false
+	}
+	brand := string(buf[8:12])
+	return brand == "avif" || brand == "avis"
+}
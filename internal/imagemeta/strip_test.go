@@ -0,0 +1,92 @@
+package imagemeta
+
+import (
+	"testing"
+
+	"github.com/cshum/vipsgen/vips"
+)
+
+func TestPolicyRemoves(t *testing.T) {
+	gpsOnly := Policy{GPS: true}
+	serialsOnly := Policy{Serials: true}
+	ownerOnly := Policy{Owner: true}
+
+	tests := []struct {
+		field string
+		// whether Private, GPS only, serials only, owner only and the zero
+		// policy remove it
+		private, gps, serials, owner, keep bool
+	}{
+		{"exif-ifd0-Make", false, false, false, false, false},
+		{"exif-ifd0-Orientation", false, false, false, false, false},
+		{"exif-ifd2-DateTimeOriginal", false, false, false, false, false},
+		{"exif-ifd1-Compression", true, true, true, true, true},
+		{"exif-ifd1-JPEGInterchangeFormat", true, true, true, true, true},
+		{"exif-ifd3-GPSLatitude", true, true, false, false, false},
+		{"exif-ifd3-GPSVersionID", true, true, false, false, false},
+		{"exif-ifd2-GPSLongitude", true, true, false, false, false},
+		{"exif-ifd2-BodySerialNumber", true, false, true, false, false},
+		{"exif-ifd2-LensSerialNumber", true, false, true, false, false},
+		{"exif-ifd2-ImageUniqueID", true, false, true, false, false},
+		{"exif-ifd2-MakerNote", true, false, true, false, false},
+		{"exif-ifd2-CameraOwnerName", true, false, false, true, false},
+		{"exif-ifd0-Artist", true, false, false, true, false},
+		{"exif-ifd0-XPAuthor", true, false, false, true, false},
+	}
+	for _, tt := range tests {
+		for _, c := range []struct {
+			name   string
+			policy Policy
+			want   bool
+		}{
+			{"Private", Private, tt.private},
+			{"GPS", gpsOnly, tt.gps},
+			{"Serials", serialsOnly, tt.serials},
+			{"Owner", ownerOnly, tt.owner},
+			{"zero", Policy{}, tt.keep},
+		} {
+			if got := c.policy.removes(tt.field); got != c.want {
+				t.Errorf("%s policy removes %s = %v, want %v", c.name, tt.field, got, c.want)
+			}
+		}
+	}
+}
+
+func TestPolicyFinds(t *testing.T) {
+	plain := []string{"width", "height", "exif-data", "exif-ifd0-Make", "exif-ifd0-Orientation", "icc-profile-data"}
+	tests := []struct {
+		name   string
+		policy Policy
+		fields []string
+		want   bool
+	}{
+		{"nothing personal", Private, plain, false},
+		{"no fields", Private, nil, false},
+		{"gps", Private, append(plain, "exif-ifd3-GPSLatitude"), true},
+		{"gps kept", Policy{Owner: true}, append(plain, "exif-ifd3-GPSLatitude"), false},
+		{"serial", Policy{Serials: true}, append(plain, "exif-ifd2-BodySerialNumber"), true},
+		{"owner", Policy{Owner: true}, append(plain, "exif-ifd0-Artist"), true},
+		{"embedded thumbnail", Policy{GPS: true}, append(plain, "exif-ifd1-Compression"), true},
+		{"xmp", Policy{GPS: true}, append(plain, xmpField), true},
+		{"iptc", Policy{Owner: true}, append(plain, iptcField), true},
+		// A policy that keeps everything never strips, whatever is there.
+		{"zero policy", Policy{}, append(plain, xmpField, "exif-ifd3-GPSLatitude"), false},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.finds(tt.fields); got != tt.want {
+			t.Errorf("%s: finds = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyKeep(t *testing.T) {
+	if !(Policy{}).IsZero() || Private.IsZero() || (Policy{GPS: true}).IsZero() {
+		t.Fatal("IsZero is wrong")
+	}
+	if keep := (Policy{}).Keep(); keep != vips.KeepAll {
+		t.Errorf("zero policy keeps %v, want everything", keep)
+	}
+	if keep := Private.Keep(); keep != vips.KeepExif|vips.KeepIcc {
+		t.Errorf("Private keeps %v, want EXIF and ICC", keep)
+	}
+}
@@ -0,0 +1,180 @@
+package imagemeta
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// xmpNamespaces are the XMP schemas read, by namespace URI, with the prefix
+// their properties are reported under.
+var xmpNamespaces = map[string]string{
+	"http://purl.org/dc/elements/1.1/":            "dc",
+	"http://ns.adobe.com/xap/1.0/":                "xmp",
+	"http://ns.adobe.com/xap/1.0/rights/":         "xmpRights",
+	"http://ns.adobe.com/photoshop/1.0/":          "photoshop",
+	"http://ns.adobe.com/exif/1.0/":               "exif",
+	"http://ns.adobe.com/exif/1.0/aux/":           "aux",
+	"http://cipa.jp/exif/1.0/":                    "exifEX",
+	"http://ns.adobe.com/tiff/1.0/":               "tiff",
+	"http://iptc.org/std/Iptc4xmpCore/1.0/xmlns/": "Iptc4xmpCore",
+}
+
+const rdfNamespace = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+
+// xmpTimeLayouts are the ISO 8601 forms XMP dates come in, most precise
+// first.
+var xmpTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02",
+}
+
+// parseXMP collects the properties of an XMP packet as "prefix:Name" to
+// values, whether written as attributes of rdf:Description or as elements.
+// Array items (rdf:li) each add a value; properties of nested structures are
+// reported under their own name. Only the schemas in xmpNamespaces are read.
+func parseXMP(packet []byte) map[string][]string {
+	props := map[string][]string{}
+	if len(packet) == 0 {
+		return props
+	}
+
+	decoder := xml.NewDecoder(bytes.NewReader(packet))
+	decoder.Strict = false
+	var stack []string // the property each open element belongs to, "" for none
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			// io.EOF, or the packet breaks off; keep what was read.
+			return props
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+			for _, attr := range t.Attr {
+				if name, ok := xmpName(attr.Name); ok && strings.TrimSpace(attr.Value) != "" {
+					props[name] = append(props[name], strings.TrimSpace(attr.Value))
+				}
+			}
+			property := ""
+			if name, ok := xmpName(t.Name); ok {
+				property = name
+			} else if t.Name.Space == rdfNamespace && len(stack) > 0 {
+				property = stack[len(stack)-1]
+			}
+			stack = append(stack, property)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			text := strings.TrimSpace(string(t))
+			if text != "" && len(stack) > 0 && stack[len(stack)-1] != "" {
+				name := stack[len(stack)-1]
+				props[name] = append(props[name], text)
+			}
+		}
+	}
+}
+
+func xmpName(name xml.Name) (string, bool) {
+	prefix, ok := xmpNamespaces[name.Space]
+	if !ok {
+		return "", false
+	}
+	return prefix + ":" + name.Local, true
+}
+
+func (meta *Metadata) fromXMP(props map[string][]string) {
+	first := func(names ...string) string {
+		for _, name := range names {
+			if values := props[name]; len(values) > 0 {
+				return values[0]
+			}
+		}
+		return ""
+	}
+
+	setIfEmpty(&meta.Make, first("tiff:Make"))
+	setIfEmpty(&meta.Model, first("tiff:Model"))
+	setIfEmpty(&meta.Lens, first("exifEX:LensModel", "aux:Lens"))
+	setIfEmpty(&meta.Title, first("dc:title", "photoshop:Headline"))
+	setIfEmpty(&meta.Description, first("dc:description"))
+	setIfEmpty(&meta.Creator, strings.Join(props["dc:creator"], ", "))
+	setIfEmpty(&meta.Copyright, first("dc:rights"))
+	if len(meta.Keywords) == 0 {
+		meta.Keywords = props["dc:subject"]
+	}
+
+	if meta.ExposureTime == "" {
+		meta.ExposureTime = exposure(first("exif:ExposureTime"))
+	}
+	if f, ok := rational(first("exif:FNumber")); ok && meta.FNumber == 0 {
+		meta.FNumber = round(f, 1)
+	}
+	if f, ok := rational(first("exif:FocalLength")); ok && meta.FocalLength == 0 {
+		meta.FocalLength = round(f, 1)
+	}
+	if iso, err := strconv.Atoi(first("exifEX:PhotographicSensitivity", "exif:ISOSpeedRatings")); err == nil && meta.ISO == 0 {
+		meta.ISO = iso
+	}
+
+	for _, name := range []string{"exif:DateTimeOriginal", "photoshop:DateCreated", "xmp:CreateDate"} {
+		if t, ok := xmpTime(first(name)); ok {
+			meta.setCaptureTime(t)
+			break
+		}
+	}
+
+	if meta.GPS == nil {
+		lat, okLat := xmpCoordinate(first("exif:GPSLatitude"))
+		lon, okLon := xmpCoordinate(first("exif:GPSLongitude"))
+		if okLat && okLon {
+			meta.GPS = &GPS{Latitude: round(lat, 6), Longitude: round(lon, 6)}
+		}
+	}
+}
+
+func xmpTime(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range xmpTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// xmpCoordinate parses the XMP GPS form "DDD,MM.mmmK" or "DDD,MM,SSK",
+// where K is N, S, E or W.
+func xmpCoordinate(value string) (float64, bool) {
+	value = strings.TrimSpace(value)
+	if len(value) < 2 {
+		return 0, false
+	}
+	ref := strings.ToUpper(value[len(value)-1:])
+	if !strings.Contains("NSEW", ref) {
+		return 0, false
+	}
+
+	deg, scale := 0.0, 1.0
+	for _, part := range strings.Split(value[:len(value)-1], ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return 0, false
+		}
+		deg += f / scale
+		scale *= 60
+	}
+	if ref == "S" || ref == "W" {
+		deg = -deg
+	}
+	return deg, true
+}
@@ -0,0 +1,408 @@
+// Package jobs runs background work from a queue kept on disk, so work that
+// was accepted survives a restart. Failed jobs are retried with exponential
+// backoff; those that keep failing are set aside as dead letters, to be
+// inspected and retried by hand.
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	cm "github.com/mahdi-cpp/api-go-settings/internal/collection_manager_v3"
+)
+
+// pollInterval is how often idle workers look for jobs whose retry is due.
+const pollInterval = time.Second
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+var (
+	ErrNotFound = errors.New("job not found")
+	ErrNotDead  = errors.New("job is not a dead letter")
+
+	// ErrPermanent marks a failure retrying cannot fix; handlers wrap it to
+	// have their job dead-lettered at once.
+	ErrPermanent = errors.New("permanent failure")
+)
+
+// State is where a job is in its life.
+type State string
+
+const (
+	StatePending   State = "pending"   // waiting for a worker, or for its retry to be due
+	StateRunning   State = "running"   // taken by a worker
+	StateSucceeded State = "succeeded" // done; kept for Options.Retention
+	StateDead      State = "dead"      // failed every attempt; kept until retried
+)
+
+// Job is one unit of background work of some Kind, with the Payload its
+// handler needs.
+type Job struct {
+	ID               string          `json:"id"`
+	Kind             string          `json:"kind"`
+	UserID           string          `json:"userID,omitempty"`
+	Payload          json.RawMessage `json:"payload,omitempty"`
+	State            State           `json:"state"`
+	Attempts         int             `json:"attempts"`
+	MaxAttempts      int             `json:"maxAttempts"`
+	RunAt            time.Time       `json:"runAt"` // when the job is next due
+	LastError        string          `json:"lastError,omitempty"`
+	ExpiresAt        time.Time       `json:"expiresAt"`
+	CreationDate     time.Time       `json:"creationDate"`
+	ModificationDate time.Time       `json:"modificationDate"`
+}
+
+func (j *Job) SetID(id string)          { j.ID = id }
+func (j *Job) SetCreatedAt(t time.Time) { j.CreationDate = t }
+func (j *Job) SetUpdatedAt(t time.Time) { j.ModificationDate = t }
+func (j *Job) GetID() string            { return j.ID }
+func (j *Job) GetCreatedAt() time.Time  { return j.CreationDate }
+func (j *Job) GetUpdatedAt() time.Time  { return j.ModificationDate }
+func (j *Job) GetExpiresAt() time.Time  { return j.ExpiresAt }
+
+// Decode unmarshals the job's payload into v.
+func (j *Job) Decode(v any) error {
+	if err := json.Unmarshal(j.Payload, v); err != nil {
+		return fmt.Errorf("%w: bad payload: %v", ErrPermanent, err)
+	}
+	return nil
+}
+
+// HandlerFunc runs one attempt of a job. ctx ends when the attempt times
+// out or the queue stops.
+type HandlerFunc func(ctx context.Context, job *Job) error
+
+// Options tune a Queue.
+type Options struct {
+	Workers     int           // jobs run at once
+	MaxAttempts int           // attempts before a job is dead-lettered
+	Backoff     time.Duration // wait before the first retry, doubled for each one after
+	MaxBackoff  time.Duration // longest wait between retries
+	Timeout     time.Duration // how long one attempt may run; 0 means no limit
+	Retention   time.Duration // how long succeeded jobs can still be looked up
+
+	// Clock tells when jobs are due and expire; nil means the system clock.
+	Clock cm.Clock
+	// Gate is passed every write to the queue's collections, typically
+	// snapshot.DefaultGate for a queue inside the data tree; nil means none.
+	Gate cm.WriteGate
+}
+
+// DefaultOptions gives up on a job after about two and a half minutes of
+// retries.
+func DefaultOptions() Options {
+	return Options{
+		Workers:     2,
+		MaxAttempts: 5,
+		Backoff:     10 * time.Second,
+		MaxBackoff:  10 * time.Minute,
+		Timeout:     5 * time.Minute,
+		Retention:   24 * time.Hour,
+	}
+}
+
+// Queue keeps jobs in a directory collection under its directory and dead
+// letters in another beside it. Jobs are only handed out once Start has
+// been called, so every handler can be registered before.
+type Queue struct {
+	opts  Options
+	clock cm.Clock
+	jobs  *cm.Manager[*Job]
+	dead  *cm.Manager[*Job]
+	wake  chan struct{}
+
+	mu       sync.Mutex // guards handlers and serialises claiming jobs
+	handlers map[string]HandlerFunc
+}
+
+// NewQueue opens the queue in dir. Jobs a previous process was running when
+// it stopped are due again.
+func NewQueue(dir string, opts Options) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	clock := opts.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+	collectionOpts := []cm.Option{cm.WithClock(clock)}
+	if opts.Gate != nil {
+		collectionOpts = append(collectionOpts, cm.WithWriteGate(opts.Gate))
+	}
+	jobs, err := cm.NewCollectionManager[*Job](filepath.Join(dir, "jobs"), false, collectionOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load jobs: %w", err)
+	}
+	dead, err := cm.NewCollectionManager[*Job](filepath.Join(dir, "dead"), false, collectionOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load dead letters: %w", err)
+	}
+
+	q := &Queue{opts: opts, clock: clock, jobs: jobs, dead: dead, wake: make(chan struct{}, 1), handlers: map[string]HandlerFunc{}}
+	running, err := jobs.GetList(func(j *Job) bool { return j.State == StateRunning })
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range running {
+		resumed := *job
+		resumed.State = StatePending
+		if _, err := jobs.Update(&resumed); err != nil {
+			return nil, fmt.Errorf("failed to resume job %s: %w", job.ID, err)
+		}
+	}
+	return q, nil
+}
+
+// Import moves the jobs and dead letters of the queue in dir, where earlier
+// versions kept it outside the data tree, into q and removes dir. Jobs that
+// were running are due again; those q holds already are left as they are.
+func (q *Queue) Import(dir string) (int, error) {
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	old, err := NewQueue(dir, Options{})
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, pair := range []struct{ from, to *cm.Manager[*Job] }{{old.jobs, q.jobs}, {old.dead, q.dead}} {
+		jobs, err := pair.from.GetAll()
+		if err != nil {
+			return moved, err
+		}
+		results, _ := pair.to.CreateManyWithID(jobs)
+		for _, result := range results {
+			if result.Err != nil && !errors.Is(result.Err, cm.ErrDuplicateID) {
+				return moved, fmt.Errorf("failed to import job %s: %w", result.ID, result.Err)
+			}
+			if result.Err == nil {
+				moved++
+			}
+		}
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return moved, err
+	}
+	q.notify()
+	return moved, nil
+}
+
+// Handle registers fn to run the jobs of kind.
+func (q *Queue) Handle(kind string, fn HandlerFunc) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[kind] = fn
+}
+
+// Enqueue adds a job of kind for user, with payload marshalled to JSON, due
+// at once.
+func (q *Queue) Enqueue(kind string, user string, payload any) (*Job, error) {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode job payload: %w", err)
+	}
+	job, err := q.jobs.Create(&Job{
+		Kind:        kind,
+		UserID:      user,
+		Payload:     raw,
+		State:       StatePending,
+		MaxAttempts: max(q.opts.MaxAttempts, 1),
+		RunAt:       q.clock.Now(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to queue %s job: %w", kind, err)
+	}
+	q.notify()
+	return job, nil
+}
+
+// Get returns the job with id, whether queued, succeeded or dead.
+func (q *Queue) Get(id string) (*Job, error) {
+	if job, err := q.jobs.Get(id); err == nil {
+		return job, nil
+	}
+	if job, err := q.dead.Get(id); err == nil {
+		return job, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+}
+
+// Dead returns the dead letters filter accepts, newest first; a nil filter
+// accepts all.
+func (q *Queue) Dead(filter func(*Job) bool) ([]*Job, error) {
+	return q.dead.GetSortedList(filter, "modificationDate", "desc")
+}
+
+// Retry puts a dead letter back in the queue with its attempts reset.
+func (q *Queue) Retry(id string) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	dead, err := q.dead.Get(id)
+	if err != nil {
+		if _, err := q.jobs.Get(id); err == nil {
+			return nil, fmt.Errorf("%w: %s", ErrNotDead, id)
+		}
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, id)
+	}
+	job := *dead
+	job.State = StatePending
+	job.Attempts = 0
+	job.RunAt = q.clock.Now()
+	if _, err := q.jobs.CreateWithID(&job); err != nil {
+		return nil, err
+	}
+	if err := q.dead.Delete(id); err != nil {
+		return nil, err
+	}
+	q.notify()
+	return &job, nil
+}
+
+// Start runs the workers and the sweeper of succeeded jobs until ctx is
+// cancelled. An attempt cut short by cancellation runs again after the next
+// start.
+func (q *Queue) Start(ctx context.Context) {
+	q.jobs.StartSweeper(ctx, time.Minute)
+	for i := 0; i < max(q.opts.Workers, 1); i++ {
+		go q.work(ctx)
+	}
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *Queue) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		job, fn := q.claim()
+		if job == nil {
+			select {
+			case <-ctx.Done():
+			case <-q.wake:
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+		q.run(ctx, job, fn)
+	}
+}
+
+// claim takes the pending job that has been due longest and marks it
+// running. Workers get their own copy, so lookups never see a job change
+// under them.
+func (q *Queue) claim() (*Job, HandlerFunc) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.clock.Now()
+	due, err := q.jobs.GetList(func(j *Job) bool {
+		return j.State == StatePending && !j.RunAt.After(now)
+	})
+	if err != nil || len(due) == 0 {
+		return nil, nil
+	}
+	next := due[0]
+	for _, job := range due[1:] {
+		if job.RunAt.Before(next.RunAt) {
+			next = job
+		}
+	}
+
+	job := *next
+	job.State = StateRunning
+	job.Attempts++
+	if _, err := q.jobs.Update(&job); err != nil {
+		log.Printf("failed to claim job %s: %v", job.ID, err)
+		return nil, nil
+	}
+	return &job, q.handlers[job.Kind]
+}
+
+func (q *Queue) run(ctx context.Context, job *Job, fn HandlerFunc) {
+	var err error
+	if fn == nil {
+		err = fmt.Errorf("%w: no handler for %q jobs", ErrPermanent, job.Kind)
+	} else {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		if q.opts.Timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, q.opts.Timeout)
+		}
+		err = call(attemptCtx, fn, job)
+		cancel()
+	}
+	if err != nil && ctx.Err() != nil {
+		// Stopping; the job stays running and is resumed by the next NewQueue.
+		return
+	}
+	q.finish(job, err)
+}
+
+// call runs fn, turning a panic into an error.
+func call(ctx context.Context, fn HandlerFunc, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v\n%s", r, debug.Stack())
+		}
+	}()
+	return fn(ctx, job)
+}
+
+// finish records the outcome of an attempt: success, a retry after backoff,
+// or a dead letter once the job is out of attempts.
+func (q *Queue) finish(job *Job, err error) {
+	now := q.clock.Now()
+	switch {
+	case err == nil:
+		job.State = StateSucceeded
+		job.LastError = ""
+		job.ExpiresAt = now.Add(q.opts.Retention)
+		if _, err := q.jobs.Update(job); err != nil {
+			log.Printf("failed to record job %s: %v", job.ID, err)
+		}
+	case errors.Is(err, ErrPermanent) || job.Attempts >= job.MaxAttempts:
+		job.State = StateDead
+		job.LastError = err.Error()
+		log.Printf("job %s (%s) is dead after %d attempts: %v", job.ID, job.Kind, job.Attempts, err)
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if _, err := q.dead.CreateWithID(job); err != nil {
+			log.Printf("failed to dead-letter job %s: %v", job.ID, err)
+			return
+		}
+		if err := q.jobs.Delete(job.ID); err != nil {
+			log.Printf("failed to remove dead job %s: %v", job.ID, err)
+		}
+	default:
+		job.State = StatePending
+		job.LastError = err.Error()
+		job.RunAt = now.Add(q.backoff(job.Attempts))
+		log.Printf("job %s (%s) failed attempt %d, retrying at %s: %v", job.ID, job.Kind, job.Attempts, job.RunAt.Format(time.RFC3339), err)
+		if _, err := q.jobs.Update(job); err != nil {
+			log.Printf("failed to reschedule job %s: %v", job.ID, err)
+		}
+	}
+}
+
+// backoff is the wait after the given number of failed attempts.
+func (q *Queue) backoff(attempts int) time.Duration {
+	wait := q.opts.Backoff
+	for i := 1; i < attempts && wait < q.opts.MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, q.opts.MaxBackoff)
+}
@@ -0,0 +1,357 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cm "github.com/mahdi-cpp/api-go-settings/internal/collection_manager_v3"
+)
+
+var testEpoch = time.Date(2025, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func newTestQueue(t *testing.T) (*Queue, *cm.FakeClock) {
+	t.Helper()
+	clock := cm.NewFakeClock(testEpoch)
+	q, err := NewQueue(t.TempDir(), Options{
+		Workers:     1,
+		MaxAttempts: 3,
+		Backoff:     10 * time.Second,
+		MaxBackoff:  15 * time.Second,
+		Retention:   time.Hour,
+		Clock:       clock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return q, clock
+}
+
+// drain runs every job that is due, one after the other as a single worker
+// would, and returns how many attempts were made.
+func drain(q *Queue) int {
+	runs := 0
+	for {
+		job, fn := q.claim()
+		if job == nil {
+			return runs
+		}
+		q.run(context.Background(), job, fn)
+		runs++
+	}
+}
+
+func get(t *testing.T, q *Queue, id string) *Job {
+	t.Helper()
+	job, err := q.Get(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return job
+}
+
+func TestRetriedUntilDeadThenRetriedByHand(t *testing.T) {
+	q, clock := newTestQueue(t)
+	var healthy atomic.Bool
+	var calls atomic.Int32
+	q.Handle("flaky", func(ctx context.Context, job *Job) error {
+		calls.Add(1)
+		if healthy.Load() {
+			return nil
+		}
+		return errors.New("still broken")
+	})
+	job, err := q.Enqueue("flaky", "alice", map[string]string{"asset": "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !job.RunAt.Equal(testEpoch) {
+		t.Fatalf("RunAt = %v, want the time of Enqueue", job.RunAt)
+	}
+
+	// Each retry is due once its backoff has passed, not before.
+	for attempt, wait := range []time.Duration{10 * time.Second, 15 * time.Second} {
+		if n := drain(q); n != 1 {
+			t.Fatalf("attempt %d: %d runs", attempt+1, n)
+		}
+		failed := get(t, q, job.ID)
+		if failed.State != StatePending || failed.LastError != "still broken" || !failed.RunAt.Equal(clock.Now().Add(wait)) {
+			t.Fatalf("after attempt %d: %+v", attempt+1, failed)
+		}
+		clock.Advance(wait - time.Nanosecond)
+		if n := drain(q); n != 0 {
+			t.Fatalf("retry ran %v early", time.Nanosecond)
+		}
+		clock.Advance(time.Nanosecond)
+	}
+	if n := drain(q); n != 1 {
+		t.Fatalf("last attempt: %d runs", n)
+	}
+
+	dead := get(t, q, job.ID)
+	if dead.State != StateDead || dead.Attempts != 3 || calls.Load() != 3 {
+		t.Fatalf("dead letter %+v after %d calls, want 3", dead, calls.Load())
+	}
+	letters, err := q.Dead(nil)
+	if err != nil || len(letters) != 1 || letters[0].ID != job.ID {
+		t.Fatalf("Dead = %v, %v", letters, err)
+	}
+
+	healthy.Store(true)
+	retried, err := q.Retry(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retried.Attempts != 0 || retried.State != StatePending || !retried.RunAt.Equal(clock.Now()) {
+		t.Fatalf("retried job = %+v", retried)
+	}
+	if n := drain(q); n != 1 {
+		t.Fatalf("retried job ran %d times", n)
+	}
+	done := get(t, q, job.ID)
+	if done.State != StateSucceeded || done.Attempts != 1 || done.LastError != "" {
+		t.Fatalf("succeeded job = %+v", done)
+	}
+	if letters, _ := q.Dead(nil); len(letters) != 0 {
+		t.Fatalf("dead letters left after retry: %v", letters)
+	}
+	if _, err := q.Retry(job.ID); !errors.Is(err, ErrNotDead) {
+		t.Fatalf("retry of a live job: %v", err)
+	}
+	if _, err := q.Retry("missing"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("retry of an unknown job: %v", err)
+	}
+}
+
+func TestSucceededJobsKeptForRetention(t *testing.T) {
+	q, clock := newTestQueue(t)
+	q.Handle("work", func(ctx context.Context, job *Job) error { return nil })
+	job, err := q.Enqueue("work", "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	drain(q)
+	if done := get(t, q, job.ID); !done.ExpiresAt.Equal(testEpoch.Add(time.Hour)) {
+		t.Fatalf("ExpiresAt = %v", done.ExpiresAt)
+	}
+
+	clock.Advance(time.Hour - time.Nanosecond)
+	if n, _ := q.jobs.SweepExpired(); n != 0 {
+		t.Fatalf("swept %d jobs before their retention ended", n)
+	}
+	clock.Advance(time.Nanosecond)
+	if n, err := q.jobs.SweepExpired(); n != 1 || err != nil {
+		t.Fatalf("sweep: %d, %v", n, err)
+	}
+	if _, err := q.Get(job.ID); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("swept job: %v", err)
+	}
+}
+
+func TestPermanentFailuresAreNotRetried(t *testing.T) {
+	q, clock := newTestQueue(t)
+	q.Handle("bad", func(ctx context.Context, job *Job) error {
+		var payload struct{ Asset int }
+		return job.Decode(&payload)
+	})
+	q.Handle("panics", func(ctx context.Context, job *Job) error {
+		panic("boom")
+	})
+
+	bad, err := q.Enqueue("bad", "alice", map[string]string{"Asset": "not a number"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, err := q.Enqueue("nobody-handles", "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	panics, err := q.Enqueue("panics", "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := drain(q); n != 3 {
+		t.Fatalf("first round: %d runs", n)
+	}
+
+	for _, id := range []string{bad.ID, unknown.ID} {
+		if job := get(t, q, id); job.State != StateDead || job.Attempts != 1 {
+			t.Errorf("job %s = %s after %d attempts, want dead after 1", id, job.State, job.Attempts)
+		}
+	}
+	// A panic is an ordinary failure, retried like any other.
+	for i := 0; i < 2; i++ {
+		clock.Advance(time.Minute)
+		drain(q)
+	}
+	job := get(t, q, panics.ID)
+	if job.State != StateDead || job.Attempts != 3 || !strings.HasPrefix(job.LastError, "panic: boom") {
+		t.Errorf("panicking job = %s, %d attempts, %q", job.State, job.Attempts, job.LastError)
+	}
+}
+
+func TestClaimTakesLongestDueFirst(t *testing.T) {
+	q, clock := newTestQueue(t)
+	var order []string
+	q.Handle("work", func(ctx context.Context, job *Job) error {
+		var name string
+		job.Decode(&name)
+		order = append(order, name)
+		return nil
+	})
+	for _, name := range []string{"first", "second", "third"} {
+		if _, err := q.Enqueue("work", "alice", name); err != nil {
+			t.Fatal(err)
+		}
+		clock.Advance(time.Second)
+	}
+	drain(q)
+	if strings.Join(order, ",") != "first,second,third" {
+		t.Fatalf("ran in order %v", order)
+	}
+}
+
+func TestWorkersRunEnqueuedJobs(t *testing.T) {
+	q, _ := newTestQueue(t)
+	ran := make(chan string, 1)
+	q.Handle("work", func(ctx context.Context, job *Job) error {
+		ran <- job.ID
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	q.Start(ctx)
+
+	// Enqueue wakes an idle worker rather than leaving the job to its poll.
+	job, err := q.Enqueue("work", "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case id := <-ran:
+		if id != job.ID {
+			t.Fatalf("ran %s, want %s", id, job.ID)
+		}
+	case <-time.After(pollInterval / 2):
+		t.Fatal("enqueued job not run")
+	}
+}
+
+func TestBackoffDoublesUpToMax(t *testing.T) {
+	q := &Queue{opts: Options{Backoff: 10 * time.Second, MaxBackoff: time.Minute}}
+	for attempts, want := range map[int]time.Duration{
+		1: 10 * time.Second,
+		2: 20 * time.Second,
+		3: 40 * time.Second,
+		4: time.Minute,
+		9: time.Minute,
+	} {
+		if got := q.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+}
+
+func TestRunningJobsResumeAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	q, err := NewQueue(dir, Options{Workers: 1, MaxAttempts: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := q.Enqueue("work", "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimed, _ := q.claim()
+	if claimed == nil || claimed.ID != job.ID {
+		t.Fatalf("claimed %+v", claimed)
+	}
+
+	restarted, err := NewQueue(dir, Options{Workers: 1, MaxAttempts: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := restarted.Get(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resumed.State != StatePending || resumed.Attempts != 1 {
+		t.Fatalf("resumed job = %+v", resumed)
+	}
+}
+
+// countingGate counts the writes passed through it.
+type countingGate struct{ writes atomic.Int32 }
+
+func (g *countingGate) BeginWrite() func() {
+	g.writes.Add(1)
+	return func() {}
+}
+
+func TestQueueWritesPassTheGate(t *testing.T) {
+	gate := &countingGate{}
+	q, err := NewQueue(t.TempDir(), Options{MaxAttempts: 1, Gate: gate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := q.Enqueue("work", "alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	if gate.writes.Load() == 0 {
+		t.Fatal("Enqueue wrote past the gate")
+	}
+	before := gate.writes.Load()
+	drain(q) // no handler: claimed, then dead-lettered
+	if gate.writes.Load() < before+3 {
+		t.Fatalf("claim and dead-letter made %d gated writes, want 3", gate.writes.Load()-before)
+	}
+}
+
+func TestImportMovesLegacyQueue(t *testing.T) {
+	legacyDir := filepath.Join(t.TempDir(), "jobs")
+	legacy, err := NewQueue(legacyDir, Options{MaxAttempts: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending, err := legacy.Enqueue("work", "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	running, err := legacy.Enqueue("work", "bob", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dead, err := legacy.Enqueue("unhandled", "alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Left running, as by a process that stopped mid attempt, and dead.
+	for _, id := range []string{running.ID, dead.ID} {
+		job, _ := legacy.jobs.Get(id)
+		claimed := *job
+		claimed.State = StateRunning
+		if _, err := legacy.jobs.Update(&claimed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadJob, _ := legacy.jobs.Get(dead.ID)
+	legacy.finish(deadJob, ErrPermanent)
+
+	q, _ := newTestQueue(t)
+	n, err := q.Import(legacyDir)
+	if err != nil || n != 3 {
+		t.Fatalf("Import: %d, %v", n, err)
+	}
+	for id, state := range map[string]State{pending.ID: StatePending, running.ID: StatePending, dead.ID: StateDead} {
+		if job := get(t, q, id); job.State != state {
+			t.Errorf("imported job %s is %s, want %s", id, job.State, state)
+		}
+	}
+	if n, err := q.Import(legacyDir); n != 0 || err != nil {
+		t.Fatalf("second Import: %d, %v", n, err)
+	}
+}
@@ -0,0 +1,69 @@
+// Package snapshot archives the /app/iris data tree into point-in-time
+// snapshots and restores it from them.
+package snapshot
+
+import "sync"
+
+// Gate lets writers to the data tree run concurrently with each other while
+// a snapshot waits for them to finish and holds new ones off. A snapshot
+// only freezes the gate once no write is in progress, and writes only wait
+// while it is frozen, so a write may begin inside another without
+// deadlocking against a snapshot waiting in between.
+type Gate struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	writers int
+	frozen  bool
+}
+
+func NewGate() *Gate {
+	g := &Gate{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// DefaultGate is the gate the server's writers and snapshots share.
+var DefaultGate = NewGate()
+
+// BeginWrite marks the start of a write to the data tree and returns the
+// function that ends it.
+func (g *Gate) BeginWrite() (end func()) {
+	g.mu.Lock()
+	for g.frozen {
+		g.cond.Wait()
+	}
+	g.writers++
+	g.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			g.writers--
+			g.cond.Broadcast()
+			g.mu.Unlock()
+		})
+	}
+}
+
+// freeze waits for the writes in progress and blocks new ones until thaw.
+func (g *Gate) freeze() (thaw func()) {
+	g.mu.Lock()
+	for g.frozen || g.writers > 0 {
+		g.cond.Wait()
+	}
+	g.frozen = true
+	g.mu.Unlock()
+
+	return func() {
+		g.mu.Lock()
+		g.frozen = false
+		g.cond.Broadcast()
+		g.mu.Unlock()
+	}
+}
+
+// BeginWrite begins a write through DefaultGate.
+func BeginWrite() (end func()) {
+	return DefaultGate.BeginWrite()
+}
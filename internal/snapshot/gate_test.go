@@ -0,0 +1,59 @@
+package snapshot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGateNestedWriteWhileFreezePending(t *testing.T) {
+	g := NewGate()
+	endOuter := g.BeginWrite()
+
+	frozen := make(chan func())
+	go func() { frozen <- g.freeze() }()
+	time.Sleep(10 * time.Millisecond)
+
+	// The snapshot waits for the outer write; the inner one must not wait
+	// for the snapshot.
+	done := make(chan struct{})
+	go func() {
+		g.BeginWrite()()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("nested write deadlocked behind a pending freeze")
+	}
+
+	endOuter()
+	select {
+	case thaw := <-frozen:
+		thaw()
+	case <-time.After(time.Second):
+		t.Fatal("freeze did not get the gate once writes ended")
+	}
+}
+
+func TestGateFreezeHoldsOffWrites(t *testing.T) {
+	g := NewGate()
+	thaw := g.freeze()
+
+	began := make(chan struct{})
+	go func() {
+		defer close(began)
+		g.BeginWrite()()
+	}()
+	select {
+	case <-began:
+		t.Fatal("write began while frozen")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	thaw()
+	select {
+	case <-began:
+	case <-time.After(time.Second):
+		t.Fatal("write did not begin after thaw")
+	}
+}
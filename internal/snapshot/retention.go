@@ -0,0 +1,105 @@
+package snapshot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Policy says which archives Prune keeps: the KeepLast newest, plus the
+// newest of each of the KeepDaily most recent days, KeepWeekly ISO weeks and
+// KeepMonthly months that have one. An archive kept by any rule stays. The
+// zero Policy keeps everything.
+type Policy struct {
+	KeepLast    int `json:"keepLast"`
+	KeepDaily   int `json:"keepDaily"`
+	KeepWeekly  int `json:"keepWeekly"`
+	KeepMonthly int `json:"keepMonthly"`
+}
+
+// DefaultPolicy keeps a week of dailies, a month of weeklies and half a
+// year of monthlies.
+var DefaultPolicy = Policy{KeepLast: 3, KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 6}
+
+func (p Policy) keepsAll() bool {
+	return p == Policy{}
+}
+
+// Prune removes the archives in dir that policy does not keep and returns
+// them.
+func Prune(dir string, policy Policy) ([]Info, error) {
+	infos, err := List(dir)
+	if err != nil || policy.keepsAll() {
+		return nil, err
+	}
+
+	keep := make([]bool, len(infos))
+	for i := 0; i < policy.KeepLast && i < len(infos); i++ {
+		keep[i] = true
+	}
+	keepNewestPer(infos, keep, policy.KeepDaily, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keepNewestPer(infos, keep, policy.KeepWeekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	})
+	keepNewestPer(infos, keep, policy.KeepMonthly, func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+
+	var removed []Info
+	for i, info := range infos {
+		if keep[i] {
+			continue
+		}
+		if err := os.Remove(info.Path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, info)
+	}
+	return removed, nil
+}
+
+// keepNewestPer marks the newest archive of each of the n most recent
+// periods; infos is newest first.
+func keepNewestPer(infos []Info, keep []bool, n int, period func(time.Time) string) {
+	seen := map[string]bool{}
+	for i, info := range infos {
+		if len(seen) >= n {
+			return
+		}
+		p := period(info.Time)
+		if !seen[p] {
+			seen[p] = true
+			keep[i] = true
+		}
+	}
+}
+
+// StartScheduler creates a snapshot every interval and prunes by policy
+// afterwards, until ctx is cancelled.
+func StartScheduler(ctx context.Context, opts Options, interval time.Duration, policy Policy) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				info, err := Create(opts)
+				if err != nil {
+					log.Printf("failed to create snapshot: %v", err)
+					continue
+				}
+				log.Printf("created snapshot %s (%d bytes)", info.Name, info.Size)
+				if _, err := Prune(opts.Dir, policy); err != nil {
+					log.Printf("failed to prune snapshots: %v", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,459 @@
+package snapshot
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mahdi-cpp/api-go-settings/internal/config"
+)
+
+const (
+	namePrefix = "iris-"
+	nameSuffix = ".tar.gz"
+	timeFormat = "20060102T150405Z"
+)
+
+var (
+	ErrNotFound    = errors.New("snapshot not found")
+	ErrUnsafeEntry = errors.New("snapshot entry escapes the data tree")
+)
+
+// Options says what to archive and where archives live.
+type Options struct {
+	Root    string   // data tree to archive
+	Dir     string   // directory holding the archives
+	Exclude []string // paths relative to Root left out of archives and kept on restore
+	Gate    *Gate    // writers Create holds off, DefaultGate if nil
+}
+
+// DefaultOptions archives config.GetRootDir into config.GetSnapshotDir. The
+// master keys stay out of the archives, so a leaked snapshot of encrypted
+// collections is of no use on its own.
+func DefaultOptions() Options {
+	return Options{
+		Root:    config.GetRootDir(),
+		Dir:     config.GetSnapshotDir(),
+		Exclude: []string{"keys"},
+		Gate:    DefaultGate,
+	}
+}
+
+func (o Options) gate() *Gate {
+	if o.Gate == nil {
+		return DefaultGate
+	}
+	return o.Gate
+}
+
+// Info describes one archive.
+type Info struct {
+	Name string    `json:"name"`
+	Path string    `json:"path"`
+	Time time.Time `json:"time"`
+	Size int64     `json:"size"`
+
+	seq int // tells apart archives created within the same second
+}
+
+// Create archives the data tree as a gzip-compressed tar. Writes coordinated
+// through the gate of opts wait only while the tree is staged next to the
+// archive, by hard links to files that are replaced rather than written in
+// place and copies of the checksum logs that are appended to, so the archive
+// never holds a half-written item; writes from other processes are not
+// covered.
+func Create(opts Options) (Info, error) {
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return Info{}, err
+	}
+
+	now := time.Now().UTC()
+	name := namePrefix + now.Format(timeFormat) + nameSuffix
+	for i := 1; ; i++ {
+		if _, err := os.Stat(filepath.Join(opts.Dir, name)); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		name = fmt.Sprintf("%s%s-%d%s", namePrefix, now.Format(timeFormat), i, nameSuffix)
+	}
+	path := filepath.Join(opts.Dir, name)
+
+	staging := path + ".staging"
+	if err := os.RemoveAll(staging); err != nil {
+		return Info{}, err
+	}
+	defer os.RemoveAll(staging)
+
+	thaw := opts.gate().freeze()
+	err := stage(opts, staging)
+	thaw()
+	if err != nil {
+		return Info{}, fmt.Errorf("failed to stage the data tree: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := writeArchive(tmp, staging); err != nil {
+		os.Remove(tmp)
+		return Info{}, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return Info{}, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return Info{}, err
+	}
+	return Info{Name: name, Path: path, Time: now.Truncate(time.Second), Size: fi.Size()}, nil
+}
+
+// stage mirrors the data tree into staging, leaving out the archive
+// directory, excluded paths and temporary files.
+func stage(opts Options, staging string) error {
+	root := filepath.Clean(opts.Root)
+	dir := filepath.Clean(opts.Dir)
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if p == dir || excluded(rel, opts.Exclude) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasSuffix(p, ".tmp") {
+			return nil
+		}
+		target := filepath.Join(staging, rel)
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case fi.IsDir():
+			return os.MkdirAll(target, fi.Mode().Perm()|0700)
+		case fi.Mode()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case !fi.Mode().IsRegular():
+			return nil
+		case appendedInPlace(d.Name()):
+			return copyFile(p, target, fi.Mode().Perm())
+		}
+		if err := os.Link(p, target); err != nil {
+			// Another filesystem, or one without hard links.
+			return copyFile(p, target, fi.Mode().Perm())
+		}
+		return nil
+	})
+}
+
+// appendedInPlace reports whether the file named name is written in place,
+// so a hard link to it would keep changing after the tree is thawed. Every
+// other file of the tree is replaced through a rename.
+func appendedInPlace(name string) bool {
+	return name == ".checksums" || strings.HasSuffix(name, ".sum")
+}
+
+func copyFile(src string, dst string, mode fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeArchive writes the tree at root to path.
+func writeArchive(path string, root string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		return addEntry(tw, p, filepath.ToSlash(rel), d)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func excluded(rel string, exclude []string) bool {
+	for _, e := range exclude {
+		e = filepath.Clean(e)
+		if rel == e || strings.HasPrefix(rel, e+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func addEntry(tw *tar.Writer, path string, name string, d fs.DirEntry) error {
+	fi, err := d.Info()
+	if err != nil {
+		return err
+	}
+
+	var link string
+	switch {
+	case fi.Mode().IsRegular(), fi.IsDir():
+	case fi.Mode()&fs.ModeSymlink != 0:
+		if link, err = os.Readlink(path); err != nil {
+			return err
+		}
+	default:
+		return nil
+	}
+
+	hdr, err := tar.FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	if fi.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(tw, src)
+	return err
+}
+
+// List returns the archives in dir, newest first.
+func List(dir string) ([]Info, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []Info
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, namePrefix) || !strings.HasSuffix(name, nameSuffix) {
+			continue
+		}
+		stamp := strings.TrimPrefix(name, namePrefix)
+		if len(stamp) < len(timeFormat) {
+			continue
+		}
+		t, err := time.Parse(timeFormat, stamp[:len(timeFormat)])
+		if err != nil {
+			continue
+		}
+		var seq int
+		if rest := strings.TrimSuffix(stamp[len(timeFormat):], nameSuffix); rest != "" {
+			if _, err := fmt.Sscanf(rest, "-%d", &seq); err != nil {
+				continue
+			}
+		}
+		fi, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, Info{Name: name, Path: filepath.Join(dir, name), Time: t, Size: fi.Size(), seq: seq})
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Time.Equal(infos[j].Time) {
+			return infos[i].seq > infos[j].seq
+		}
+		return infos[i].Time.After(infos[j].Time)
+	})
+	return infos, nil
+}
+
+// Restore replaces the data tree with the named archive. The archive is
+// unpacked next to the tree first; the current tree is then moved aside,
+// and its path returned, with excluded paths carried over into the restored
+// one. If a step after the unpacking fails, the current tree and its
+// excluded paths are put back where they were. The server must be stopped
+// while it runs.
+func Restore(opts Options, name string) (previous string, err error) {
+	archive := filepath.Join(opts.Dir, filepath.Base(name))
+	if _, err := os.Stat(archive); err != nil {
+		return "", fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+
+	root := filepath.Clean(opts.Root)
+	staging := root + ".restoring"
+	if err := os.RemoveAll(staging); err != nil {
+		return "", err
+	}
+	if err := extract(archive, staging); err != nil {
+		os.RemoveAll(staging)
+		return "", fmt.Errorf("failed to unpack %s: %w", name, err)
+	}
+
+	if _, err := os.Stat(root); err != nil {
+		if err := os.Rename(staging, root); err != nil {
+			os.RemoveAll(staging)
+			return "", err
+		}
+		return "", nil
+	}
+
+	// Undone in reverse order should a later step fail.
+	var undo []func() error
+	defer func() {
+		if err == nil {
+			return
+		}
+		for i := len(undo) - 1; i >= 0; i-- {
+			if undoErr := undo[i](); undoErr != nil {
+				err = errors.Join(err, fmt.Errorf("failed to roll back: %w", undoErr))
+			}
+		}
+		os.RemoveAll(staging)
+		previous = ""
+	}()
+	move := func(src, dst string) error {
+		if err := os.Rename(src, dst); err != nil {
+			return err
+		}
+		undo = append(undo, func() error { return os.Rename(dst, src) })
+		return nil
+	}
+
+	for _, e := range opts.Exclude {
+		src, dst := filepath.Join(root, e), filepath.Join(staging, e)
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return "", err
+		}
+		if err := move(src, dst); err != nil {
+			return "", err
+		}
+	}
+	previous = root + ".pre-restore-" + time.Now().UTC().Format(timeFormat)
+	if err := move(root, previous); err != nil {
+		return "", err
+	}
+	if err := os.Rename(staging, root); err != nil {
+		return "", err
+	}
+	return previous, nil
+}
+
+func extract(archive string, dst string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer gz.Close()
+
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.FromSlash(strings.TrimSuffix(hdr.Name, "/"))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("%w: %s", ErrUnsafeEntry, hdr.Name)
+		}
+		target := filepath.Join(dst, name)
+		mode := fs.FileMode(hdr.Mode).Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(out, tr)
+			if closeErr := out.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
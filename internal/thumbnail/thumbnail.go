@@ -10,9 +10,9 @@ import (
 	"time"
 
 	"github.com/cshum/vipsgen/vips"
+	"github.com/mahdi-cpp/api-go-settings/internal/imagemeta"
 )
 
-const userID = "018f3a8b-1b32-729a-f7e5-5467c1b2d3e4"
 const workers = 1
 const maxDimension = 270
 const targetWidth = 270
@@ -23,26 +23,36 @@ func isImageFile(entry os.DirEntry) bool {
 		(strings.HasSuffix(name, ".jpg") ||
 			strings.HasSuffix(name, ".jpeg") ||
 			strings.HasSuffix(name, ".heic") ||
-			strings.HasSuffix(name, ".png"))
+			strings.HasSuffix(name, ".png") ||
+			strings.HasSuffix(name, ".webp") ||
+			strings.HasSuffix(name, ".avif") ||
+			strings.HasSuffix(name, ".gif"))
 }
 
-func CreateSingleThumbnail(src string, fileName string) error {
+// CreateSingleThumbnail creates the thumbnail of src at dst, creating its
+// directory if need be. Thumbnails never carry location, serial numbers or
+// owner names, so they can be served as they are.
+func CreateSingleThumbnail(src string, dst string) error {
 
 	_, err := os.ReadFile(src)
 	if err != nil {
 		return fmt.Errorf("failed to read file: %w", err)
 	}
 
-	if err := processImage(src, "app/tmp/ali/"+fileName); err != nil {
-		log.Printf("failed create single thumbnail %s: %v", src, err)
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("failed to create thumbnails directory: %w", err)
+	}
+	if err := processImage(src, dst); err != nil {
+		return fmt.Errorf("failed to create thumbnail of %s: %w", src, err)
 	}
 
 	return nil
 }
 
-func CreateThumbnails() error {
+// CreateThumbnails creates a thumbnail of every image in basePath, saved
+// under the same name in its thumbnails directory.
+func CreateThumbnails(basePath string) error {
 
-	basePath := filepath.Join("/app/iris/com.iris.photos/users", userID, "zz")
 	thumbPath := filepath.Join(basePath, "thumbnails")
 
 	if err := os.MkdirAll(thumbPath, 0755); err != nil {
@@ -106,7 +116,6 @@ func processImage(filePath string, savePath string) error {
 	defer img.Close()
 	defer source.Close()
 
-	fmt.Println("img orientation ", img.Orientation())
 	var width = 0
 	var height = 0
 	if img.Orientation() == 6 {
@@ -128,7 +137,6 @@ func processImage(filePath string, savePath string) error {
 	// Resize the img
 	err = img.Resize(scale, &vips.ResizeOptions{Kernel: vips.KernelNearest})
 	if err != nil {
-		fmt.Println("1", err.Error())
 		return fmt.Errorf("failed to resize img: %w", err)
 	}
 
@@ -154,17 +162,21 @@ func processImage(filePath string, savePath string) error {
 	//}
 	//} else {
 
-	// Check if the filename has a .heic extension.
-	if strings.HasSuffix(savePath, ".heic") {
+	// Thumbnails are always JPEG, whatever the original format.
+	if ext := strings.ToLower(filepath.Ext(savePath)); ext != ".jpg" && ext != ".jpeg" {
 		// Replace the extension with .jpg.
 		savePath = strings.TrimSuffix(savePath, filepath.Ext(savePath)) + ".jpg"
 	}
 
-	err = img.Jpegsave(savePath, &vips.JpegsaveOptions{})
-	if err != nil {
-		fmt.Println("2 error Jpegsave ", err.Error())
+	// Thumbnails never carry location, serial numbers or owner names.
+	if err := imagemeta.Strip(img, imagemeta.Private); err != nil {
 		return err
 	}
+
+	err = img.Jpegsave(savePath, &vips.JpegsaveOptions{Keep: imagemeta.Private.Keep()})
+	if err != nil {
+		return fmt.Errorf("failed to save thumbnail: %w", err)
+	}
 	//}
 
 	//source.Close()
@@ -206,8 +218,12 @@ func main() {
 	vips.Startup(nil)
 	defer vips.Shutdown()
 
+	if len(os.Args) != 2 {
+		log.Fatalf("usage: %s <directory>", filepath.Base(os.Args[0]))
+	}
+
 	start := time.Now()
-	if err := CreateThumbnails(); err != nil {
+	if err := CreateThumbnails(os.Args[1]); err != nil {
 		log.Fatalf("An error occurred during thumbnail creation: %v", err)
 	}
 	elapsed := time.Since(start)
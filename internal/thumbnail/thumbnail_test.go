@@ -0,0 +1,18 @@
+package thumbnail
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateSingleThumbnailNeedsSource(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "assets", "thumbnails", "a.jpg")
+	if err := CreateSingleThumbnail(filepath.Join(dir, "missing.jpg"), dst); err == nil {
+		t.Fatal("thumbnail of a missing original created")
+	}
+	if _, err := os.Stat(filepath.Dir(dst)); !os.IsNotExist(err) {
+		t.Fatalf("thumbnails directory created for a missing original: %v", err)
+	}
+}
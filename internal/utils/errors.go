@@ -12,6 +12,7 @@ var (
 	ErrAssetNotFound     = errors.New("asset not found")
 	ErrThumbnailNotFound = errors.New("thumbnail not found")
 	ErrFileTooLarge      = errors.New("file size exceeds limit")
+	ErrQuotaExceeded     = errors.New("storage quota exceeded")
 	ErrInvalidUpdate     = errors.New("invalid asset update")
 	ErrMetadataCorrupted = errors.New("metadata corrupted")
 	ErrIndexCorrupted    = errors.New("index corrupted")